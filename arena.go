@@ -0,0 +1,53 @@
+package dory
+
+// Arena is a pre-allocated region of memory which is carved into fixed-size
+// chunks, each backing one table. This gives control over where the cache's
+// memory lives (for example, an explicit huge page mapping, or memory bound to
+// a NUMA node), and avoids a mmap/munmap for every table.
+//
+// Memory returned to the arena is not released to the OS. An Arena can only be
+// used by a single Memcache.
+type Arena struct {
+	chunkSize int
+	numChunks int
+	free      [][]byte
+}
+
+// NewArena creates an arena of chunkSize chunks out of buf. Any space at the
+// end of buf which is smaller than chunkSize is unused.
+func NewArena(buf []byte, chunkSize int) *Arena {
+	if chunkSize <= 0 {
+		panic("invalid chunkSize")
+	}
+	a := &Arena{chunkSize: chunkSize}
+	for off := 0; off+chunkSize <= len(buf); off += chunkSize {
+		a.free = append(a.free, buf[off:off+chunkSize:off+chunkSize])
+	}
+	a.numChunks = len(a.free)
+	return a
+}
+
+// ChunkSize returns the size of each chunk, in bytes.
+func (a *Arena) ChunkSize() int {
+	return a.chunkSize
+}
+
+// Size returns the total size of all chunks, in bytes.
+func (a *Arena) Size() int64 {
+	return int64(a.numChunks) * int64(a.chunkSize)
+}
+
+// Returns a free chunk, or nil if there are none.
+func (a *Arena) alloc() []byte {
+	if len(a.free) == 0 {
+		return nil
+	}
+	buf := a.free[len(a.free)-1]
+	a.free = a.free[:len(a.free)-1]
+	return buf
+}
+
+// Returns a chunk from alloc() to the free list.
+func (a *Arena) release(buf []byte) {
+	a.free = append(a.free, buf)
+}
@@ -0,0 +1,43 @@
+package dory
+
+const (
+	// Number of bits set in a bloom filter for each key.
+	bloomHashes = 4
+)
+
+// bloomFilter is a fixed size bloom filter of key hashes. It never shrinks, so
+// the false positive rate increases as more keys are added.
+type bloomFilter struct {
+	bits []uint64
+}
+
+func newBloomFilter(numBits int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint64, (numBits+63)/64)}
+}
+
+// Returns the |i|th bit index for |hash|, using double hashing to derive each
+// index from the two halves of the hash.
+func (f *bloomFilter) index(hash uint64, i int) uint64 {
+	h1 := hash & 0xffffffff
+	h2 := hash >> 32
+	return (h1 + uint64(i)*h2) % uint64(len(f.bits)*64)
+}
+
+func (f *bloomFilter) add(hash uint64) {
+	for i := 0; i < bloomHashes; i++ {
+		idx := f.index(hash, i)
+		f.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+// Returns whether |hash| may have been added. False positives are possible,
+// but false negatives are not.
+func (f *bloomFilter) mayContain(hash uint64) bool {
+	for i := 0; i < bloomHashes; i++ {
+		idx := f.index(hash, i)
+		if f.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
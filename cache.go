@@ -0,0 +1,20 @@
+package dory
+
+// Cache is the basic set of cache operations, implemented by Memcache. Servers
+// accept a Cache so that they can serve other implementations, such as fakes
+// in tests, or wrappers which add behaviour to a Memcache.
+type Cache interface {
+	Has(key []byte) bool
+	// Get appends the value of key to buf and returns it, or returns nil if
+	// key isn't in the cache.
+	Get(key, buf []byte) []byte
+	Put(key, val []byte) error
+	Delete(key []byte)
+
+	MinKeySize() int
+	MaxKeySize() int
+	MinValSize() int
+	MaxValSize() int
+}
+
+var _ Cache = (*Memcache)(nil)
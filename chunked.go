@@ -0,0 +1,296 @@
+package dory
+
+import (
+	"encoding/binary"
+	"io"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	chunkedInvalidations = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_chunked_invalidations_total",
+		Help: "Number of chunked values dropped because one of their chunks was evicted.",
+	})
+)
+
+func init() {
+	prom.MustRegister(chunkedInvalidations)
+}
+
+// A chunk's key is the value's key, zero padded to maxKeySize, followed by the
+// length of the value's key, the value's generation, and the chunk's index.
+// Being longer than maxKeySize, chunk keys can't collide with any other key.
+const chunkKeySuffixLen = 4 + 8 + 4
+
+// chunkManifest describes a value which is too large for a single entry, so
+// is stored as a sequence of chunks, each in their own entry.
+type chunkManifest struct {
+	// Unique to each chunked value, so that chunks of a replaced value are
+	// never mistaken for chunks of the new one.
+	gen    uint64
+	size   int
+	chunks int
+}
+
+// Returns the maximum size of each chunk, which fits in the same space as the
+// largest regular entry.
+func (c *Memcache) chunkSize() int {
+	return c.maxValSize - chunkKeySuffixLen
+}
+
+// Returns the key of chunk |index| of the key's chunked value.
+func (c *Memcache) chunkKey(key []byte, gen uint64, index int) []byte {
+	ck := make([]byte, c.maxKeySize+chunkKeySuffixLen)
+	copy(ck, key)
+	suffix := ck[c.maxKeySize:]
+	binary.LittleEndian.PutUint32(suffix, uint32(len(key)))
+	binary.LittleEndian.PutUint64(suffix[4:], gen)
+	binary.LittleEndian.PutUint32(suffix[12:], uint32(index))
+	return ck
+}
+
+// Returns whether |key| is the key of a chunk and, if it is, the key of the
+// chunk's value and the chunk's index.
+func (c *Memcache) parseChunkKey(key []byte) ([]byte, int, bool) {
+	if len(key) != c.maxKeySize+chunkKeySuffixLen {
+		return nil, 0, false
+	}
+	suffix := key[c.maxKeySize:]
+	keyLen := binary.LittleEndian.Uint32(suffix)
+	return key[:keyLen], int(binary.LittleEndian.Uint32(suffix[12:])), true
+}
+
+// Returns the manifest of the key's chunked value, if it has one. Only
+// requires the read lock.
+func (c *Memcache) chunkedManifest(key []byte) (chunkManifest, bool) {
+	if len(c.chunked) == 0 {
+		return chunkManifest{}, false
+	}
+	m, ok := c.chunked[string(key)]
+	return m, ok
+}
+
+// Stores the value as chunks, replacing any existing value. If any chunk
+// can't be stored, none of the value is.
+func (c *Memcache) putChunked(key, val []byte) error {
+	existed := c.deleteWithHash(key, c.hashFunc(key))
+	if len(key) > c.maxKeySize || len(val) > c.maxChunkedValSize {
+		return ErrTooLarge
+	}
+
+	c.chunkGen++
+	m := chunkManifest{gen: c.chunkGen, size: len(val)}
+	chunkSize := c.chunkSize()
+	for off := 0; off < len(val); off += chunkSize {
+		end := off + chunkSize
+		if end > len(val) {
+			end = len(val)
+		}
+		ck := c.chunkKey(key, m.gen, m.chunks)
+		err := c.storeWithHash(ck, val[off:end], c.hashFunc(ck), existed)
+		if err != nil {
+			c.deleteChunks(key, m)
+			return err
+		}
+		m.chunks++
+	}
+	c.chunked[string(key)] = m
+	return nil
+}
+
+// Appends the key's chunked value to buf. Returns false if any chunk has been
+// evicted, in which case the value is invalid. Only requires the read lock.
+func (c *Memcache) readChunks(key []byte, m chunkManifest, buf []byte) ([]byte, bool) {
+	if cap(buf)-len(buf) < m.size {
+		newBuf := make([]byte, len(buf), len(buf)+m.size)
+		copy(newBuf, buf)
+		buf = newBuf
+	}
+	for i := 0; i < m.chunks; i++ {
+		ck := c.chunkKey(key, m.gen, i)
+		t, val := c.find(ck, c.hashFunc(ck))
+		if t == nil {
+			return nil, false
+		}
+		buf = append(buf, val...)
+	}
+	return buf, true
+}
+
+// Returns whether every chunk of the key's chunked value is in the cache.
+// Only requires the read lock.
+func (c *Memcache) hasChunks(key []byte, m chunkManifest) bool {
+	for i := 0; i < m.chunks; i++ {
+		ck := c.chunkKey(key, m.gen, i)
+		if t, _ := c.find(ck, c.hashFunc(ck)); t == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Deletes the key's chunked value, if it has one. Returns whether it did.
+func (c *Memcache) deleteChunked(key []byte) bool {
+	m, ok := c.chunkedManifest(key)
+	if !ok {
+		return false
+	}
+	delete(c.chunked, string(key))
+	c.deleteChunks(key, m)
+	return true
+}
+
+// Deletes the first m.chunks chunks of a chunked value.
+func (c *Memcache) deleteChunks(key []byte, m chunkManifest) {
+	for i := 0; i < m.chunks; i++ {
+		ck := c.chunkKey(key, m.gen, i)
+		c.deleteWithHash(ck, c.hashFunc(ck))
+	}
+}
+
+// Deletes a chunked value which has lost a chunk, since it can never be read.
+func (c *Memcache) invalidateChunked(key []byte) {
+	c.deleteChunked(key)
+	c.keyChanged(key)
+	chunkedInvalidations.Inc()
+}
+
+// Deletes chunked values which have lost a chunk to eviction, so that the
+// space used by their remaining chunks can be reclaimed. Returns the number
+// of values deleted.
+func (c *Memcache) sweepChunked() int {
+	deleted := 0
+	for key, m := range c.chunked {
+		if !c.hasChunks([]byte(key), m) {
+			// Deleting from a map during iteration is safe.
+			c.invalidateChunked([]byte(key))
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// WriteValueTo writes the key's value to w, and returns the number of bytes
+// written and whether the key was found. Unlike Get, a chunked value isn't
+// assembled in memory first. Instead, each chunk is copied with the read lock
+// held, and written to w with it released, so the memory used is bounded by
+// the chunk size. If the value changes after part of it has been written,
+// ErrValueChanged is returned. Like Stat, this doesn't promote the key.
+func (c *Memcache) WriteValueTo(key []byte, w io.Writer) (int64, bool, error) {
+	if len(key) == 0 {
+		return 0, false, nil
+	}
+
+	var written int64
+	var gen uint64
+	var buf []byte
+	for i := 0; ; i++ {
+		var ok, done bool
+		buf, gen, ok, done = c.readValueChunk(key, i, gen, buf[:0])
+		if !ok {
+			if i == 0 {
+				return 0, false, nil
+			}
+			return written, true, ErrValueChanged
+		}
+		n, err := w.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, true, err
+		} else if done {
+			return written, true, nil
+		}
+	}
+}
+
+// OpenValue returns a reader of the key's value, and whether the key was
+// found. Like WriteValueTo, a chunked value is read a chunk at a time, so
+// the memory used is bounded by the chunk size, and the caller can read at
+// its own pace without holding the lock. Since tables aren't pinned, if the
+// value changes after the first chunk is read, Read returns ErrValueChanged.
+// The reader should be closed to release its buffer.
+func (c *Memcache) OpenValue(key []byte) (io.ReadCloser, bool) {
+	if len(key) == 0 {
+		return nil, false
+	}
+	r := &valueReader{c: c, key: append([]byte(nil), key...)}
+	var ok bool
+	r.buf, r.gen, ok, r.last = c.readValueChunk(r.key, 0, 0, nil)
+	if !ok {
+		return nil, false
+	}
+	return r, true
+}
+
+// valueReader reads a value a chunk at a time, for OpenValue.
+type valueReader struct {
+	c   *Memcache
+	key []byte
+	// Generation of the value, and the index of the chunk in buf.
+	gen   uint64
+	index int
+	buf   []byte
+	off   int
+	// Whether buf holds the last chunk.
+	last bool
+	// Returned by all subsequent reads, once the value has changed or the
+	// reader has been closed.
+	err error
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for r.off == len(r.buf) {
+		if r.last {
+			return 0, io.EOF
+		}
+		var ok bool
+		r.index++
+		r.buf, _, ok, r.last = r.c.readValueChunk(r.key, r.index, r.gen, r.buf[:0])
+		r.off = 0
+		if !ok {
+			r.err = ErrValueChanged
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.buf[r.off:])
+	r.off += n
+	return n, nil
+}
+
+func (r *valueReader) Close() error {
+	r.err = ErrReaderClosed
+	r.buf = nil
+	return nil
+}
+
+// Appends chunk |index| of the key's value to buf, where the first chunk of a
+// value which isn't chunked is the whole value. gen is the generation of the
+// value's first chunk, or 0 for the first chunk. Returns the buffer, the
+// value's generation, whether the chunk was found (in the same generation),
+// and whether it was the last chunk.
+func (c *Memcache) readValueChunk(key []byte, index int, gen uint64, buf []byte) ([]byte, uint64, bool, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.isExpired(key) {
+		return buf, 0, false, false
+	}
+	if index == 0 {
+		if t, val := c.find(key, c.hashFunc(key)); t != nil {
+			return append(buf, val...), 0, true, true
+		}
+	}
+	m, ok := c.chunkedManifest(key)
+	if !ok || (index > 0 && m.gen != gen) {
+		return buf, 0, false, false
+	}
+	ck := c.chunkKey(key, m.gen, index)
+	t, val := c.find(ck, c.hashFunc(ck))
+	if t == nil {
+		return buf, 0, false, false
+	}
+	return append(buf, val...), m.gen, true, index == m.chunks-1
+}
@@ -2,12 +2,17 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// ErrAtCapacity is returned by Put when the value was stored, but the server
+// had to evict other entries to make room. Clients should slow down writes.
+var ErrAtCapacity = errors.New("value stored, but cache is at capacity")
+
 type Client struct {
 	host       string
 	maxTimeout time.Duration
@@ -78,6 +83,8 @@ func (c *Client) Put(ctx context.Context, key, val []byte) error {
 	status, err := c.client.Set(ctx, string(key), string(val), 0).Result()
 	if err != nil {
 		return err
+	} else if status == "EVICTED" {
+		return ErrAtCapacity
 	} else if status != "OK" {
 		return fmt.Errorf("redis error: %s", status)
 	}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgryski/go-farm"
+)
+
+const (
+	// Number of points on the ring for each node. More points give a more even
+	// distribution of keys, at the cost of a larger ring.
+	ringPointsPerNode = 128
+)
+
+var ErrNoNodes = errors.New("no nodes in ring")
+
+type ringPoint struct {
+	hash uint64
+	addr string
+}
+
+// Ring shards keys across multiple dory instances using consistent hashing.
+// When a node is added or removed, only the keys belonging to that node are
+// remapped, which show up as cache misses.
+type Ring struct {
+	maxTimeout time.Duration
+
+	lock    sync.RWMutex
+	points  []ringPoint
+	clients map[string]*Client
+}
+
+func NewRing(addrs []string, maxTimeout time.Duration) *Ring {
+	r := &Ring{
+		maxTimeout: maxTimeout,
+		clients:    make(map[string]*Client),
+	}
+	for _, addr := range addrs {
+		r.Add(addr)
+	}
+	return r
+}
+
+// Add adds the node at addr to the ring, if it isn't already present.
+func (r *Ring) Add(addr string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.clients[addr]; ok {
+		return
+	}
+	r.clients[addr] = NewClient(addr, r.maxTimeout)
+	for i := 0; i < ringPointsPerNode; i++ {
+		r.points = append(r.points, ringPoint{
+			hash: farm.Hash64([]byte(addr + "#" + strconv.Itoa(i))),
+			addr: addr,
+		})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+// Remove removes the node at addr from the ring, and closes its connection.
+func (r *Ring) Remove(addr string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	client, ok := r.clients[addr]
+	if !ok {
+		return nil
+	}
+	delete(r.clients, addr)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.addr != addr {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+	return client.Close()
+}
+
+// Returns the address of the node which owns the key, or "" if the ring is
+// empty. Must be called with the lock held.
+func (r *Ring) nodeFor(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := farm.Hash64(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		// Wrap around the ring.
+		i = 0
+	}
+	return r.points[i].addr
+}
+
+func (r *Ring) clientFor(key []byte) (*Client, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	addr := r.nodeFor(key)
+	if addr == "" {
+		return nil, ErrNoNodes
+	}
+	return r.clients[addr], nil
+}
+
+func (r *Ring) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var err error
+	for addr, client := range r.clients {
+		if cerr := client.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(r.clients, addr)
+	}
+	r.points = nil
+	return err
+}
+
+func (r *Ring) Has(ctx context.Context, key []byte) (bool, error) {
+	client, err := r.clientFor(key)
+	if err != nil {
+		return false, err
+	}
+	return client.Has(ctx, key)
+}
+
+func (r *Ring) Get(ctx context.Context, key, buf []byte) ([]byte, error) {
+	client, err := r.clientFor(key)
+	if err != nil {
+		return nil, err
+	}
+	return client.Get(ctx, key, buf)
+}
+
+func (r *Ring) Put(ctx context.Context, key, val []byte) error {
+	client, err := r.clientFor(key)
+	if err != nil {
+		return err
+	}
+	return client.Put(ctx, key, val)
+}
+
+func (r *Ring) Delete(ctx context.Context, key []byte) error {
+	client, err := r.clientFor(key)
+	if err != nil {
+		return err
+	}
+	return client.Delete(ctx, key)
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Distribution(t *testing.T) {
+	const numKeys = 100000
+	addrs := []string{"a:6379", "b:6379", "c:6379", "d:6379"}
+	r := NewRing(addrs, 0)
+	defer r.Close()
+
+	counts := make(map[string]int)
+	for i := 0; i < numKeys; i++ {
+		counts[r.nodeFor([]byte(fmt.Sprint(i)))]++
+	}
+	assert.Equal(t, len(addrs), len(counts))
+	for _, addr := range addrs {
+		// Each node should get roughly a quarter of the keys.
+		share := float64(counts[addr]) / numKeys
+		assert.InDelta(t, 0.25, share, 0.1, "node %s", addr)
+	}
+}
+
+func TestRing_Remove(t *testing.T) {
+	const numKeys = 10000
+	r := NewRing([]string{"a:6379", "b:6379", "c:6379"}, 0)
+	defer r.Close()
+
+	before := make([]string, numKeys)
+	for i := range before {
+		before[i] = r.nodeFor([]byte(fmt.Sprint(i)))
+	}
+
+	assert.NoError(t, r.Remove("b:6379"))
+	for i, addr := range before {
+		after := r.nodeFor([]byte(fmt.Sprint(i)))
+		assert.NotEqual(t, "b:6379", after)
+		if addr != "b:6379" {
+			// Keys on the remaining nodes stay where they are.
+			assert.Equal(t, addr, after)
+		}
+	}
+
+	// Adding the node back restores the original mapping.
+	r.Add("b:6379")
+	for i, addr := range before {
+		assert.Equal(t, addr, r.nodeFor([]byte(fmt.Sprint(i))))
+	}
+}
+
+func TestRing_Empty(t *testing.T) {
+	r := NewRing(nil, 0)
+	_, err := r.Has(context.Background(), []byte("foo"))
+	assert.Equal(t, ErrNoNodes, err)
+}
@@ -2,27 +2,90 @@ package dory
 
 import (
 	"container/list"
+	"io"
+	"sync/atomic"
 )
 
+// Maps memory for tables. Replaced by tests to simulate mmap failures.
+var mmapFunc = mmap
+
 // TODO: Rename to MmappedTable?
 type DiscardableTable struct {
-	table   *PackedTable
-	buf     []byte
-	meta    interface{}
-	element *list.Element
+	table           *PackedTable
+	buf             []byte
+	autoGcThreshold int
+	meta            interface{}
+	element         *list.Element
+	// If non-nil, buf is a chunk of arena, instead of being mapped.
+	arena *Arena
+	// If non-nil, buf is returned to pool when discarded, instead of being
+	// unmapped.
+	pool *mapPool
+	// Number of reads of keys in the table, for sampled eviction. Updated with
+	// only the cache's read lock held.
+	accesses atomic.Uint64
+	// Whether buf is cleared when the table is discarded, recycled or reset, so
+	// that old entries don't linger in memory.
+	zeroOnDiscard bool
 
 	keyHashes []uint64
 }
 
-func NewDiscardableTable(size int, meta interface{}) *DiscardableTable {
-	buf, err := mmap(size)
+// NewDiscardableTable maps a new table of the given size. If populate is true,
+// the table's memory is faulted in up front, otherwise pages are faulted in
+// as they are first used.
+func NewDiscardableTable(size, autoGcThreshold int, populate bool, meta interface{}) *DiscardableTable {
+	t, err := newDiscardableTable(size, autoGcThreshold, populate, meta)
 	if err != nil {
 		panic(err)
 	}
+	return t
+}
+
+// newDiscardableTable is like NewDiscardableTable, but returns an error if the
+// table's memory can't be mapped.
+func newDiscardableTable(size, autoGcThreshold int, populate bool, meta interface{}) (*DiscardableTable, error) {
+	buf, err := mmapFunc(size, populate)
+	if err != nil {
+		return nil, err
+	}
+	return &DiscardableTable{
+		table:           NewPackedTable(buf, autoGcThreshold),
+		buf:             buf,
+		autoGcThreshold: autoGcThreshold,
+		meta:            meta,
+	}, nil
+}
+
+// newPooledTable is like newDiscardableTable, but reuses a mapping from |pool|
+// if possible, and returns the mapping to the pool when discarded.
+func newPooledTable(pool *mapPool, size, autoGcThreshold int, populate bool, meta interface{}) (*DiscardableTable, error) {
+	buf, err := pool.alloc(size, populate)
+	if err != nil {
+		return nil, err
+	}
+	return &DiscardableTable{
+		table:           NewPackedTable(buf, autoGcThreshold),
+		buf:             buf,
+		autoGcThreshold: autoGcThreshold,
+		meta:            meta,
+		pool:            pool,
+	}, nil
+}
+
+// newArenaTable creates a table backed by a chunk of |arena|. Returns nil if
+// the arena has no free chunks.
+func newArenaTable(arena *Arena, autoGcThreshold int, meta interface{}) *DiscardableTable {
+	buf := arena.alloc()
+	if buf == nil {
+		return nil
+	}
 	return &DiscardableTable{
-		table: NewPackedTable(buf, len(buf)/4),
-		buf:   buf,
-		meta:  meta,
+		table:           NewPackedTable(buf, autoGcThreshold),
+		buf:             buf,
+		autoGcThreshold: autoGcThreshold,
+		meta:            meta,
+		arena:           arena,
 	}
 }
 
@@ -31,10 +94,15 @@ func (t *DiscardableTable) Recycle(meta interface{}) *DiscardableTable {
 		panic("t.table == nil")
 	}
 	newTable := &DiscardableTable{
-		table: NewPackedTable(t.buf, len(t.buf)/4),
-		buf:   t.buf,
-		meta:  meta,
+		table:           NewPackedTable(t.buf, t.autoGcThreshold),
+		buf:             t.buf,
+		autoGcThreshold: t.autoGcThreshold,
+		meta:            meta,
+		arena:           t.arena,
+		pool:            t.pool,
+		zeroOnDiscard:   t.zeroOnDiscard,
 	}
+	t.zero()
 	t.table = nil
 	t.buf = nil
 	return newTable
@@ -56,8 +124,14 @@ func (t *DiscardableTable) Discard() {
 	if t.table == nil {
 		return
 	}
-	err := munmap(t.buf)
-	if err != nil {
+	t.zero()
+	if t.arena != nil {
+		t.arena.release(t.buf)
+	} else if t.pool != nil {
+		if err := t.pool.release(t.buf); err != nil {
+			panic(err)
+		}
+	} else if err := munmap(t.buf); err != nil {
 		panic(err)
 	}
 	t.table = nil
@@ -70,6 +144,30 @@ func (t *DiscardableTable) Reset() {
 	}
 	t.table.Reset()
 	t.keyHashes = nil
+	t.zero()
+}
+
+// Clears the table's memory if zeroOnDiscard is set.
+func (t *DiscardableTable) zero() {
+	if !t.zeroOnDiscard {
+		return
+	}
+	// Compiled to a memclr.
+	for i := range t.buf {
+		t.buf[i] = 0
+	}
+}
+
+func (t *DiscardableTable) GC() {
+	if t.table == nil {
+		panic("t.table == nil")
+	}
+	t.table.GC()
+}
+
+// Size returns the size of the table's buffer, in bytes.
+func (t *DiscardableTable) Size() int {
+	return len(t.buf)
 }
 
 func (t *DiscardableTable) NumEntries() int {
@@ -107,6 +205,13 @@ func (t *DiscardableTable) DeletedSpace() int {
 	return t.table.DeletedSpace()
 }
 
+func (t *DiscardableTable) Keys() [][]byte {
+	if t.table == nil {
+		return nil
+	}
+	return t.table.Keys()
+}
+
 func (t *DiscardableTable) Has(key []byte) bool {
 	if t.table == nil {
 		return false
@@ -121,6 +226,20 @@ func (t *DiscardableTable) Get(key []byte) []byte {
 	return t.table.Get(key)
 }
 
+func (t *DiscardableTable) EntryOffset(key []byte) int {
+	if t.table == nil {
+		return -1
+	}
+	return t.table.EntryOffset(key)
+}
+
+func (t *DiscardableTable) Epoch() uint32 {
+	if t.table == nil {
+		return 0
+	}
+	return t.table.Epoch()
+}
+
 func (t *DiscardableTable) Put(key, val []byte, hash uint64) error {
 	if t.table == nil {
 		return nil
@@ -129,6 +248,13 @@ func (t *DiscardableTable) Put(key, val []byte, hash uint64) error {
 	return t.table.Put(key, val)
 }
 
+func (t *DiscardableTable) Overwrite(key, val []byte) bool {
+	if t.table == nil {
+		return false
+	}
+	return t.table.Overwrite(key, val)
+}
+
 func (t *DiscardableTable) Delete(key []byte) bool {
 	if t.table == nil {
 		return false
@@ -136,6 +262,20 @@ func (t *DiscardableTable) Delete(key []byte) bool {
 	return t.table.Delete(key)
 }
 
+func (t *DiscardableTable) Verify() error {
+	if t.table == nil {
+		return nil
+	}
+	return t.table.Verify()
+}
+
+func (t *DiscardableTable) WriteEntries(w io.Writer, skip func(key []byte) bool) (int64, error) {
+	if t.table == nil {
+		return 0, nil
+	}
+	return t.table.writeEntries(w, skip)
+}
+
 func (t *DiscardableTable) KeyHashes() []uint64 {
 	return t.keyHashes
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -10,6 +12,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -24,7 +27,15 @@ const (
 )
 
 var (
-	listenAddr = flag.String("listen-addr", "0.0.0.0:6379", "Address/port to listen on")
+	listenAddr   = flag.String("listen-addr", "0.0.0.0:6379", "Address/port to listen on")
+	network      = flag.String("network", "tcp4", "Network to listen on: tcp4, tcp6 or tcp (dual-stack)")
+	protocol     = flag.String("protocol", "redis", "Protocol to serve: redis, memcached or memcached-binary")
+	tcpKeepAlive = flag.Duration("tcp-keepalive", 0,
+		"TCP keep-alive period for client connections. 0 = Go default (15s), negative = disabled")
+	allowCidr = flag.String("allow-cidr", "",
+		"Comma-separated CIDR ranges of clients allowed to connect. Default empty = all not denied")
+	denyCidr = flag.String("deny-cidr", "",
+		"Comma-separated CIDR ranges of clients not allowed to connect")
 
 	minAvailableMb        = flag.Int("min-available-mb", 512, "Minimum available memory, in MiB")
 	maxKeySize            = flag.Int("max-key-size", 1024, "Max key size in bytes")
@@ -32,13 +43,159 @@ var (
 	oomAdj                = flag.Bool("oom-adj", true, "Adjust OOM score so that we're killed first")
 	maxConcurrentRequests = flag.Int(
 		"max-concurrent-requests", 64, "Maximum number of concurrent get/put requests")
+	maxConcurrentReads = flag.Int("max-concurrent-reads", 0,
+		"Maximum number of redis commands reading the cache at once. Default 0 = unlimited")
+	maxConcurrentWrites = flag.Int("max-concurrent-writes", 0,
+		"Maximum number of redis commands writing to the cache at once. Default 0 = unlimited")
 	constCacheSizeMb = flag.Int("const-cache-size-mb", 0,
 		"Constant cache size, in MiB. Default 0 = use all available memory up to --min-available-mb")
+	gcThresholdFraction = flag.Float64("gc-threshold-fraction", dory.DefaultGcThresholdFraction,
+		"Fraction of a table's space taken up by deleted entries before it is compacted")
+	largeValThreshold = flag.Int("large-val-threshold", 0,
+		"Values larger than this many bytes are stored in separate large tables. Default 0 = disabled")
+	largeTableSizeMb = flag.Int("large-table-size-mb", dory.DefaultLargeTableSize/megabyte,
+		"Size of tables used to store large values, in MiB")
+	maxChunkedValSize = flag.Int("max-chunked-val-size", 0,
+		"If non-zero, store values larger than --max-val-size, up to this many bytes, split into chunks")
+	reserveTables = flag.Int("reserve-tables", 0,
+		"Number of empty tables to keep mapped for reuse, instead of releasing them")
+	seenKeysFilterMb = flag.Int("seen-keys-filter-mb", 0,
+		"If non-zero, size in MiB of a bloom filter of stored keys, used by WASCACHED")
+	frequencySketchMb = flag.Int("frequency-sketch-mb", 0,
+		"If non-zero, size in MiB of a sketch estimating how often keys are read, used by OBJECT FREQ")
+	hotKeySampleRate = flag.Int("hot-key-sample-rate", 0,
+		"If non-zero, track the most read keys for DEBUG HOTKEYS, counting one in this many reads")
+	evictionSamples = flag.Int("eviction-samples", 0,
+		"If greater than 1, evict the least read of this many oldest tables, instead of the oldest table")
+	mapPoolTables = flag.Int("map-pool-tables", 4,
+		"Number of discarded table mappings to keep for reuse, instead of unmapping them")
+	lazyTables = flag.Bool("lazy-tables", false,
+		"Fault in table memory on first use, instead of when the table is created")
+	zeroOnDiscard = flag.Bool("zero-on-discard", false,
+		"Clear the memory of discarded and emptied tables, so that old values don't linger in memory")
+	disablePromotion = flag.Bool("disable-promotion", false,
+		"Don't move old keys to the newest table on get, making eviction FIFO instead of LRU")
+	promotionMinAge = flag.Int("promotion-min-age", dory.DefaultPromotionMinAge,
+		"Minimum age, in tables, of a key before get moves it to the newest table")
+	promotionTableFraction = flag.Float64("promotion-table-fraction", dory.DefaultPromotionTableFraction,
+		"Minimum age of a key before get moves it to the newest table, as a fraction of the number of tables")
+	singleFlightGets = flag.Bool("single-flight-gets", false,
+		"Combine concurrent gets of the same key which need to promote or expire the key into one")
+	freeSearchTables = flag.Int("free-search-tables", dory.DefaultFreeSearchTables,
+		"Number of recent tables searched for free space before creating a new table")
+	softLimitFraction = flag.Float64("soft-limit-fraction", 0,
+		"If non-zero, reject new keys instead of evicting once table memory reaches this fraction of the limit")
+	compactionThreshold = flag.Float64("compaction-threshold", 0,
+		"If non-zero, compact fragmented tables in the background once deleted entries take up this fraction of table memory")
+	scrubInterval = flag.Duration("scrub-interval", 0,
+		"If non-zero, verify the integrity of one table every interval, discarding corrupt tables")
 
 	promPort  = flag.Int("prom-port", 0, "Port to export prometheus metrics")
 	pprofAddr = flag.String("pprof-addr", "", "Address/port to serve pprof")
+
+	preloadFile = flag.String("preload-file", "",
+		"File of length-prefixed key/value pairs to load into the cache at startup")
+	migrateAddr = flag.String("migrate-addr", "",
+		"Address/port to serve /_dump, /_load and /_replicate, for migrating and replicating cache contents")
+	replicateFrom = flag.String("replicate-from", "",
+		"URL of a primary's /_replicate endpoint to replicate from, making this a read replica")
+
+	enableDebugCommands = flag.Bool("enable-debug-commands", false,
+		"Enable DEBUG SLEEP and DEBUG OBJECT, for testing")
+	reportEvictionsOnSet = flag.Bool("report-evictions-on-set", false,
+		"Reply to SET with EVICTED instead of OK when it caused an eviction, so clients can slow down")
+	enableEvictionNotifications = flag.Bool("enable-eviction-notifications", false,
+		"Enable WATCH-EVICTIONS, which notifies clients of evicted keys")
+	writeBufferSize = flag.Int("write-buffer-size", 4096,
+		"Default size of each redis connection's write buffer, in bytes")
+	textProtocol = flag.Bool("text-protocol", false,
+		"Serve the plain text line protocol on all connections, instead of detecting it")
+	lenientLineEndings = flag.Bool("lenient-line-endings", false,
+		"Accept a lone LF, as well as CRLF, as the line terminator in redis commands")
+
+	selfTest = flag.Bool("self-test", false,
+		"Check that the cache works on this host with the given options, then exit")
 )
 
+func preloadCache(cache *dory.Memcache, path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return cache.LoadFrom(f)
+}
+
+// filteredListener closes connections from clients which aren't allowed by
+// the filter, like the main listener.
+type filteredListener struct {
+	net.Listener
+	filter *server.AddrFilter
+}
+
+func (l filteredListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.Allowed(c.RemoteAddr()) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func serveMigration(cache *dory.Memcache, addr string, filter *server.AddrFilter, readOnly bool) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(filteredListener{l, filter}, migrationHandler(cache, readOnly))
+}
+
+// Returns the handler for /_dump, /_load and /_replicate. A read only replica
+// rejects /_load, like any other write.
+func migrationHandler(cache *dory.Memcache, readOnly bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_dump", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err := cache.DumpTo(w)
+		if err != nil {
+			log.Print("Error dumping cache: ", err)
+		}
+	})
+	mux.HandleFunc("/_load", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		} else if readOnly {
+			http.Error(w, "can't load into a read only replica", http.StatusForbidden)
+			return
+		}
+		loaded, skipped, err := cache.LoadFrom(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "loaded %d, skipped %d\n", loaded, skipped)
+	})
+	mux.HandleFunc("/_replicate", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		err := cache.Subscribe(w)
+		log.Printf("Replication to %s stopped: %v", req.RemoteAddr, err)
+	})
+	return mux
+}
+
 func main() {
 	runtime.SetBlockProfileRate(100)
 	runtime.SetMutexProfileFraction(100)
@@ -76,14 +233,122 @@ func main() {
 		MemoryFunction: dory.AvailableMemory(int64(*minAvailableMb)*megabyte, 1.0),
 		MaxKeySize:     *maxKeySize,
 		MaxValSize:     *maxValSize,
+
+		GcThresholdFraction:     *gcThresholdFraction,
+		LargeValueThreshold:     *largeValThreshold,
+		LargeTableSize:          *largeTableSizeMb * megabyte,
+		MaxChunkedValSize:       *maxChunkedValSize,
+		DisablePromotion:        *disablePromotion,
+		PromotionMinAge:         *promotionMinAge,
+		PromotionTableFraction:  *promotionTableFraction,
+		FreeSearchTables:        *freeSearchTables,
+		SingleFlightGets:        *singleFlightGets,
+		ReserveTables:           *reserveTables,
+		MapPoolTables:           *mapPoolTables,
+		EvictionSamples:         *evictionSamples,
+		SeenKeysFilterBits:      *seenKeysFilterMb * megabyte * 8,
+		FrequencySketchCounters: *frequencySketchMb * megabyte / 4,
+		HotKeySampleRate:        *hotKeySampleRate,
+		DisablePopulate:         *lazyTables,
+		ZeroOnDiscard:           *zeroOnDiscard,
+		ScrubInterval:           *scrubInterval,
+		SoftLimitFraction:       *softLimitFraction,
+		CompactionThreshold:     *compactionThreshold,
+	}
+	if *selfTest {
+		err := dory.SelfTest(cacheOpts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Self-test failed:", err)
+			os.Exit(1)
+		}
+		log.Print("Self-test passed")
+		os.Exit(0)
 	}
 	if *constCacheSizeMb != 0 {
 		cacheOpts.MemoryFunction = dory.ConstantMemory(int64(*constCacheSizeMb) * megabyte)
 	}
+	var evictionWatchers *server.EvictionWatchers
+	if *enableEvictionNotifications {
+		evictionWatchers = server.NewEvictionWatchers()
+		cacheOpts.OnEvict = evictionWatchers.Notify
+	}
+	addrFilter, err := server.NewAddrFilter(*allowCidr, *denyCidr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	cache := dory.NewMemcache(cacheOpts)
+	if *preloadFile != "" {
+		loaded, skipped, err := preloadCache(cache, *preloadFile)
+		if err != nil {
+			log.Print("Error preloading cache: ", err)
+		}
+		log.Printf("Preloaded %d entries from %s, skipped %d", loaded, *preloadFile, skipped)
+	}
+	if *migrateAddr != "" {
+		go func() {
+			err := serveMigration(cache, *migrateAddr, addrFilter, *replicateFrom != "")
+			if err != nil {
+				panic(err)
+			}
+		}()
+	}
+	if *replicateFrom != "" {
+		go dory.NewReplicaClient(cache, *replicateFrom).Run()
+	}
 	redisServer := server.NewRedisServer(cache)
+	redisServer.SetConcurrencyLimits(*maxConcurrentReads, *maxConcurrentWrites)
+	redisServer.SetWriteBufferSize(*writeBufferSize)
+	if *replicateFrom != "" {
+		redisServer.SetReadOnly()
+	}
+	if *enableDebugCommands {
+		redisServer.EnableDebugCommands()
+	}
+	if *reportEvictionsOnSet {
+		redisServer.ReportEvictionsOnSet()
+	}
+	if evictionWatchers != nil {
+		redisServer.SetEvictionWatchers(evictionWatchers)
+	}
+	if *textProtocol {
+		redisServer.SetTextProtocol()
+	}
+	if *lenientLineEndings {
+		redisServer.SetLenientLineEndings()
+	}
 
-	l, err := net.Listen("tcp4", *listenAddr)
+	var serve func(conn io.ReadWriter) error
+	switch *protocol {
+	case "redis":
+		serve = redisServer.Serve
+	case "memcached":
+		memcachedServer := server.NewMemcachedServer(cache)
+		if *replicateFrom != "" {
+			memcachedServer.SetReadOnly()
+		}
+		serve = memcachedServer.Serve
+	case "memcached-binary":
+		memcachedServer := server.NewMemcachedBinaryServer(cache)
+		if *replicateFrom != "" {
+			memcachedServer.SetReadOnly()
+		}
+		serve = memcachedServer.Serve
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown protocol %q\n", *protocol)
+		os.Exit(1)
+	}
+
+	switch *network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown network %q\n", *network)
+		os.Exit(1)
+	}
+
+	lc := net.ListenConfig{KeepAlive: *tcpKeepAlive}
+	l, err := lc.Listen(context.Background(), *network, *listenAddr)
 	if err != nil {
 		panic(err)
 	}
@@ -93,11 +358,29 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		if !addrFilter.Allowed(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		if tc, ok := c.(*net.TCPConn); ok {
+			// Go enables this by default, but be explicit since replies to
+			// single commands would otherwise be delayed by Nagle's algorithm.
+			// Pipelined replies are already batched before being flushed.
+			tc.SetNoDelay(true)
+		}
 		go func() {
 			defer c.Close()
-			err := redisServer.Serve(c)
+			defer func() {
+				// A bug triggered by one connection shouldn't take down the server.
+				if r := recover(); r != nil {
+					log.Printf("Panic serving %v: %v\n%s", c.RemoteAddr(), r, debug.Stack())
+				}
+			}()
+			cc := server.NewCountingConn(c)
+			err := serve(cc)
 			if err != nil && !strings.Contains(err.Error(), "connection reset by peer") {
-				log.Print("Redis server error: ", err)
+				log.Printf("%s server error from %v (read %d bytes, wrote %d bytes): %v",
+					*protocol, c.RemoteAddr(), cc.BytesRead(), cc.BytesWritten(), err)
 			}
 		}()
 	}
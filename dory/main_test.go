@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akmistry/dory"
+)
+
+func newTestCache() *dory.Memcache {
+	return dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+}
+
+func TestMigrationHandler(t *testing.T) {
+	src := newTestCache()
+	defer src.Close()
+	assert.NoError(t, src.Put([]byte("foo"), []byte("11")))
+	dst := newTestCache()
+	defer dst.Close()
+
+	rec := httptest.NewRecorder()
+	migrationHandler(src, false).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_dump", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	dump := rec.Body.Bytes()
+
+	// A replica rejects loads.
+	rec = httptest.NewRecorder()
+	migrationHandler(dst, true).ServeHTTP(rec,
+		httptest.NewRequest(http.MethodPost, "/_load", bytes.NewReader(dump)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.False(t, dst.Has([]byte("foo")))
+
+	rec = httptest.NewRecorder()
+	migrationHandler(dst, false).ServeHTTP(rec,
+		httptest.NewRequest(http.MethodPost, "/_load", bytes.NewReader(dump)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "loaded 1, skipped 0\n", rec.Body.String())
+	assert.Equal(t, []byte("11"), dst.Get([]byte("foo"), nil))
+}
+
+func TestPreloadCache(t *testing.T) {
+	src := newTestCache()
+	defer src.Close()
+	assert.NoError(t, src.Put([]byte("foo"), []byte("11")))
+	assert.NoError(t, src.Put([]byte("bar"), []byte("22")))
+
+	path := filepath.Join(t.TempDir(), "dump")
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	_, err = src.DumpTo(f)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	dst := newTestCache()
+	defer dst.Close()
+	loaded, skipped, err := preloadCache(dst, path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+	assert.Equal(t, 0, skipped)
+	assert.Equal(t, []byte("11"), dst.Get([]byte("foo"), nil))
+	assert.Equal(t, []byte("22"), dst.Get([]byte("bar"), nil))
+
+	_, _, err = preloadCache(dst, filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
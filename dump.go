@@ -0,0 +1,225 @@
+package dory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Flag set in the key length of a dumped entry which has a TTL. The remaining
+// TTL, in milliseconds, follows the value length as a little-endian uint64.
+// Keys are far smaller than 2GiB, so older dumps never have the flag set.
+const dumpTTLFlag = 1 << 31
+
+// DumpTo writes the contents of the cache to w, as a sequence of entries each
+// consisting of a 4-byte little-endian key length, 4-byte little-endian value
+// length, key, and value. The cache is only locked while each table is being
+// copied, so the dump is not a consistent snapshot, and a key may appear more
+// than once if it moves between tables. Later entries take precedence. Keys
+// with a TTL have dumpTTLFlag set in their key length, and their remaining TTL
+// written after the value length. Expired keys are left out. An entry with an
+// empty value, as written by LoggingCache, is a deletion of the key.
+func (c *Memcache) DumpTo(w io.Writer) (int64, error) {
+	var written int64
+	err := c.dumpTables(func(chunk []byte) error {
+		n, err := w.Write(chunk)
+		written += int64(n)
+		return err
+	})
+	return written, err
+}
+
+// Calls fn with the entries of each table, oldest first, in the format
+// written by DumpTo. The chunk passed to fn is only valid until fn returns.
+func (c *Memcache) dumpTables(fn func(chunk []byte) error) error {
+	c.lock.RLock()
+	tables := make([]*DiscardableTable, 0, c.tables.Len())
+	// Oldest tables first, so that newer values are written last.
+	for e := c.tables.Back(); e != nil; e = e.Prev() {
+		tables = append(tables, e.Value.(*DiscardableTable))
+	}
+	c.lock.RUnlock()
+
+	// Chunks are internal entries, which are only meaningful to this cache, so
+	// chunked values are written whole, under their own keys, instead. Keys
+	// with a TTL are written separately, with their remaining TTL.
+	skip := func(key []byte) bool {
+		if _, _, ok := c.parseChunkKey(key); ok {
+			return true
+		}
+		_, hasTTL := c.expiries[string(key)]
+		return hasTTL
+	}
+	var buf bytes.Buffer
+	for _, t := range tables {
+		buf.Reset()
+		c.lock.RLock()
+		// Writing to a bytes.Buffer never fails. Tables which have since been
+		// discarded or recycled have no entries.
+		t.WriteEntries(&buf, skip)
+		c.lock.RUnlock()
+
+		if buf.Len() == 0 {
+			continue
+		}
+		err := fn(buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.dumpTTLs(fn); err != nil {
+		return err
+	}
+	return c.dumpChunked(fn)
+}
+
+// Appends the header and key of a dumped entry to buf. A TTL of 0 is no TTL.
+func appendDumpHeader(buf, key []byte, valLen int, ttl time.Duration) []byte {
+	keyLen := uint32(len(key))
+	if ttl > 0 {
+		keyLen |= dumpTTLFlag
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, keyLen)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(valLen))
+	if ttl > 0 {
+		// Round up, so that a key which is about to expire still has a TTL.
+		buf = binary.LittleEndian.AppendUint64(buf, uint64((ttl+time.Millisecond-1)/time.Millisecond))
+	}
+	return append(buf, key...)
+}
+
+// Calls fn with each unexpired value with a TTL, other than chunked values, in
+// the format written by DumpTo.
+func (c *Memcache) dumpTTLs(fn func(chunk []byte) error) error {
+	c.lock.RLock()
+	keys := make([]string, 0, len(c.expiries))
+	for key := range c.expiries {
+		keys = append(keys, key)
+	}
+	c.lock.RUnlock()
+
+	var buf []byte
+	for _, key := range keys {
+		c.lock.RLock()
+		t, val := c.find([]byte(key), c.hashFunc([]byte(key)))
+		ok := t != nil && !c.isExpired([]byte(key))
+		if ok {
+			buf = appendDumpHeader(buf[:0], []byte(key), len(val), c.ttl([]byte(key)))
+			buf = append(buf, val...)
+		}
+		c.lock.RUnlock()
+
+		if !ok {
+			continue
+		}
+		err := fn(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn with each unexpired chunked value, reassembled under its key, in
+// the format written by DumpTo.
+func (c *Memcache) dumpChunked(fn func(chunk []byte) error) error {
+	c.lock.RLock()
+	keys := make([]string, 0, len(c.chunked))
+	for key := range c.chunked {
+		keys = append(keys, key)
+	}
+	c.lock.RUnlock()
+
+	var buf []byte
+	for _, key := range keys {
+		c.lock.RLock()
+		m, ok := c.chunkedManifest([]byte(key))
+		ok = ok && !c.isExpired([]byte(key))
+		if ok {
+			buf = appendDumpHeader(buf[:0], []byte(key), m.size, c.ttl([]byte(key)))
+			buf, ok = c.readChunks([]byte(key), m, buf)
+		}
+		c.lock.RUnlock()
+
+		// Values which have since been replaced, deleted, expired, or lost a
+		// chunk, are skipped.
+		if !ok {
+			continue
+		}
+		err := fn(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFrom reads entries written by DumpTo (or LoggingCache) from r, and
+// stores them in the cache, with their TTL if they have one, or deletes the
+// key for entries with an empty value. Returns the number of entries loaded,
+// including deletions, and the number skipped because they are too large for
+// the cache.
+func (c *Memcache) LoadFrom(r io.Reader) (int, int, error) {
+	bufr := bufio.NewReader(r)
+	var header [prefixLen]byte
+	var ttlBuf [8]byte
+	var buf []byte
+	loaded := 0
+	skipped := 0
+	for {
+		_, err := io.ReadFull(bufr, header[:])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return loaded, skipped, err
+		}
+		rawKeyLen := binary.LittleEndian.Uint32(header[:])
+		keyLen := int(rawKeyLen &^ dumpTTLFlag)
+		valLen := int(binary.LittleEndian.Uint32(header[4:]))
+		var ttl time.Duration
+		if rawKeyLen&dumpTTLFlag != 0 {
+			_, err = io.ReadFull(bufr, ttlBuf[:])
+			if err != nil {
+				return loaded, skipped, err
+			}
+			ttl = time.Duration(binary.LittleEndian.Uint64(ttlBuf[:])) * time.Millisecond
+		}
+
+		isDelete := valLen == 0
+		if keyLen < c.MinKeySize() || keyLen > c.MaxKeySize() ||
+			(!isDelete && (valLen < c.MinValSize() || valLen > c.MaxValSize())) {
+			// Skip without reading the entry into memory.
+			_, err = bufr.Discard(keyLen + valLen)
+			if err != nil {
+				return loaded, skipped, err
+			}
+			skipped++
+			continue
+		}
+
+		if cap(buf) < keyLen+valLen {
+			buf = make([]byte, keyLen+valLen)
+		}
+		buf = buf[:keyLen+valLen]
+		_, err = io.ReadFull(bufr, buf)
+		if err != nil {
+			return loaded, skipped, err
+		}
+		if isDelete {
+			c.Delete(buf)
+			loaded++
+			continue
+		}
+		err = c.PutWithTTL(buf[:keyLen], buf[keyLen:], ttl)
+		if err == ErrTooLarge {
+			skipped++
+			continue
+		} else if err != nil {
+			return loaded, skipped, err
+		}
+		loaded++
+	}
+	return loaded, skipped, nil
+}
@@ -0,0 +1,133 @@
+package dory
+
+// Flags are an opaque 32-bit value stored alongside a key's value, which
+// memcached clients use to record how the value is encoded. Most keys have no
+// flags, so flags are stored in a map rather than in the tables, and only
+// keys with non-zero flags pay for them. Storing them in table entries would
+// cost every entry, and change the table format which is persisted and
+// preloaded. Since the map is outside the tables, its estimated size is taken
+// out of the memory available to tables. A key's flags are cleared whenever
+// its value is stored or deleted. Like known misses, flags aren't replicated
+// or dumped.
+
+// Estimated memory used by each key in the flags map, excluding the key
+// itself: the map entry, string header and value, with room for the map's
+// unused slots.
+const flagsEntryOverhead = 48
+
+// GetWithFlags is like Get, but also returns the key's flags, or 0 if the key
+// has none.
+func (c *Memcache) GetWithFlags(key, buf []byte) ([]byte, uint32) {
+	if len(key) == 0 {
+		return nil, 0
+	}
+
+	tr := startTrace()
+	defer tr.finish("get")
+	var flags uint32
+	if val, ok := c.getRead(key, buf, &flags, &tr); ok {
+		return val, flags
+	}
+
+	// The key needs to be promoted or expired, which requires the write lock.
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	val := c.get(key, buf)
+	if val == nil {
+		return nil, 0
+	}
+	return val, c.keyFlags(key)
+}
+
+// SetFlags sets the flags of a key in the cache, without changing its value.
+// Returns false if the key isn't in the cache.
+func (c *Memcache) SetFlags(key []byte, flags uint32) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.setFlags(key, flags)
+}
+
+// Flags returns the flags of a key, and whether the key is in the cache.
+func (c *Memcache) Flags(key []byte) (uint32, bool) {
+	if len(key) == 0 {
+		return 0, false
+	}
+	var flags uint32
+	if has, ok := c.hasRead(key, &flags); ok {
+		return flags, has
+	}
+
+	// Expired keys need to be deleted, which requires the write lock.
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.has(key) {
+		return 0, false
+	}
+	return c.keyFlags(key), true
+}
+
+func (tx *Txn) SetFlags(key []byte, flags uint32) bool {
+	return tx.c.setFlags(key, flags)
+}
+
+func (c *Memcache) setFlags(key []byte, flags uint32) bool {
+	if !c.has(key) {
+		return false
+	}
+	if flags == 0 {
+		c.clearFlags(key)
+		return true
+	}
+	if _, ok := c.flags[string(key)]; !ok {
+		c.flagsMem += int64(len(key) + flagsEntryOverhead)
+	}
+	c.flags[string(key)] = flags
+	return true
+}
+
+// Returns the key's flags, without checking that the key exists. Only
+// requires the read lock.
+func (c *Memcache) keyFlags(key []byte) uint32 {
+	if len(c.flags) == 0 {
+		return 0
+	}
+	return c.flags[string(key)]
+}
+
+// Clears the key's flags, because its value has been stored or deleted.
+func (c *Memcache) clearFlags(key []byte) {
+	if len(c.flags) > 0 {
+		c.deleteFlags(string(key))
+	}
+}
+
+// Deletes the key's flags, if it has any.
+func (c *Memcache) deleteFlags(key string) {
+	if _, ok := c.flags[key]; ok {
+		delete(c.flags, key)
+		c.flagsMem -= int64(len(key) + flagsEntryOverhead)
+	}
+}
+
+// Deletes the flags of keys which are no longer in the cache, because they
+// were evicted or expired. At most expirySweepLimit keys are examined per
+// call. Returns the number of keys whose flags were deleted.
+func (c *Memcache) sweepFlags() int {
+	examined := 0
+	deleted := 0
+	for key := range c.flags {
+		if examined >= expirySweepLimit {
+			break
+		}
+		examined++
+		if t, _ := c.find([]byte(key), c.hashFunc([]byte(key))); t != nil {
+			continue
+		} else if _, ok := c.chunkedManifest([]byte(key)); ok {
+			continue
+		}
+		c.deleteFlags(key)
+		deleted++
+	}
+	return deleted
+}
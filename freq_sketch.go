@@ -0,0 +1,66 @@
+package dory
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// Number of counters incremented in a frequency sketch for each key.
+	freqSketchHashes = 4
+	// Estimates are capped at this value, matching the range of redis'
+	// OBJECT FREQ.
+	freqSketchMax = 255
+)
+
+// freqSketch is a count-min sketch estimating how many times each key hash
+// has been read. Estimates can be too high, due to hash collisions, but never
+// too low, except for increments lost when racing with decay. Counters are
+// updated atomically, so the sketch can be updated with only the read lock.
+type freqSketch struct {
+	counters []atomic.Uint32
+}
+
+func newFreqSketch(numCounters int) *freqSketch {
+	return &freqSketch{counters: make([]atomic.Uint32, numCounters)}
+}
+
+// Returns the |i|th counter index for |hash|, using double hashing to derive
+// each index from the two halves of the hash.
+func (f *freqSketch) index(hash uint64, i int) uint64 {
+	h1 := hash & 0xffffffff
+	h2 := hash >> 32
+	return (h1 + uint64(i)*h2) % uint64(len(f.counters))
+}
+
+func (f *freqSketch) add(hash uint64) {
+	for i := 0; i < freqSketchHashes; i++ {
+		c := &f.counters[f.index(hash, i)]
+		// Stop counting well before overflowing, but far enough above the
+		// maximum estimate that decay doesn't quickly bring it back under.
+		if c.Load() < 4*freqSketchMax {
+			c.Add(1)
+		}
+	}
+}
+
+// Returns the estimated number of reads of |hash|, up to freqSketchMax.
+func (f *freqSketch) estimate(hash uint64) int {
+	min := uint32(freqSketchMax)
+	for i := 0; i < freqSketchHashes; i++ {
+		if v := f.counters[f.index(hash, i)].Load(); v < min {
+			min = v
+		}
+	}
+	return int(min)
+}
+
+// Halves every counter, so that estimates favour recent reads. Increments
+// racing with decay may be lost.
+func (f *freqSketch) decay() {
+	for i := range f.counters {
+		c := &f.counters[i]
+		if v := c.Load(); v > 0 {
+			c.Store(v / 2)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package dory
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Size of the count-min sketch used to count sampled reads of each key.
+	hotKeySketchCounters = 64 * 1024
+	// Maximum number of candidate hot keys tracked, and so returned by HotKeys.
+	maxHotKeys = 100
+	// Reads are counted over windows of this length, so that rates reflect
+	// recent reads.
+	hotKeyWindow = time.Minute
+	// Until the current window is at least this old, rates are reported from
+	// the previous window, since they'd be based on too few reads.
+	hotKeyMinWindow = 10 * time.Second
+)
+
+var (
+	hotKeyRate = prom.NewGauge(prom.GaugeOpts{
+		Name: "dory_hot_key_reads_per_second",
+		Help: "Estimated reads per second of the most read key, if hot keys are being tracked.",
+	})
+)
+
+func init() {
+	prom.MustRegister(hotKeyRate)
+}
+
+// HotKey is a frequently read key, reported by HotKeys.
+type HotKey struct {
+	Key []byte
+	// Estimated reads per second.
+	Rate float64
+}
+
+// hotKeys finds the most read keys, by counting a sample of reads in a
+// count-min sketch, and keeping the keys with the largest counts. Counts can
+// be too high, due to hash collisions, but never too low. Counts are reset
+// every hotKeyWindow. Safe for concurrent use, so reads can be recorded with
+// only the cache's read lock held.
+type hotKeys struct {
+	sampleRate uint64
+	reads      atomic.Uint64
+
+	lock     sync.Mutex
+	counters []uint32
+	// Counts of the most read keys in the current window.
+	top         map[string]uint32
+	windowStart time.Time
+	// Hot keys of the previous window, most read first.
+	prev []HotKey
+}
+
+func newHotKeys(sampleRate int, now time.Time) *hotKeys {
+	return &hotKeys{
+		sampleRate:  uint64(sampleRate),
+		counters:    make([]uint32, hotKeySketchCounters),
+		top:         make(map[string]uint32),
+		windowStart: now,
+	}
+}
+
+// Records a read of the key with |hash|, if it is sampled.
+func (h *hotKeys) record(key []byte, hash uint64, now time.Time) {
+	if h.reads.Add(1)%h.sampleRate != 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.maybeRotate(now)
+
+	// Like freqSketch, double hashing derives each counter index from the two
+	// halves of the hash.
+	h1 := hash & 0xffffffff
+	h2 := hash >> 32
+	count := uint32(0)
+	for i := 0; i < freqSketchHashes; i++ {
+		c := &h.counters[(h1+uint64(i)*h2)%uint64(len(h.counters))]
+		*c++
+		if i == 0 || *c < count {
+			count = *c
+		}
+	}
+
+	if _, ok := h.top[string(key)]; ok || len(h.top) < maxHotKeys {
+		h.top[string(key)] = count
+		return
+	}
+	// Replace the least read key, if this one has been read more.
+	var minKey string
+	minCount := count
+	for k, c := range h.top {
+		if c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	if minCount < count {
+		delete(h.top, minKey)
+		h.top[string(key)] = count
+	}
+}
+
+// Starts a new window if the current one has ended. Must be called with the
+// lock held.
+func (h *hotKeys) maybeRotate(now time.Time) {
+	elapsed := now.Sub(h.windowStart)
+	if elapsed < hotKeyWindow {
+		return
+	}
+	if elapsed < 2*hotKeyWindow {
+		h.prev = h.current(elapsed)
+	} else {
+		// Nothing has been sampled for a whole window, so the previous window
+		// had no reads.
+		h.prev = nil
+	}
+	for i := range h.counters {
+		h.counters[i] = 0
+	}
+	h.top = make(map[string]uint32)
+	h.windowStart = now
+}
+
+// Returns the hot keys of the current window, which is |elapsed| old, most
+// read first. Must be called with the lock held.
+func (h *hotKeys) current(elapsed time.Duration) []HotKey {
+	// Avoid wildly overestimating rates from a very short window.
+	if elapsed < time.Second {
+		elapsed = time.Second
+	}
+	keys := make([]HotKey, 0, len(h.top))
+	for k, c := range h.top {
+		keys = append(keys, HotKey{
+			Key:  []byte(k),
+			Rate: float64(uint64(c)*h.sampleRate) / elapsed.Seconds(),
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Rate != keys[j].Rate {
+			return keys[i].Rate > keys[j].Rate
+		}
+		return string(keys[i].Key) < string(keys[j].Key)
+	})
+	return keys
+}
+
+// Returns up to |n| of the most read keys, most read first.
+func (h *hotKeys) hottest(n int, now time.Time) []HotKey {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.maybeRotate(now)
+	keys := h.prev
+	if elapsed := now.Sub(h.windowStart); elapsed >= hotKeyMinWindow || h.prev == nil {
+		keys = h.current(elapsed)
+	}
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// HotKeys returns up to n of the most read keys, most read first, with their
+// estimated reads per second over the last minute or so. Only a sample of
+// reads is counted, so keys read infrequently may be missed, and rates are
+// approximate. Returns nil if hot keys aren't being tracked.
+func (c *Memcache) HotKeys(n int) []HotKey {
+	if c.hotKeys == nil || n <= 0 {
+		return nil
+	}
+	return c.hotKeys.hottest(n, c.nowFunc())
+}
+
+// TracksHotKeys returns whether the cache tracks the most read keys, for
+// HotKeys.
+func (c *Memcache) TracksHotKeys() bool {
+	return c.hotKeys != nil
+}
+
+// Updates the hot key metric.
+func (c *Memcache) updateHotKeyMetrics() {
+	if keys := c.HotKeys(1); len(keys) > 0 {
+		hotKeyRate.Set(keys[0].Rate)
+	} else {
+		hotKeyRate.Set(0)
+	}
+}
@@ -0,0 +1,6 @@
+package dory
+
+// LoadFunc is called by Memcache.Get with a key which isn't in the cache, and
+// returns the key's value, or false if the key has no value. The key is only
+// valid until it returns.
+type LoadFunc func(key []byte) ([]byte, bool)
@@ -0,0 +1,76 @@
+package dory
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// LoggingCache is a Cache which writes a log of every Put and Delete to an
+// io.Writer, before passing them on to another Cache. The log uses the format
+// written by Memcache.DumpTo, with a deletion written as an entry with an
+// empty value, so it can be replayed into a cache using Memcache.LoadFrom.
+//
+// Writes are serialised, so that the log is in the same order as the writes
+// were applied.
+type LoggingCache struct {
+	Cache
+
+	lock sync.Mutex
+	w    io.Writer
+	buf  []byte
+	// The first error writing the log. Once the log is incomplete, nothing
+	// more is written.
+	err error
+}
+
+// NewLoggingCache returns a LoggingCache which logs writes to inner to w.
+// Writes to w are not buffered.
+func NewLoggingCache(inner Cache, w io.Writer) *LoggingCache {
+	return &LoggingCache{Cache: inner, w: w}
+}
+
+// Put stores the value in the inner cache and, if that succeeds, logs it. If
+// the value couldn't be stored, any existing value may have been deleted, so a
+// deletion is logged instead. Returns an error if the value couldn't be
+// stored, or the log couldn't be written.
+func (c *LoggingCache) Put(key, val []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.Cache.Put(key, val)
+	if err != nil {
+		c.writeEntry(key, nil)
+		return err
+	}
+	return c.writeEntry(key, val)
+}
+
+// Delete deletes the key from the inner cache, and logs it. Any error writing
+// the log is returned by Err.
+func (c *LoggingCache) Delete(key []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Cache.Delete(key)
+	c.writeEntry(key, nil)
+}
+
+// Err returns the first error writing the log, or nil if there hasn't been
+// one.
+func (c *LoggingCache) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Writes one log entry, as a single Write. Must be called with the lock held.
+func (c *LoggingCache) writeEntry(key, val []byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.buf = binary.LittleEndian.AppendUint32(c.buf[:0], uint32(len(key)))
+	c.buf = binary.LittleEndian.AppendUint32(c.buf, uint32(len(val)))
+	c.buf = append(c.buf, key...)
+	c.buf = append(c.buf, val...)
+	_, c.err = c.w.Write(c.buf)
+	return c.err
+}
@@ -4,11 +4,19 @@ import (
 	"syscall"
 )
 
-func mmap(size int) ([]byte, error) {
-	return syscall.Mmap(0, 0, size, syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_POPULATE)
+func mmap(size int, populate bool) ([]byte, error) {
+	flags := syscall.MAP_PRIVATE | syscall.MAP_ANONYMOUS
+	if populate {
+		flags |= syscall.MAP_POPULATE
+	}
+	return syscall.Mmap(0, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, flags)
 }
 
 func munmap(buf []byte) error {
 	return syscall.Munmap(buf)
 }
+
+// dropPages releases the memory backing buf, keeping it mapped.
+func dropPages(buf []byte) error {
+	return syscall.Madvise(buf, syscall.MADV_DONTNEED)
+}
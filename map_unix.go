@@ -4,9 +4,12 @@ package dory
 
 import (
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
-func mmap(size int) ([]byte, error) {
+// MAP_POPULATE is Linux specific, so populate is ignored.
+func mmap(size int, populate bool) ([]byte, error) {
 	return syscall.Mmap(0, 0, size, syscall.PROT_READ|syscall.PROT_WRITE,
 		syscall.MAP_PRIVATE|syscall.MAP_ANON)
 }
@@ -14,3 +17,8 @@ func mmap(size int) ([]byte, error) {
 func munmap(buf []byte) error {
 	return syscall.Munmap(buf)
 }
+
+// dropPages releases the memory backing buf, keeping it mapped.
+func dropPages(buf []byte) error {
+	return unix.Madvise(buf, unix.MADV_DONTNEED)
+}
@@ -0,0 +1,57 @@
+package dory
+
+// mapPool keeps the mappings of discarded tables, with their pages dropped, so
+// that they can be reused for new tables without a munmap/mmap round trip.
+// This bounds the syscall rate when memory usage oscillates. Must be called
+// with the cache lock held.
+type mapPool struct {
+	maxSize int
+	free    [][]byte
+	// Number of mappings reused since the last trim.
+	reused int
+}
+
+func newMapPool(maxSize int) *mapPool {
+	return &mapPool{maxSize: maxSize}
+}
+
+// Returns a pooled mapping of |size| bytes, or maps a new one if there is
+// none. Reused mappings aren't populated.
+func (p *mapPool) alloc(size int, populate bool) ([]byte, error) {
+	for i := len(p.free) - 1; i >= 0; i-- {
+		buf := p.free[i]
+		if len(buf) != size {
+			continue
+		}
+		p.free[i] = p.free[len(p.free)-1]
+		p.free[len(p.free)-1] = nil
+		p.free = p.free[:len(p.free)-1]
+		p.reused++
+		return buf, nil
+	}
+	return mmapFunc(size, populate)
+}
+
+// Drops the pages of |buf| and keeps it for reuse, or unmaps it if the pool
+// is full.
+func (p *mapPool) release(buf []byte) error {
+	if len(p.free) < p.maxSize && dropPages(buf) == nil {
+		p.free = append(p.free, buf)
+		return nil
+	}
+	return munmap(buf)
+}
+
+// Unmaps one pooled mapping if none have been reused since the last trim, so
+// that the pool drains once churn stops.
+func (p *mapPool) trim() error {
+	reused := p.reused
+	p.reused = 0
+	if reused > 0 || len(p.free) == 0 {
+		return nil
+	}
+	buf := p.free[len(p.free)-1]
+	p.free[len(p.free)-1] = nil
+	p.free = p.free[:len(p.free)-1]
+	return munmap(buf)
+}
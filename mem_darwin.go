@@ -0,0 +1,30 @@
+package dory
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// An approximation of Linux's MemAvailable, intended for development use. It
+// counts free pages, and pages the kernel can reclaim without writing them
+// out (speculative and purgeable pages).
+func getMemAvailable() int64 {
+	pageSize, err := unix.SysctlUint32("hw.pagesize")
+	if err != nil {
+		panic(err)
+	}
+	pages := uint64(0)
+	for _, name := range []string{"vm.page_free_count", "vm.page_speculative_count",
+		"vm.page_purgeable_count"} {
+		count, err := unix.SysctlUint32(name)
+		if err != nil {
+			panic(err)
+		}
+		pages += uint64(count)
+	}
+
+	memAvailable := int64(pages * uint64(pageSize))
+	if memSize, err := unix.SysctlUint64("hw.memsize"); err == nil && memAvailable > int64(memSize) {
+		memAvailable = int64(memSize)
+	}
+	return memAvailable
+}
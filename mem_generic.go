@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !windows
+
+package dory
+
+import (
+	"os"
+	"strconv"
+)
+
+const (
+	// Used when the available memory isn't set in the environment.
+	defaultMemAvailable = 1024 * megabyte
+)
+
+// There's no portable way to find the available memory, so it is read from
+// the DORY_AVAILABLE_MEM environment variable, in bytes.
+func getMemAvailable() int64 {
+	memAvailable, err := strconv.ParseInt(os.Getenv("DORY_AVAILABLE_MEM"), 10, 64)
+	if err != nil || memAvailable < 0 {
+		return defaultMemAvailable
+	}
+	return memAvailable
+}
@@ -2,7 +2,11 @@ package dory
 
 import (
 	"container/list"
+	"errors"
 	"log"
+	"math"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,8 +20,20 @@ const (
 	maxUintptr = ^uintptr(0)
 	maxMemory  = (maxUintptr >> 1)
 
-	freeSearch                = 4
 	changedKeysSweepThreshold = 10000
+
+	// Maximum number of keys sampled each second for the probe distance
+	// histogram.
+	probeSampleKeys = 100
+
+	// Read frequency estimates are halved this often, so that they reflect
+	// recent reads.
+	freqDecayInterval = time.Minute
+
+	// Maximum number of keys with a TTL examined by each expiry sweep, to bound
+	// the time the lock is held. Map iteration order is random, so successive
+	// sweeps examine different keys.
+	expirySweepLimit = 100000
 )
 
 var (
@@ -29,16 +45,98 @@ var (
 		Name: "dory_cache_size_max",
 		Help: "Maximum cache size.",
 	})
+	cacheRss = prom.NewGauge(prom.GaugeOpts{
+		Name: "dory_cache_rss_bytes",
+		Help: "Resident memory of the process. Unlike dory_cache_size, this only counts table pages which have been faulted in.",
+	})
 	cacheKeys = prom.NewGauge(prom.GaugeOpts{
 		Name: "dory_cache_keys",
 		Help: "Number of keys in cache.",
 	})
+	keyProbeDistance = prom.NewHistogram(prom.HistogramOpts{
+		Name:    "dory_key_probe_distance",
+		Help:    "Number of hash slots probed to find a key, beyond its ideal slot, sampled periodically.",
+		Buckets: append([]float64{0}, prom.ExponentialBuckets(1, 2, 10)...),
+	})
+	putsTooLarge = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_puts_too_large_total",
+		Help: "Number of puts rejected because the entry is larger than a table.",
+	})
+	expiredKeys = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_expired_keys_total",
+		Help: "Number of keys deleted because their TTL expired.",
+	})
+	softLimitRejects = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_soft_limit_rejected_puts_total",
+		Help: "Number of puts of new keys rejected because the cache was at its soft memory limit.",
+	})
+	promotions = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_promotions_total",
+		Help: "Number of keys moved to the newest table by Get.",
+	})
+	tablesCreated = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_tables_created_total",
+		Help: "Number of tables created.",
+	})
+	tablesRecycled = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_tables_recycled_total",
+		Help: "Number of tables emptied and reused as the newest table.",
+	})
+	tablesDiscarded = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_tables_discarded_total",
+		Help: "Number of tables discarded to release memory.",
+	})
+	tableAllocFailures = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_table_alloc_failures_total",
+		Help: "Number of times memory for a new table couldn't be mapped, and an old table was evicted instead.",
+	})
+	compactionReclaimed = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_compaction_reclaimed_bytes_total",
+		Help: "Number of bytes used by deleted entries reclaimed by background compaction.",
+	})
+	tableGeneration = prom.NewGauge(prom.GaugeOpts{
+		Name: "dory_table_generation",
+		Help: "Generation of the next table to be created or recycled.",
+	})
+	generationRebases = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_table_generation_rebases_total",
+		Help: "Number of times table generations were rebased because the counter was about to wrap around.",
+	})
+)
+
+var (
+	ErrTooLarge = errors.New("key or value too large")
+	ErrEmptyKey = errors.New("empty key")
+	// ErrSoftLimit is returned when storing a new key would grow the cache
+	// beyond its soft memory limit.
+	ErrSoftLimit = errors.New("write rejected, at soft limit")
+	// ErrOutOfRange is returned by SetRange for a negative offset.
+	ErrOutOfRange = errors.New("offset out of range")
+	// ErrValueChanged is returned by WriteValueTo, and by readers returned by
+	// OpenValue, when the value is replaced, deleted or evicted after part of
+	// it has been written or read.
+	ErrValueChanged = errors.New("value changed while being written")
+	// ErrReaderClosed is returned by reading from a closed value reader.
+	ErrReaderClosed = errors.New("read from closed value reader")
 )
 
 func init() {
 	prom.MustRegister(cacheSize)
 	prom.MustRegister(cacheSizeMax)
 	prom.MustRegister(cacheKeys)
+	prom.MustRegister(cacheRss)
+	prom.MustRegister(keyProbeDistance)
+	prom.MustRegister(putsTooLarge)
+	prom.MustRegister(expiredKeys)
+	prom.MustRegister(softLimitRejects)
+	prom.MustRegister(promotions)
+	prom.MustRegister(tablesCreated)
+	prom.MustRegister(tablesRecycled)
+	prom.MustRegister(tablesDiscarded)
+	prom.MustRegister(tableAllocFailures)
+	prom.MustRegister(compactionReclaimed)
+	prom.MustRegister(tableGeneration)
+	prom.MustRegister(generationRebases)
 }
 
 // TODO: Having a pointer here isn't GC friendly.
@@ -53,6 +151,11 @@ type MemFunc func(usage int64) int64
 // The hash should have uniform distribution, suitable for use in a hash table.
 type HashFunc func(b []byte) uint64
 
+// EvictFunc is called with each key evicted from a Memcache to make room for
+// new entries. It is called with the cache locked, so must not block or call
+// into the cache, and the key is only valid until it returns.
+type EvictFunc func(key []byte)
+
 // ConstantMemory returns a MemFunc that causes Memcache to use a fixed amount
 // of memory.
 func ConstantMemory(size int64) MemFunc {
@@ -67,21 +170,100 @@ const (
 
 	DefaultMaxKeySize = 1024
 	DefaultMaxValSize = 1024 * 1024
+
+	DefaultGcThresholdFraction = 0.25
+
+	DefaultLargeTableSize = 64 * megabyte
+
+	DefaultPromotionMinAge        = 4
+	DefaultPromotionTableFraction = 0.5
+	DefaultFreeSearchTables       = 4
 )
 
+// KeepTTL can be passed as the ttl to PutWithTTL, PutEvicting, Add and Replace
+// to keep the existing TTL of the key, instead of replacing it. If the key
+// doesn't exist, or has no TTL, the new value never expires.
+const KeepTTL = time.Duration(math.MinInt64)
+
 type Memcache struct {
-	tableSize  int64
-	maxKeySize int
-	maxValSize int
-	memFunc    MemFunc
-	hashFunc   HashFunc
+	tableSize           int64
+	largeTableSize      int64
+	largeValThreshold   int
+	gcThresholdFraction float64
+	softLimitFraction   float64
+	compactionThreshold float64
+	disablePromotion    bool
+	promotionMinAge     uint64
+	promotionFraction   float64
+	freeSearchTables    int
+	evictionSamples     int
+	reserveTables       int
+	disablePopulate     bool
+	zeroOnDiscard       bool
+	maxKeySize          int
+	maxValSize          int
+	maxChunkedValSize   int
+	memFunc             MemFunc
+	autoMemFunc         MemFunc
+	hashFunc            HashFunc
+	onEvict             EvictFunc
+	loader              LoadFunc
+	missTTL             time.Duration
+	flights             *flightGroup
+	arena               *Arena
+	mapPool             *mapPool
+	seenKeys            *bloomFilter
+	freqs               *freqSketch
+	hotKeys             *hotKeys
 
 	// TODO: Document how this works.
-	keys      keyTable
-	tables    list.List
-	maxTables int
-	count     uint64
-	lock      sync.Mutex
+	keys        keyTable
+	tables      list.List
+	tableMem    int64
+	maxTableMem int64
+	count       uint64
+	// Number of non-empty tables evicted to make room.
+	evictedTables uint64
+	// Pure reads take the read lock. Anything that mutates the cache, including
+	// a Get which promotes or expires a key, takes the write lock.
+	lock sync.RWMutex
+
+	// Expiry deadlines, in Unix nanoseconds, of keys which have a TTL. Keys
+	// without a TTL aren't in this map, so only keys with a TTL pay for a heap
+	// copy of the key.
+	expiries map[string]int64
+	nowFunc  func() time.Time
+
+	// Expiry deadlines, in Unix nanoseconds, of keys recorded as absent by
+	// PutMiss.
+	misses map[string]int64
+
+	// Flags of keys which have non-zero flags, and an estimate of the memory
+	// they use, which counts towards the memory limit. See flags.go.
+	flags    map[string]uint32
+	flagsMem int64
+
+	// Manifests of values stored as chunks, and the generation of the last
+	// chunked value stored.
+	chunked  map[string]chunkManifest
+	chunkGen uint64
+
+	// Keys being watched for changes by Watch, and the last version assigned to
+	// a watched key.
+	watched      map[string]*watchedKey
+	watchVersion uint64
+
+	// Replication subscribers, which are sent every Put and Delete.
+	subscribers map[*subscriber]struct{}
+
+	// Generation of the next table to be verified by the scrubber.
+	scrubGen uint64
+
+	// Closed by Close() to stop the background goroutines, which are tracked
+	// by bgWg.
+	done      chan struct{}
+	bgWg      sync.WaitGroup
+	closeOnce sync.Once
 }
 
 type MemcacheOptions struct {
@@ -90,6 +272,148 @@ type MemcacheOptions struct {
 	TableSize      int
 	MaxKeySize     int
 	MaxValSize     int
+
+	// GcThresholdFraction is the fraction of a table's space which may be
+	// taken up by deleted entries before the table is automatically garbage
+	// collected. Must be in the range (0, 1]. Lower values reclaim space sooner
+	// at the cost of more CPU.
+	GcThresholdFraction float64
+
+	// Values larger than LargeValueThreshold are stored in a separate class of
+	// tables, of size LargeTableSize, so that they don't fragment the tables
+	// used for smaller values. A LargeValueThreshold of 0 disables large value
+	// tables.
+	LargeValueThreshold int
+	LargeTableSize      int
+
+	// MaxChunkedValSize, if non-zero, allows values larger than MaxValSize, up
+	// to MaxChunkedValSize, to be stored. These values are split into chunks,
+	// each stored as a separate entry, and reassembled by Get. Evicting any
+	// chunk drops the whole value. Only Get, Has, Stat, Put and Delete (and
+	// their variants) support chunked values, which other operations treat as
+	// missing. Chunked values are also not promoted or dumped.
+	MaxChunkedValSize int
+
+	// ReserveTables is the number of empty tables kept mapped, instead of being
+	// released, so that bursts of writes can reuse them without mapping new
+	// memory. Reserved tables count towards the cache's memory usage.
+	ReserveTables int
+
+	// DisablePopulate stops new tables from being faulted in when they are
+	// mapped (using MAP_POPULATE on Linux). Instead, pages are faulted in as
+	// they are first written, which spreads out the cost of creating tables at
+	// the expense of slower writes to new tables.
+	DisablePopulate bool
+
+	// ZeroOnDiscard clears a table's memory when it's discarded, recycled for
+	// new entries, or emptied, so that evicted and deleted values don't linger
+	// in memory (for example, in arena chunks, or pages which are later
+	// swapped out or included in a core dump). Without it, old values remain
+	// until they're overwritten, or the kernel reuses the pages. This costs a
+	// write to every page of the table, faulting in any pages of lazily
+	// populated tables which were never used. It doesn't clear deleted or
+	// overwritten entries in tables which are still in use, or values which
+	// have already been written to swap.
+	ZeroOnDiscard bool
+
+	// OnEvict, if set, is called with every key evicted due to memory
+	// pressure. Keys which are deleted, replaced, or expire are not reported.
+	OnEvict EvictFunc
+
+	// Loader, if set, makes the cache read-through. When Get misses, it calls
+	// Loader (without the cache locked) and stores and returns the value it
+	// loads. Other lookups, such as Has and transactions, don't call Loader.
+	// Keys recorded as known misses by PutMiss aren't loaded.
+	Loader LoadFunc
+
+	// MissTTL, if non-zero, records keys which Loader returns no value for as
+	// known misses for MissTTL, as if by PutMiss, so that they aren't loaded
+	// again until it expires.
+	MissTTL time.Duration
+
+	// SingleFlightGets combines concurrent Gets of the same key which need
+	// more than the read lock, because the key needs to be promoted, expired
+	// or loaded, into a single lookup whose result is shared. This prevents
+	// stampedes on hot keys, in particular calling Loader once for concurrent
+	// misses of the same key.
+	SingleFlightGets bool
+
+	// DisablePromotion stops Get from moving old keys to the newest table,
+	// making Get a pure read. Without promotion, eviction is FIFO instead of
+	// approximately LRU.
+	DisablePromotion bool
+
+	// Get promotes a key when its table is more than PromotionMinAge
+	// generations old, and older than PromotionTableFraction of the number of
+	// tables. Larger values reduce the writes caused by reads, at the cost of
+	// eviction being less like LRU. PromotionTableFraction must be in the
+	// range (0, 1].
+	PromotionMinAge        int
+	PromotionTableFraction float64
+
+	// FreeSearchTables is the number of most recent tables searched for free
+	// space when storing an entry, before a new table is created.
+	FreeSearchTables int
+
+	// EvictionSamples, if greater than 1, is the number of oldest tables
+	// considered when a table needs to be evicted. The table with the fewest
+	// reads, relative to its age, is evicted, instead of always the oldest
+	// table. This better preserves frequently read keys in old tables, which
+	// is most useful when promotion is disabled, at the cost of counting reads.
+	EvictionSamples int
+
+	// ScrubInterval, if non-zero, enables a background scrubber which verifies
+	// the integrity of one table every interval, cycling through all tables.
+	// Corrupt tables are logged and discarded.
+	ScrubInterval time.Duration
+
+	// SoftLimitFraction, if non-zero, is the fraction of the maximum table
+	// memory beyond which new keys are rejected with ErrSoftLimit, instead of
+	// growing the cache or evicting old keys. Overwrites of existing keys are
+	// still allowed. Must be in the range [0, 1]. This protects the working
+	// set during memory spikes, at the cost of not caching new keys.
+	SoftLimitFraction float64
+
+	// CompactionThreshold, if non-zero, is the fraction of table memory which
+	// may be taken up by deleted entries before the most fragmented tables are
+	// compacted in the background, so that the space can be reused. Tables
+	// aren't compacted when the cache is out of memory, since old tables will
+	// be evicted anyway. Must be in the range [0, 1].
+	CompactionThreshold float64
+
+	// Arena, if set, backs every table with a chunk of the arena, instead of
+	// mapping memory for each table. TableSize defaults to the arena's chunk
+	// size, and must match it if set. The cache's memory is limited to the
+	// size of the arena, in addition to MemoryFunction. Large value tables
+	// can't be used with an arena.
+	Arena *Arena
+
+	// MapPoolTables is the number of discarded tables whose memory mappings
+	// are kept for reuse by new tables, instead of being unmapped, to avoid
+	// mmap/munmap churn when memory usage oscillates. Pooled mappings have
+	// their pages released, so don't count towards memory usage, and tables
+	// reusing them are faulted in lazily. The pool slowly drains when mappings
+	// aren't being reused.
+	MapPoolTables int
+
+	// SeenKeysFilterBits, if non-zero, is the size of a bloom filter which
+	// records every key stored in the cache, so that WasCached can tell a key
+	// which was evicted from one which was never stored. The filter is never
+	// cleared, so false positives become more likely as more distinct keys
+	// are stored.
+	SeenKeysFilterBits int
+
+	// FrequencySketchCounters, if non-zero, is the size of a count-min sketch
+	// which estimates how often each key is read by Get, reported by
+	// KeyFrequency. Each counter uses 4 bytes. Estimates are halved every
+	// minute, and become less accurate as the number of distinct keys read
+	// grows relative to the number of counters.
+	FrequencySketchCounters int
+
+	// HotKeySampleRate, if non-zero, enables tracking of the most read keys,
+	// reported by HotKeys, by counting one in every HotKeySampleRate reads.
+	// A rate of 1 counts every read.
+	HotKeySampleRate int
 }
 
 func valOrDefault(val, def int) int {
@@ -99,6 +423,20 @@ func valOrDefault(val, def int) int {
 	return val
 }
 
+// Returns a MemFunc which never returns more memory than the arena has.
+func limitToArena(memFunc MemFunc, arena *Arena) MemFunc {
+	if arena == nil {
+		return memFunc
+	}
+	arenaSize := arena.Size()
+	return func(usage int64) int64 {
+		if limit := memFunc(usage); limit < arenaSize {
+			return limit
+		}
+		return arenaSize
+	}
+}
+
 func NewMemcache(opts MemcacheOptions) *Memcache {
 	memFunc := opts.MemoryFunction
 	if memFunc == nil {
@@ -110,28 +448,171 @@ func NewMemcache(opts MemcacheOptions) *Memcache {
 		hashFunc = farm.Hash64
 	}
 
-	tableSize := valOrDefault(opts.TableSize, DefaultTableSize)
+	defaultTableSize := DefaultTableSize
+	if opts.Arena != nil {
+		defaultTableSize = opts.Arena.ChunkSize()
+	}
+	tableSize := valOrDefault(opts.TableSize, defaultTableSize)
 	if tableSize < 1024 || tableSize > 1<<30 {
 		panic("invalid tableSize")
 	}
 
+	gcThresholdFraction := opts.GcThresholdFraction
+	if gcThresholdFraction == 0 {
+		gcThresholdFraction = DefaultGcThresholdFraction
+	}
+	if gcThresholdFraction < 0 || gcThresholdFraction > 1 {
+		panic("invalid gcThresholdFraction")
+	}
+
+	promotionFraction := opts.PromotionTableFraction
+	if promotionFraction == 0 {
+		promotionFraction = DefaultPromotionTableFraction
+	}
+	if promotionFraction < 0 || promotionFraction > 1 {
+		panic("invalid promotionTableFraction")
+	}
+	if opts.PromotionMinAge < 0 {
+		panic("invalid promotionMinAge")
+	}
+	if opts.EvictionSamples < 0 {
+		panic("invalid evictionSamples")
+	}
+	if opts.FreeSearchTables < 0 {
+		panic("invalid freeSearchTables")
+	}
+
+	if opts.SeenKeysFilterBits < 0 {
+		panic("invalid seenKeysFilterBits")
+	}
+	if opts.FrequencySketchCounters < 0 {
+		panic("invalid frequencySketchCounters")
+	}
+	if opts.HotKeySampleRate < 0 {
+		panic("invalid hotKeySampleRate")
+	}
+	if opts.MapPoolTables < 0 {
+		panic("invalid mapPoolTables")
+	}
+
+	if opts.SoftLimitFraction < 0 || opts.SoftLimitFraction > 1 {
+		panic("invalid softLimitFraction")
+	}
+	if opts.CompactionThreshold < 0 || opts.CompactionThreshold > 1 {
+		panic("invalid compactionThreshold")
+	}
+
+	if opts.Arena != nil {
+		if opts.Arena.Size() == 0 {
+			panic("arena has no chunks")
+		} else if opts.Arena.ChunkSize() != tableSize {
+			panic("tableSize doesn't match arena chunk size")
+		} else if opts.LargeValueThreshold > 0 {
+			panic("large value tables can't be used with an arena")
+		}
+		memFunc = limitToArena(memFunc, opts.Arena)
+	}
+
+	largeTableSize := valOrDefault(opts.LargeTableSize, DefaultLargeTableSize)
+	if opts.LargeValueThreshold > 0 && (largeTableSize < tableSize || largeTableSize > 1<<30) {
+		panic("invalid largeTableSize")
+	}
+
+	maxKeySize := valOrDefault(opts.MaxKeySize, DefaultMaxKeySize)
+	maxValSize := valOrDefault(opts.MaxValSize, DefaultMaxValSize)
+	if opts.LargeValueThreshold > 0 {
+		if opts.LargeValueThreshold+maxKeySize+prefixLen > tableSize {
+			panic("largeValueThreshold + maxKeySize too large for tableSize")
+		}
+		if maxValSize+maxKeySize+prefixLen > largeTableSize {
+			panic("maxValSize + maxKeySize too large for largeTableSize")
+		}
+	} else if maxValSize+maxKeySize+prefixLen > tableSize {
+		panic("maxValSize + maxKeySize too large for tableSize")
+	}
+
+	if opts.MaxChunkedValSize != 0 &&
+		(opts.MaxChunkedValSize <= maxValSize || maxValSize <= chunkKeySuffixLen) {
+		panic("invalid maxChunkedValSize")
+	}
+
 	availableTableMem := memFunc(0)
 	if availableTableMem > int64(maxMemory) {
 		availableTableMem = int64(maxMemory)
 	}
 	c := &Memcache{
-		tableSize:  int64(tableSize),
-		maxKeySize: valOrDefault(opts.MaxKeySize, DefaultMaxKeySize),
-		maxValSize: valOrDefault(opts.MaxValSize, DefaultMaxValSize),
-		memFunc:    memFunc,
-		hashFunc:   hashFunc,
-		keys:       make(keyTable),
-		maxTables:  int(availableTableMem) / tableSize,
+		tableSize:           int64(tableSize),
+		largeTableSize:      int64(largeTableSize),
+		largeValThreshold:   opts.LargeValueThreshold,
+		gcThresholdFraction: gcThresholdFraction,
+		softLimitFraction:   opts.SoftLimitFraction,
+		compactionThreshold: opts.CompactionThreshold,
+		disablePromotion:    opts.DisablePromotion,
+		promotionMinAge:     uint64(valOrDefault(opts.PromotionMinAge, DefaultPromotionMinAge)),
+		promotionFraction:   promotionFraction,
+		freeSearchTables:    valOrDefault(opts.FreeSearchTables, DefaultFreeSearchTables),
+		evictionSamples:     opts.EvictionSamples,
+		reserveTables:       opts.ReserveTables,
+		disablePopulate:     opts.DisablePopulate,
+		zeroOnDiscard:       opts.ZeroOnDiscard,
+		maxKeySize:          maxKeySize,
+		maxValSize:          maxValSize,
+		maxChunkedValSize:   opts.MaxChunkedValSize,
+		memFunc:             memFunc,
+		autoMemFunc:         memFunc,
+		hashFunc:            hashFunc,
+		onEvict:             opts.OnEvict,
+		loader:              opts.Loader,
+		missTTL:             opts.MissTTL,
+		arena:               opts.Arena,
+		mapPool:             newMapPool(opts.MapPoolTables),
+		keys:                make(keyTable),
+		maxTableMem:         availableTableMem,
+		expiries:            make(map[string]int64),
+		misses:              make(map[string]int64),
+		flags:               make(map[string]uint32),
+		chunked:             make(map[string]chunkManifest),
+		nowFunc:             time.Now,
+		done:                make(chan struct{}),
 	}
+	if opts.SingleFlightGets {
+		c.flights = newFlightGroup()
+	}
+	if opts.SeenKeysFilterBits > 0 {
+		c.seenKeys = newBloomFilter(opts.SeenKeysFilterBits)
+	}
+	if opts.FrequencySketchCounters > 0 {
+		c.freqs = newFreqSketch(opts.FrequencySketchCounters)
+	}
+	if opts.HotKeySampleRate > 0 {
+		c.hotKeys = newHotKeys(opts.HotKeySampleRate, c.nowFunc())
+	}
+	c.bgWg.Add(1)
 	go c.memWatcher()
+	if opts.ScrubInterval > 0 {
+		c.bgWg.Add(1)
+		go c.scrubber(opts.ScrubInterval)
+	}
 	return c
 }
 
+// Close stops the cache's background goroutines and releases the memory used
+// by its tables. The cache must not be used after it is closed. Calling Close
+// more than once has no effect.
+func (c *Memcache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.bgWg.Wait()
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.discardTables()
+		if err := c.mapPool.trim(); err != nil {
+			panic(err)
+		}
+	})
+}
+
 func (c *Memcache) MinKeySize() int {
 	return 1
 }
@@ -144,42 +625,78 @@ func (c *Memcache) MaxKeySize() int {
 	return c.maxKeySize
 }
 
+// MaxValSize returns the size of the largest value which can be stored,
+// including chunked values.
 func (c *Memcache) MaxValSize() int {
+	if c.maxChunkedValSize > 0 {
+		return c.maxChunkedValSize
+	}
 	return c.maxValSize
 }
 
 func (c *Memcache) memWatcher() {
+	defer c.bgWg.Done()
 	ticker := time.NewTicker(time.Second)
-	for range ticker.C {
-		c.lock.Lock()
-		tableMemUsage := int64(c.tables.Len()) * c.tableSize
-		c.lock.Unlock()
+	defer ticker.Stop()
+	lastFreqDecay := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		c.lock.RLock()
+		tableMemUsage := c.tableMem
+		memFunc := c.memFunc
+		c.lock.RUnlock()
 
 		// Do outside lock to avoid blocking.
-		availableTableMem := c.memFunc(tableMemUsage)
-		if availableTableMem > int64(maxMemory) {
-			availableTableMem = int64(maxMemory)
-		}
+		availableTableMem := memFunc(tableMemUsage)
 
 		c.lock.Lock()
-		c.maxTables = int(availableTableMem / c.tableSize)
-		if c.maxTables < 0 {
-			c.maxTables = 0
-		}
+		c.setMaxTableMem(availableTableMem)
+		// Sweep before downsizing, so that tables emptied by expiry are released.
+		c.sweepExpired()
+		c.sweepMisses()
+		c.sweepChunked()
+		c.sweepFlags()
 		c.downsizeTables()
-		numTables := int64(c.tables.Len())
-		maxTables := int64(c.maxTables)
+		c.compactFragmented()
+		if err := c.mapPool.trim(); err != nil {
+			panic(err)
+		}
+		numTables := c.tables.Len()
+		tableMem := c.tableMem
+		maxTableMem := c.maxTableMem
 		numKeys := len(c.keys)
+		generation := c.count
 		c.lock.Unlock()
 
 		if debugLog {
-			log.Printf("Available table memory: %d MB, tables: %d, max tables: %d",
-				availableTableMem/megabyte, numTables, maxTables)
+			log.Printf("Available table memory: %d MB, tables: %d (%d MB), max table memory: %d MB",
+				availableTableMem/megabyte, numTables, tableMem/megabyte, maxTableMem/megabyte)
 		}
 
-		cacheSize.Set(float64(numTables * c.tableSize))
-		cacheSizeMax.Set(float64(maxTables * c.tableSize))
+		cacheSize.Set(float64(tableMem))
+		cacheSizeMax.Set(float64(maxTableMem))
 		cacheKeys.Set(float64(numKeys))
+		tableGeneration.Set(float64(generation))
+		if rss := getRss(); rss >= 0 {
+			cacheRss.Set(float64(rss))
+		}
+
+		// Only a sample of keys, since walking every key would hold the lock
+		// for too long on a large cache.
+		c.sampleProbeDistances()
+		if c.freqs != nil && time.Since(lastFreqDecay) >= freqDecayInterval {
+			// Counters are atomic, so no lock is needed.
+			c.freqs.decay()
+			lastFreqDecay = time.Now()
+		}
+		if c.hotKeys != nil {
+			c.updateHotKeyMetrics()
+		}
 	}
 }
 
@@ -199,20 +716,60 @@ func (c *Memcache) cleanupTable(t *DiscardableTable) {
 	}
 }
 
+// Discards the table at |e| and removes it from the table list. Any hash
+// entries pointing to the table are cleaned up.
+func (c *Memcache) discardTable(e *list.Element) {
+	t := e.Value.(*DiscardableTable)
+	c.notifyEvicted(t)
+	c.tableChanged(t)
+	c.tableMem -= int64(t.Size())
+	t.Discard()
+	c.cleanupTable(t)
+	c.tables.Remove(e)
+	tablesDiscarded.Inc()
+}
+
+// Calls the OnEvict function with every key in |t|, which is about to be
+// evicted.
+func (c *Memcache) notifyEvicted(t *DiscardableTable) {
+	if t.NumEntries() > 0 {
+		c.evictedTables++
+	}
+	if c.onEvict == nil {
+		return
+	}
+	for _, key := range t.Keys() {
+		if valKey, index, ok := c.parseChunkKey(key); ok {
+			// Report each chunked value once, for its first chunk.
+			if index != 0 {
+				continue
+			}
+			key = valKey
+		}
+		c.onEvict(key)
+	}
+}
+
 func (c *Memcache) downsizeTables() {
 	start := time.Now()
 	deleted := 0
-	for e := c.tables.Front(); e != nil; {
-		next := e.Next()
+	reserved := 0
+	// Empty tables are moved to the back, so reserve those closest to the back.
+	for e := c.tables.Back(); e != nil; {
+		prev := e.Prev()
 		t := e.Value.(*DiscardableTable)
-		if t.NumEntries() == 0 {
+		if t.NumEntries() == 0 && reserved < c.reserveTables && int64(t.Size()) == c.tableSize {
+			reserved++
+		} else if t.NumEntries() == 0 {
+			c.tableMem -= int64(t.Size())
 			t.Discard()
 			// No call to cleanupTable() here because the table is empty, which
 			// implies there are no hashes pointing to it to clean up.
 			c.tables.Remove(e)
+			tablesDiscarded.Inc()
 			deleted++
 		}
-		e = next
+		e = prev
 	}
 	if debugLog && deleted > 0 {
 		log.Printf("Deleted %d empty tables in %0.3f sec", deleted, time.Since(start).Seconds())
@@ -220,12 +777,8 @@ func (c *Memcache) downsizeTables() {
 
 	start = time.Now()
 	deleted = 0
-	for c.tables.Len() > c.maxTables {
-		last := c.tables.Back()
-		t := last.Value.(*DiscardableTable)
-		t.Discard()
-		c.cleanupTable(t)
-		c.tables.Remove(last)
+	for c.tableMem > c.maxTableMem {
+		c.discardTable(c.evictionVictim(0))
 		deleted++
 	}
 	if debugLog && deleted > 0 {
@@ -240,17 +793,16 @@ func (c *Memcache) downsizeTables() {
 		deletedEntries := 0
 		freeSpace := 0
 
-		for e := c.tables.Front(); e != nil; e = e.Next() {
-			t := e.Value.(*DiscardableTable)
-			liveSpace += t.LiveSpace()
-			liveEntries += t.NumEntries()
-			deletedSpace += t.DeletedSpace()
-			deletedEntries += t.NumDeleted()
-			freeSpace += t.FreeSpace()
+		for _, info := range c.tableInfos() {
+			liveSpace += info.LiveSpace
+			liveEntries += info.Entries
+			deletedSpace += info.DeletedSpace
+			deletedEntries += info.Deleted
+			freeSpace += info.FreeSpace
 		}
 		utilisation := float64(0)
-		if c.tables.Len() > 0 {
-			utilisation = float64(liveSpace) / (float64(c.tables.Len()) * float64(c.tableSize))
+		if c.tableMem > 0 {
+			utilisation = float64(liveSpace) / float64(c.tableMem)
 		}
 
 		log.Printf("# tables %d, live (%d/%d MB), deleted (%d/%d MB) free %d MB, utilisation %0.2f",
@@ -260,39 +812,116 @@ func (c *Memcache) downsizeTables() {
 	// TODO: Compact and merge underutilised tables.
 }
 
-func (c *Memcache) allocTable() *DiscardableTable {
-	t := NewDiscardableTable(int(c.tableSize), c.count)
-	c.count++
-	if c.count == 0 {
-		// Don't bother handling this. Just let the server crash and restart.
-		panic("overflow")
+// Creates a new table of |tableSize|. Returns an error if the table's memory
+// can't be mapped.
+func (c *Memcache) allocTable(tableSize int64) (*DiscardableTable, error) {
+	autoGcThreshold := int(float64(tableSize) * c.gcThresholdFraction)
+	var t *DiscardableTable
+	var err error
+	gen := c.nextGeneration()
+	if c.arena != nil {
+		t = newArenaTable(c.arena, autoGcThreshold, gen)
+		if t == nil {
+			// Table memory is limited to the size of the arena, so this can't
+			// happen.
+			panic("arena exhausted")
+		}
+	} else if c.mapPool.maxSize > 0 {
+		t, err = newPooledTable(c.mapPool, int(tableSize), autoGcThreshold, !c.disablePopulate, gen)
+	} else {
+		t, err = newDiscardableTable(int(tableSize), autoGcThreshold, !c.disablePopulate, gen)
 	}
-	return t
+	if err != nil {
+		return nil, err
+	}
+	t.zeroOnDiscard = c.zeroOnDiscard
+	c.tableMem += tableSize
+	tablesCreated.Inc()
+	return t, nil
 }
 
 func (c *Memcache) recycleTable(old *DiscardableTable) *DiscardableTable {
-	t := old.Recycle(c.count)
+	c.notifyEvicted(old)
+	c.tableChanged(old)
+	t := old.Recycle(c.nextGeneration())
 	c.cleanupTable(old)
+	tablesRecycled.Inc()
+	return t
+}
+
+// Returns the generation of a new table, and advances the counter. Before the
+// counter wraps around, every table's generation is rebased, so that table
+// ages stay correct.
+func (c *Memcache) nextGeneration() uint64 {
+	if c.count == math.MaxUint64 {
+		c.rebaseGenerations()
+	}
+	gen := c.count
 	c.count++
-	if c.count == 0 {
-		// Don't bother handling this. Just let the server crash and restart.
+	return gen
+}
+
+// Subtracts the generation of the oldest table from every table's generation,
+// and the counter. This changes CAS tokens, so any outstanding tokens no longer
+// match.
+func (c *Memcache) rebaseGenerations() {
+	oldest := c.count
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		if gen := e.Value.(*DiscardableTable).Meta().(uint64); gen < oldest {
+			oldest = gen
+		}
+	}
+	if oldest == 0 {
+		// Only possible with a table which has survived 2^64 others.
 		panic("overflow")
 	}
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*DiscardableTable)
+		t.meta = t.Meta().(uint64) - oldest
+	}
+	c.count -= oldest
+	if c.scrubGen > oldest {
+		c.scrubGen -= oldest
+	} else {
+		c.scrubGen = 0
+	}
+	generationRebases.Inc()
+}
 
-	return t
+// Returns whether creating a new table of |tableSize| would take the table
+// memory over the soft limit. Reusing an empty table doesn't count.
+func (c *Memcache) atSoftLimit(tableSize int64) bool {
+	if c.softLimitFraction == 0 {
+		return false
+	}
+	last := c.tables.Back()
+	if last != nil && int64(last.Value.(*DiscardableTable).Size()) == tableSize &&
+		last.Value.(*DiscardableTable).NumEntries() == 0 {
+		return false
+	}
+	return float64(c.tableMem+tableSize) > c.softLimitFraction*float64(c.maxTableMem)
 }
 
-func (c *Memcache) createTable() *DiscardableTable {
+func (c *Memcache) createTable(tableSize int64) *DiscardableTable {
 	var t *DiscardableTable
 	last := c.tables.Back()
-	full := (c.tables.Len() >= c.maxTables)
+	full := (c.tableMem+tableSize > c.maxTableMem)
+	if full {
+		last = c.evictionVictim(tableSize)
+	}
 
-	if last != nil && (full || last.Value.(*DiscardableTable).NumEntries() == 0) {
+	if last != nil && int64(last.Value.(*DiscardableTable).Size()) == tableSize &&
+		(full || last.Value.(*DiscardableTable).NumEntries() == 0) {
 		t = last.Value.(*DiscardableTable)
 		c.tables.Remove(last)
 		t = c.recycleTable(t)
 	} else {
-		t = c.allocTable()
+		// The last table can't be recycled because it's a different size, so
+		// make room by discarding old tables.
+		for c.tables.Len() > 0 && c.tableMem+tableSize > c.maxTableMem {
+			c.discardTable(c.evictionVictim(0))
+		}
+		t = c.allocOrRecycleTable(tableSize)
 	}
 	e := c.tables.PushFront(t)
 	t.SetElement(e)
@@ -300,6 +929,31 @@ func (c *Memcache) createTable() *DiscardableTable {
 	return t
 }
 
+// Creates a new table, or if the table's memory can't be mapped, recycles the
+// oldest table instead. This lets the cache evict entries, rather than crash,
+// when the system is out of memory.
+func (c *Memcache) allocOrRecycleTable(tableSize int64) *DiscardableTable {
+	for {
+		t, err := c.allocTable(tableSize)
+		if err == nil {
+			return t
+		}
+		tableAllocFailures.Inc()
+		last := c.tables.Back()
+		if last == nil {
+			panic(err)
+		}
+		log.Printf("Unable to allocate table, evicting oldest table: %v", err)
+		if int64(last.Value.(*DiscardableTable).Size()) == tableSize {
+			c.tables.Remove(last)
+			return c.recycleTable(last.Value.(*DiscardableTable))
+		}
+		// The oldest table is a different size, so discard it to free up memory
+		// and try again.
+		c.discardTable(last)
+	}
+}
+
 func (c *Memcache) erase(hash uint64) {
 	_, ok := c.keys[hash+1]
 	if ok {
@@ -316,126 +970,1194 @@ func (c *Memcache) erase(hash uint64) {
 	}
 }
 
-func (c *Memcache) Has(key []byte) bool {
-	hash := c.hashFunc(key)
-	has := false
+// ProbeStats returns the average and maximum number of hash slots probed,
+// beyond the key's ideal slot, to find each key in the cache. A large maximum
+// indicates hash collisions or clustering. This walks every key in the cache
+// while holding the lock, so should be called sparingly.
+func (c *Memcache) ProbeStats() (float64, int) {
+	total := 0
+	max := 0
+	count := 0
 
-	c.lock.Lock()
-	for ; !has; hash++ {
-		t, ok := c.keys[hash]
-		if !ok {
-			break
-		} else if t == nil {
-			continue
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*DiscardableTable)
+		for _, key := range t.Keys() {
+			dist, ok := c.probeDistance(t, key)
+			if !ok {
+				continue
+			}
+			total += dist
+			count++
+			if dist > max {
+				max = dist
+			}
 		}
-
-		has = t.Has(key)
 	}
-	c.lock.Unlock()
-	return has
+	if count == 0 {
+		return 0, 0
+	}
+	return float64(total) / float64(count), max
 }
 
-func (c *Memcache) Get(key, buf []byte) []byte {
+// Returns the number of hash slots beyond the ideal slot of |key|, which is
+// stored in |t|, that are probed to find it. Returns false if the key isn't
+// found. Must be called with the lock held.
+func (c *Memcache) probeDistance(t *DiscardableTable, key []byte) (int, bool) {
 	hash := c.hashFunc(key)
-	keyHash := hash
-	var outBuf []byte
-
-	c.lock.Lock()
-	for ; outBuf == nil; hash++ {
-		t, ok := c.keys[hash]
+	for dist := 0; ; dist++ {
+		et, ok := c.keys[hash+uint64(dist)]
 		if !ok {
-			break
-		} else if t == nil {
-			continue
-		}
-
-		outBuf = t.Get(key)
-		if outBuf != nil {
-			// Copy value, because Get() returns a slice into its own memory.
-			outBuf = append(buf, outBuf...)
-			age := (c.count - t.Meta().(uint64))
-			if age > freeSearch && age > uint64(c.tables.Len()/2) {
-				// Promote old keys to give LRU-like behaviour.
-				c.putWithHash(key, outBuf, keyHash)
-			}
+			return 0, false
+		} else if et == t && t.Has(key) {
+			return dist, true
 		}
 	}
-	c.lock.Unlock()
-	return outBuf
 }
 
-func (c *Memcache) findPutTable(entrySize int) *DiscardableTable {
-	var t *DiscardableTable
-	i := 0
-	// Search a few of the most recent tables for the smallest spot the entry will fit into.
-	for e := c.tables.Front(); e != nil && i < freeSearch; e = e.Next() {
-		et := e.Value.(*DiscardableTable)
-		if et.FreeSpace() >= entrySize {
-			if t == nil || et.FreeSpace() < t.FreeSpace() {
-				t = et
-			}
+// Records the probe distance of a sample of keys from a random table in the
+// probe distance histogram. Unlike ProbeStats, this is cheap enough to run
+// continuously.
+func (c *Memcache) sampleProbeDistances() {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.tables.Len() == 0 {
+		return
+	}
+	e := c.tables.Front()
+	for i := rand.Intn(c.tables.Len()); i > 0; i-- {
+		e = e.Next()
+	}
+	t := e.Value.(*DiscardableTable)
+	keys := t.Keys()
+	for i := 0; i < probeSampleKeys && len(keys) > 0; i++ {
+		if dist, ok := c.probeDistance(t, keys[rand.Intn(len(keys))]); ok {
+			keyProbeDistance.Observe(float64(dist))
 		}
-		i++
 	}
-	return t
 }
 
-func (c *Memcache) putWithHash(key, val []byte, hash uint64) {
-	// Only one copy of the key should exist anywhere in the cache, so
-	// deleting any existing value before inserting the new one.
-	c.deleteWithHash(key, hash)
-
-	if c.maxTables == 0 {
-		return
+// Returns whether the key has a TTL which has expired. Only requires the read
+// lock.
+func (c *Memcache) isExpired(key []byte) bool {
+	if len(c.expiries) == 0 {
+		return false
 	}
+	deadline, ok := c.expiries[string(key)]
+	return ok && c.nowFunc().UnixNano() >= deadline
+}
 
-	if len(key) > c.maxKeySize || len(val) > c.maxValSize {
-		return
+// Returns the remaining TTL of the key, or 0 if it has no TTL. A key which has
+// expired, but not yet been deleted, has the minimum TTL of 1ns.
+func (c *Memcache) ttl(key []byte) time.Duration {
+	deadline, ok := c.expiries[string(key)]
+	if !ok {
+		return 0
 	}
-	entrySize := (*PackedTable)(nil).EntrySize(key, val)
+	ttl := time.Duration(deadline - c.nowFunc().UnixNano())
+	if ttl <= 0 {
+		ttl = time.Nanosecond
+	}
+	return ttl
+}
 
-	t := c.findPutTable(entrySize)
-	if t == nil {
-		t = c.createTable()
+// Deletes the key if its TTL has expired. Returns true if the key was expired.
+func (c *Memcache) expireKey(key []byte) bool {
+	if !c.isExpired(key) {
+		return false
 	}
-	err := t.Put(key, val, hash)
-	if err != nil {
-		panic(err)
+	delete(c.expiries, string(key))
+	c.clearFlags(key)
+	c.deleteWithHash(key, c.hashFunc(key))
+	c.keyChanged(key)
+	expiredKeys.Inc()
+	return true
+}
+
+// Deletes keys whose TTL has expired, so that the space used by them can be
+// reclaimed. Returns the number of keys deleted.
+func (c *Memcache) sweepExpired() int {
+	start := time.Now()
+	now := c.nowFunc().UnixNano()
+	examined := 0
+	deleted := 0
+	for key, deadline := range c.expiries {
+		if examined >= expirySweepLimit {
+			break
+		}
+		examined++
+		if now < deadline {
+			continue
+		}
+		// Deleting from a map during iteration is safe.
+		delete(c.expiries, key)
+		c.deleteFlags(key)
+		c.deleteWithHash([]byte(key), c.hashFunc([]byte(key)))
+		c.keyChanged([]byte(key))
+		deleted++
 	}
-	// Linear probing for the next free hash slot.
-	for ; c.keys[hash] != nil; hash++ {
+	expiredKeys.Add(float64(deleted))
+	if debugLog && deleted > 0 {
+		log.Printf("Expired %d keys in %0.3f sec", deleted, time.Since(start).Seconds())
 	}
-	c.keys[hash] = t
+	return deleted
 }
 
-func (c *Memcache) Put(key, val []byte) {
-	hash := c.hashFunc(key)
+func (c *Memcache) Has(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	if has, ok := c.hasRead(key, nil); ok {
+		return has
+	}
 
+	// Expired keys need to be deleted, which requires the write lock.
 	c.lock.Lock()
-	c.putWithHash(key, val, hash)
-	c.lock.Unlock()
+	defer c.lock.Unlock()
+	return c.has(key)
 }
 
-func (c *Memcache) tryCompaction(t *DiscardableTable) bool {
-	e := t.Element()
-	if t.NumEntries() == 0 {
-		// Move empty tables to the back to allow them to be recycled.
-		t.Reset()
-		c.tables.MoveToBack(e)
-		// Didn't technically compact, but achieved the same result.
-		return true
+// Looks up the key with only the read lock held. Returns false if the key
+// has expired, in which case the lookup needs to be done with the write lock.
+func (c *Memcache) hasRead(key []byte, flags *uint32) (has bool, ok bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.isExpired(key) {
+		return false, false
+	}
+	t, _ := c.find(key, c.hashFunc(key))
+	if t == nil {
+		if m, ok := c.chunkedManifest(key); ok {
+			has = c.hasChunks(key, m)
+		}
+	} else {
+		has = true
+	}
+	if has && flags != nil {
+		*flags = c.keyFlags(key)
 	}
+	return has, true
+}
 
-	// TODO: Compaction.
-	return false
+func (c *Memcache) has(key []byte) bool {
+	if len(key) == 0 || c.expireKey(key) {
+		return false
+	}
+	t, _ := c.find(key, c.hashFunc(key))
+	if t == nil {
+		if m, ok := c.chunkedManifest(key); ok {
+			return c.hasChunks(key, m)
+		}
+	}
+	return t != nil
 }
 
-func (c *Memcache) deleteWithHash(key []byte, hash uint64) {
-	for ; ; hash++ {
-		t, ok := c.keys[hash]
-		if !ok {
-			break
-		} else if t == nil {
+// Stat returns the size of the key's value, and whether the key exists, using
+// a single lookup and without copying the value. Like KeyAge, this does not
+// promote the key.
+func (c *Memcache) Stat(key []byte) (int, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.stat(key)
+}
+
+func (c *Memcache) stat(key []byte) (int, bool) {
+	if len(key) == 0 || c.isExpired(key) {
+		return 0, false
+	}
+	t, val := c.find(key, c.hashFunc(key))
+	if t == nil {
+		if m, ok := c.chunkedManifest(key); ok && c.hasChunks(key, m) {
+			return m.size, true
+		}
+		return 0, false
+	}
+	return len(val), true
+}
+
+// Returns the table containing the key, and a slice of the key's value in the
+// table, or nil if the key isn't in the cache. Only requires the read lock.
+func (c *Memcache) find(key []byte, hash uint64) (*DiscardableTable, []byte) {
+	for ; ; hash++ {
+		t, ok := c.keys[hash]
+		if !ok {
+			break
+		} else if t == nil {
+			continue
+		}
+
+		val := t.Get(key)
+		if val != nil {
+			return t, val
+		}
+	}
+	return nil, nil
+}
+
+// Returns whether keys in |t| are old enough to be promoted on Get.
+func (c *Memcache) shouldPromote(t *DiscardableTable) bool {
+	age := (c.count - t.Meta().(uint64))
+	return !c.disablePromotion && age > c.promotionMinAge &&
+		age > uint64(float64(c.tables.Len())*c.promotionFraction)
+}
+
+func (c *Memcache) Get(key, buf []byte) []byte {
+	if len(key) == 0 {
+		return nil
+	}
+
+	tr := startTrace()
+	val, ok := c.getRead(key, buf, nil, &tr)
+	if ok && (val != nil || c.loader == nil) {
+		tr.finish("get")
+		return val
+	}
+
+	// The key needs to be promoted, expired or loaded.
+	if c.flights == nil {
+		return c.getSlow(key, buf, &tr)
+	}
+	val, ok = c.flights.do(key, func() ([]byte, bool) {
+		val := c.getSlow(key, nil, &tr)
+		return val, val != nil
+	})
+	if !ok {
+		return nil
+	}
+	// Copy value, because it's shared with concurrent Gets of the key.
+	return append(buf, val...)
+}
+
+// Looks up the key with the write lock held, so that it can be promoted or
+// expired. If the key is missing, calls the loader (without the lock held),
+// and stores the value it returns.
+func (c *Memcache) getSlow(key, buf []byte, tr *trace) []byte {
+	// The cache may have changed since the key was looked up with the read
+	// lock, so start the lookup over.
+	c.lock.Lock()
+	tr.lockAcquired()
+	val := c.get(key, buf)
+	miss := val == nil && c.isMiss(key)
+	c.lock.Unlock()
+	tr.finish("get")
+	if val != nil || miss || c.loader == nil {
+		return val
+	}
+
+	loaded, ok := c.loader(key)
+	if !ok {
+		if c.missTTL > 0 {
+			c.PutMiss(key, c.missTTL)
+		}
+		return nil
+	}
+	// The value is returned even if it can't be stored.
+	c.Put(key, loaded)
+	return append(buf, loaded...)
+}
+
+// Looks up the key with only the read lock held. Returns false if the key
+// needs to be promoted or has expired, in which case the lookup needs to be
+// done with the write lock. If the key is found and flags is non-nil, it's set
+// to the key's flags.
+func (c *Memcache) getRead(key, buf []byte, flags *uint32, tr *trace) ([]byte, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	tr.lockAcquired()
+	if c.isExpired(key) {
+		return nil, false
+	}
+	hash := c.hashFunc(key)
+	t, val := c.find(key, hash)
+	if t == nil {
+		if m, ok := c.chunkedManifest(key); ok {
+			// If a chunk has been evicted, the value needs to be deleted, which
+			// requires the write lock.
+			val, ok := c.readChunks(key, m, buf)
+			if ok {
+				c.recordRead(key, hash)
+				if flags != nil {
+					*flags = c.keyFlags(key)
+				}
+			}
+			return val, ok
+		}
+		return nil, true
+	} else if c.shouldPromote(t) {
+		return nil, false
+	}
+	c.recordAccess(t)
+	c.recordRead(key, hash)
+	if flags != nil {
+		*flags = c.keyFlags(key)
+	}
+	// Copy value, because Get() returns a slice into its own memory.
+	return append(buf, val...), true
+}
+
+func (c *Memcache) get(key, buf []byte) []byte {
+	if len(key) == 0 || c.expireKey(key) {
+		return nil
+	}
+	hash := c.hashFunc(key)
+	t, val := c.find(key, hash)
+	if t == nil {
+		if m, ok := c.chunkedManifest(key); ok {
+			val, ok := c.readChunks(key, m, buf)
+			if !ok {
+				c.invalidateChunked(key)
+				return nil
+			}
+			c.recordRead(key, hash)
+			return val
+		}
+		return nil
+	}
+
+	// Copy value, because Get() returns a slice into its own memory.
+	buf = append(buf, val...)
+	c.recordRead(key, hash)
+	if c.shouldPromote(t) {
+		// Promote old keys to give LRU-like behaviour.
+		if c.putWithHash(key, buf, hash) == nil {
+			promotions.Inc()
+		}
+	} else {
+		c.recordAccess(t)
+	}
+	return buf
+}
+
+// Records a read of a key in |t|, for sampled eviction. Only requires the read
+// lock.
+func (c *Memcache) recordAccess(t *DiscardableTable) {
+	if c.evictionSamples > 1 {
+		t.accesses.Add(1)
+	}
+}
+
+// Returns the table to evict to make room. Without eviction sampling, this is
+// the oldest table. Otherwise, it is the table with the fewest reads relative
+// to its age, out of the oldest evictionSamples tables. If |tableSize| is
+// non-zero, only tables of that size are considered, unless there are none.
+func (c *Memcache) evictionVictim(tableSize int64) *list.Element {
+	last := c.tables.Back()
+	if c.evictionSamples <= 1 || last == nil {
+		return last
+	}
+
+	victim := last
+	victimScore := -1.0
+	sampled := 0
+	for e := last; e != nil && sampled < c.evictionSamples; e = e.Prev() {
+		t := e.Value.(*DiscardableTable)
+		if tableSize != 0 && int64(t.Size()) != tableSize {
+			continue
+		}
+		sampled++
+		if t.NumEntries() == 0 {
+			// Nothing to lose by evicting an empty table.
+			return e
+		}
+		age := c.count - t.Meta().(uint64)
+		score := float64(t.accesses.Load()) / float64(age)
+		if victimScore < 0 || score < victimScore {
+			victim = e
+			victimScore = score
+		}
+	}
+	return victim
+}
+
+// WasCached returns whether the key has ever been stored in the cache, even if
+// it has since been evicted or deleted. False positives are possible. Returns
+// false if the cache wasn't created with a SeenKeysFilterBits.
+func (c *Memcache) WasCached(key []byte) bool {
+	if c.seenKeys == nil {
+		return false
+	}
+	hash := c.hashFunc(key)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.seenKeys.mayContain(hash)
+}
+
+// TracksSeenKeys returns whether the cache records stored keys for WasCached.
+func (c *Memcache) TracksSeenKeys() bool {
+	return c.seenKeys != nil
+}
+
+// Records a read of the key with |hash| in the frequency sketch and hot key
+// tracker, if enabled. Only requires the read lock.
+func (c *Memcache) recordRead(key []byte, hash uint64) {
+	if c.freqs != nil {
+		c.freqs.add(hash)
+	}
+	if c.hotKeys != nil {
+		c.hotKeys.record(key, hash, c.nowFunc())
+	}
+}
+
+// KeyFrequency returns an estimate, from 0 to 255, of the number of recent
+// reads of the key, or false if the key doesn't exist or frequencies aren't
+// being tracked. Estimates are halved every minute, so a key read at a steady
+// rate has an estimate of between one and two times its reads per minute.
+func (c *Memcache) KeyFrequency(key []byte) (int, bool) {
+	if c.freqs == nil || len(key) == 0 {
+		return 0, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.isExpired(key) {
+		return 0, false
+	}
+	hash := c.hashFunc(key)
+	if t, _ := c.find(key, hash); t == nil {
+		return 0, false
+	}
+	return c.freqs.estimate(hash), true
+}
+
+// TracksFrequencies returns whether the cache estimates how often keys are
+// read, for KeyFrequency.
+func (c *Memcache) TracksFrequencies() bool {
+	return c.freqs != nil
+}
+
+// KeyInfo describes where a key is stored in the cache.
+type KeyInfo struct {
+	// Generation of the table holding the key. Larger is newer.
+	Generation uint64
+	// Offset of the key's entry in the table.
+	Offset int
+	// Size of the entry, including the key and the entry header.
+	EntrySize int
+	// Size of the table holding the key.
+	TableSize int
+}
+
+// SetMemoryLimit replaces the MemoryFunction with a constant limit of |limit|
+// bytes of table memory, or restores the MemoryFunction if |limit| is 0. The
+// new limit is reported by Stats as MaxTableMem straight away, and like
+// changes in available memory, tables are evicted within a second if the
+// cache is over the limit.
+func (c *Memcache) SetMemoryLimit(limit int64) {
+	if limit < 0 {
+		panic("invalid limit")
+	}
+	c.lock.Lock()
+	if limit == 0 {
+		c.memFunc = c.autoMemFunc
+	} else {
+		c.memFunc = limitToArena(ConstantMemory(limit), c.arena)
+	}
+	memFunc := c.memFunc
+	tableMemUsage := c.tableMem
+	c.lock.Unlock()
+
+	// Like memWatcher, call the function without the lock held.
+	availableTableMem := memFunc(tableMemUsage)
+	c.lock.Lock()
+	c.setMaxTableMem(availableTableMem)
+	c.lock.Unlock()
+}
+
+// Sets the memory available to tables, given the memory available to the
+// cache. Must be called with the lock held.
+func (c *Memcache) setMaxTableMem(availableMem int64) {
+	if availableMem > int64(maxMemory) {
+		availableMem = int64(maxMemory)
+	}
+	// Flags are stored outside the tables, so tables get whatever memory the
+	// flags don't use.
+	c.maxTableMem = availableMem - c.flagsMem
+	if c.maxTableMem < 0 {
+		c.maxTableMem = 0
+	}
+}
+
+// Stats describes the size of the cache.
+type Stats struct {
+	// Number of keys in the cache.
+	Keys int
+	// Number of tables, and the memory they use.
+	Tables   int
+	TableMem int64
+	// Memory the tables are allowed to use, and the number of tables which fit
+	// in it.
+	MaxTableMem int64
+	MaxTables   int
+	// Space within the tables used by live entries, deleted entries (which
+	// can be reclaimed by GC), and not yet used.
+	LiveSpace    int64
+	DeletedSpace int64
+	FreeSpace    int64
+	// Resident set size of the process, or -1 if it can't be determined.
+	Rss int64
+}
+
+func (c *Memcache) Stats() Stats {
+	c.lock.RLock()
+	stats := Stats{
+		Keys:        len(c.keys),
+		Tables:      c.tables.Len(),
+		TableMem:    c.tableMem,
+		MaxTableMem: c.maxTableMem,
+		MaxTables:   int(c.maxTableMem / c.tableSize),
+	}
+	for _, info := range c.tableInfos() {
+		stats.LiveSpace += int64(info.LiveSpace)
+		stats.DeletedSpace += int64(info.DeletedSpace)
+		stats.FreeSpace += int64(info.FreeSpace)
+	}
+	c.lock.RUnlock()
+
+	stats.Rss = getRss()
+	return stats
+}
+
+// TableInfo describes the space used by a table.
+type TableInfo struct {
+	// Generation of the table. Larger is newer.
+	Generation uint64
+	// Size of the table.
+	Size int
+	// Number of live and deleted entries.
+	Entries int
+	Deleted int
+	// Space used by live and deleted entries, and free space.
+	LiveSpace    int
+	DeletedSpace int
+	FreeSpace    int
+}
+
+// Tables returns information about each table, newest first, for debugging.
+func (c *Memcache) Tables() []TableInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tableInfos()
+}
+
+func (c *Memcache) tableInfos() []TableInfo {
+	infos := make([]TableInfo, 0, c.tables.Len())
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*DiscardableTable)
+		infos = append(infos, TableInfo{
+			Generation:   t.Meta().(uint64),
+			Size:         t.Size(),
+			Entries:      t.NumEntries(),
+			Deleted:      t.NumDeleted(),
+			LiveSpace:    t.LiveSpace(),
+			DeletedSpace: t.DeletedSpace(),
+			FreeSpace:    t.FreeSpace(),
+		})
+	}
+	return infos
+}
+
+// Inspect returns information about where the key is stored, for debugging.
+// Unlike Get, this does not promote the key.
+func (c *Memcache) Inspect(key []byte) (KeyInfo, bool) {
+	if len(key) == 0 {
+		return KeyInfo{}, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	t, val := c.find(key, c.hashFunc(key))
+	if t == nil {
+		return KeyInfo{}, false
+	}
+	return KeyInfo{
+		Generation: t.Meta().(uint64),
+		Offset:     t.EntryOffset(key),
+		EntrySize:  len(key) + len(val) + prefixLen,
+		TableSize:  t.Size(),
+	}, true
+}
+
+// KeyAge returns how many tables have been created since the key's table,
+// which approximates how long ago the key was written or last promoted. Unlike
+// Get, this does not promote the key.
+func (c *Memcache) KeyAge(key []byte) (uint64, bool) {
+	if len(key) == 0 {
+		return 0, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.isExpired(key) {
+		return 0, false
+	}
+	t, _ := c.find(key, c.hashFunc(key))
+	if t == nil {
+		return 0, false
+	}
+	return c.count - t.Meta().(uint64), true
+}
+
+// GetRange appends the bytes of the key's value from start to end, inclusive,
+// to buf. Negative offsets are relative to the end of the value, so -1 is the
+// last byte, and offsets beyond the value are clamped. Returns false if the
+// key doesn't exist. Like KeyAge, this does not promote the key.
+func (c *Memcache) GetRange(key []byte, start, end int, buf []byte) ([]byte, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.getRange(key, start, end, buf)
+}
+
+func (c *Memcache) getRange(key []byte, start, end int, buf []byte) ([]byte, bool) {
+	if len(key) == 0 || c.isExpired(key) {
+		return nil, false
+	}
+	t, val := c.find(key, c.hashFunc(key))
+	if t == nil {
+		return nil, false
+	}
+
+	if start < 0 {
+		start += len(val)
+	}
+	if end < 0 {
+		end += len(val)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= len(val) {
+		end = len(val) - 1
+	}
+	if buf == nil {
+		buf = []byte{}
+	}
+	if start > end {
+		return buf, true
+	}
+	return append(buf, val[start:end+1]...), true
+}
+
+// SetRange overwrites the key's value, starting at offset, with val. The value
+// is extended with zero bytes if offset is beyond its end, and a missing key is
+// treated as an empty value. The key's TTL is kept. Returns the length of the
+// new value, or ErrTooLarge if it would exceed the maximum value size, in
+// which case the existing value is left unchanged.
+func (c *Memcache) SetRange(key []byte, offset int, val []byte) (int, error) {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	return c.setRange(key, offset, val)
+}
+
+func (c *Memcache) setRange(key []byte, offset int, val []byte) (int, error) {
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	} else if offset < 0 {
+		return 0, ErrOutOfRange
+	}
+	c.expireKey(key)
+	_, old := c.find(key, c.hashFunc(key))
+	if len(val) == 0 {
+		// Nothing to write, so don't create the key.
+		return len(old), nil
+	}
+
+	newLen := offset + len(val)
+	if newLen < len(old) {
+		newLen = len(old)
+	}
+	if newLen > c.maxValSize {
+		return len(old), ErrTooLarge
+	}
+	// Write the whole value with put, which overwrites the entry in place if
+	// the length is unchanged and it's in the newest table, or stores it anew
+	// otherwise. |old| points into the table, so must be copied before the put.
+	buf := make([]byte, newLen)
+	copy(buf, old)
+	copy(buf[offset:], val)
+	return newLen, c.put(key, buf, KeepTTL)
+}
+
+// Returns the size of tables that should store a value of size |valSize|.
+func (c *Memcache) tableSizeFor(valSize int) int64 {
+	if c.largeValThreshold > 0 && valSize > c.largeValThreshold {
+		return c.largeTableSize
+	}
+	return c.tableSize
+}
+
+func (c *Memcache) findPutTable(entrySize int, tableSize int64) *DiscardableTable {
+	var t *DiscardableTable
+	i := 0
+	// Search a few of the most recent tables for the smallest spot the entry will fit into.
+	for e := c.tables.Front(); e != nil && i < c.freeSearchTables; e = e.Next() {
+		et := e.Value.(*DiscardableTable)
+		if int64(et.Size()) != tableSize {
+			// Different class of table.
+			continue
+		}
+		if et.FreeSpace() >= entrySize {
+			if t == nil || et.FreeSpace() < t.FreeSpace() {
+				t = et
+			}
+		}
+		i++
+	}
+	return t
+}
+
+func (c *Memcache) putWithHash(key, val []byte, hash uint64) error {
+	// A value of the same size in the newest table is overwritten in place,
+	// which leaves no deleted space to be GC'd. Values in older tables are
+	// stored anew, like any other put, so that writing a key can still move it
+	// out of a table which is due to be evicted.
+	if t, old := c.find(key, hash); t != nil && len(old) == len(val) && c.isNewestTable(t) {
+		if t.Overwrite(key, val) {
+			c.recordAccess(t)
+			return nil
+		}
+	}
+
+	// Only one copy of the key should exist anywhere in the cache, so
+	// deleting any existing value before inserting the new one.
+	existed := c.deleteWithHash(key, hash)
+
+	if len(key) > c.maxKeySize || len(val) > c.maxValSize {
+		return ErrTooLarge
+	}
+	return c.storeWithHash(key, val, hash, existed)
+}
+
+// Returns whether |t| is the newest table of its size, which new entries of
+// its size are stored in.
+func (c *Memcache) isNewestTable(t *DiscardableTable) bool {
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		if et := e.Value.(*DiscardableTable); et.Size() == t.Size() {
+			return et == t
+		}
+	}
+	return false
+}
+
+// Stores the entry, which must not already exist, without checking the key
+// and value sizes. |existed| is whether the entry replaces an existing value,
+// so isn't subject to the soft limit.
+func (c *Memcache) storeWithHash(key, val []byte, hash uint64, existed bool) error {
+	tableSize := c.tableSizeFor(len(val))
+	if c.maxTableMem < tableSize {
+		return nil
+	}
+	entrySize := (*PackedTable)(nil).EntrySize(key, val)
+	if int64(entrySize) > tableSize {
+		// The entry will never fit into a table, even an empty one.
+		putsTooLarge.Inc()
+		if debugLog {
+			log.Printf("Entry size %d larger than table size %d", entrySize, tableSize)
+		}
+		return ErrTooLarge
+	}
+
+	t := c.findPutTable(entrySize, tableSize)
+	if t == nil {
+		if !existed && c.atSoftLimit(tableSize) {
+			softLimitRejects.Inc()
+			return ErrSoftLimit
+		}
+		t = c.createTable(tableSize)
+	}
+	err := t.Put(key, val, hash)
+	if err != nil {
+		return err
+	}
+	if c.seenKeys != nil {
+		c.seenKeys.add(hash)
+	}
+	// Linear probing for the next free hash slot.
+	for ; c.keys[hash] != nil; hash++ {
+	}
+	c.keys[hash] = t
+	return nil
+}
+
+// Put stores the key/value in the cache, replacing any existing value. Returns
+// ErrTooLarge if the key or value exceeds the maximum size, in which case any
+// existing value is deleted, or ErrEmptyKey if the key is empty. Being a
+// cache, a successful Put does not guarantee the value will be stored.
+func (c *Memcache) Put(key, val []byte) error {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	return c.put(key, val, 0)
+}
+
+// PutBatch stores each key/value pair in the cache, like Put. Entries are
+// stored largest first, so that tables are packed densely before new ones are
+// created. If a key appears more than once, the last value is stored. Entries
+// which can't be stored are skipped, and the first error is returned.
+func (c *Memcache) PutBatch(keys, vals [][]byte) error {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	return c.putBatch(keys, vals)
+}
+
+func (c *Memcache) putBatch(keys, vals [][]byte) error {
+	if len(keys) != len(vals) {
+		panic("len(keys) != len(vals)")
+	}
+	last := make(map[string]int, len(keys))
+	for i, key := range keys {
+		last[string(key)] = i
+	}
+	order := make([]int, 0, len(last))
+	for _, i := range last {
+		order = append(order, i)
+	}
+	entrySize := func(i int) int {
+		return (*PackedTable)(nil).EntrySize(keys[i], vals[i])
+	}
+	sort.Slice(order, func(a, b int) bool {
+		sa, sb := entrySize(order[a]), entrySize(order[b])
+		if sa != sb {
+			return sa > sb
+		}
+		return order[a] < order[b]
+	})
+
+	var firstErr error
+	for _, i := range order {
+		err := c.put(keys[i], vals[i], 0)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// PutWithTTL is like Put, but the key expires after ttl. A ttl <= 0 means the
+// key never expires. Expired keys are not returned, and are periodically
+// deleted to reclaim their space.
+func (c *Memcache) PutWithTTL(key, val []byte, ttl time.Duration) error {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	return c.put(key, val, ttl)
+}
+
+// PutEvicting is like PutWithTTL, but also returns whether other entries had
+// to be evicted to make room. Callers can use this as a signal that the cache
+// is at capacity, and slow down writes.
+func (c *Memcache) PutEvicting(key, val []byte, ttl time.Duration) (bool, error) {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	return c.putEvicting(key, val, ttl)
+}
+
+// Add is like PutWithTTL, but only stores the value if the key isn't already
+// in the cache. Returns whether the value was stored.
+func (c *Memcache) Add(key, val []byte, ttl time.Duration) (bool, error) {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	return c.add(key, val, ttl)
+}
+
+// Replace is like PutWithTTL, but only stores the value if the key is already
+// in the cache. Returns whether the value was stored.
+func (c *Memcache) Replace(key, val []byte, ttl time.Duration) (bool, error) {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	return c.replace(key, val, ttl)
+}
+
+func (c *Memcache) add(key, val []byte, ttl time.Duration) (bool, error) {
+	if c.has(key) {
+		return false, nil
+	}
+	err := c.put(key, val, ttl)
+	return err == nil, err
+}
+
+func (c *Memcache) replace(key, val []byte, ttl time.Duration) (bool, error) {
+	if !c.has(key) {
+		return false, nil
+	}
+	err := c.put(key, val, ttl)
+	return err == nil, err
+}
+
+// GetWithCas is like Get, but also returns a CAS token identifying the stored
+// value, for use with PutWithCas. The token changes whenever the key is
+// stored, but may also change without the value changing, for example when
+// the key is moved to a newer table, so a failed PutWithCas should be retried
+// with a fresh token.
+func (c *Memcache) GetWithCas(key, buf []byte) ([]byte, uint64, bool) {
+	if len(key) == 0 {
+		return nil, 0, false
+	}
+
+	tr := startTrace()
+	defer tr.finish("get")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	val := c.get(key, buf)
+	if val == nil {
+		return nil, 0, false
+	}
+	// Find the key again, since get() may have promoted it.
+	return val, c.casToken(key), true
+}
+
+// PutWithCas is like Put, but only stores the value if the key is in the
+// cache, and its CAS token matches cas. Returns whether the value was stored.
+func (c *Memcache) PutWithCas(key, val []byte, cas uint64) (bool, error) {
+	tr := startTrace()
+	defer tr.finish("put")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tr.lockAcquired()
+	if len(key) == 0 || c.expireKey(key) {
+		return false, nil
+	} else if token := c.casToken(key); token == 0 || token != cas {
+		return false, nil
+	}
+	err := c.put(key, val, 0)
+	return err == nil, err
+}
+
+// Returns the CAS token of the key, or 0 if the key isn't in the cache.
+//
+// The token packs the low 24 bits of the table generation, the low 10 bits of
+// the table's epoch, and the entry's offset (which is less than 2^30). Entries
+// are only appended within an epoch, so each store of a key gets a distinct
+// token, unless the fields wrap around.
+func (c *Memcache) casToken(key []byte) uint64 {
+	t, _ := c.find(key, c.hashFunc(key))
+	if t == nil {
+		return 0
+	}
+	gen := t.Meta().(uint64) & (1<<24 - 1)
+	epoch := uint64(t.Epoch()) & (1<<10 - 1)
+	off := uint64(t.EntryOffset(key))
+	// Add 1 so that a valid token is never 0.
+	return (gen<<40 | epoch<<30 | off) + 1
+}
+
+func (c *Memcache) putEvicting(key, val []byte, ttl time.Duration) (bool, error) {
+	evictedTables := c.evictedTables
+	err := c.put(key, val, ttl)
+	return c.evictedTables != evictedTables, err
+}
+
+func (c *Memcache) put(key, val []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if ttl == KeepTTL {
+		// An expired key no longer exists, so has no TTL to keep.
+		ttl = 0
+		if !c.expireKey(key) {
+			ttl = c.ttl(key)
+		}
+	}
+	if len(c.expiries) > 0 {
+		// A Put replaces any existing TTL.
+		delete(c.expiries, string(key))
+	}
+	c.clearMiss(key)
+	c.clearFlags(key)
+	var err error
+	if c.maxChunkedValSize > 0 && len(val) > c.maxValSize {
+		err = c.putChunked(key, val)
+	} else {
+		err = c.putWithHash(key, val, c.hashFunc(key))
+	}
+	if err == nil && ttl > 0 {
+		c.expiries[string(key)] = c.nowFunc().Add(ttl).UnixNano()
+	}
+	if err == nil {
+		c.publish(feedOpPut, key, val, ttl)
+	} else {
+		// Any existing value was deleted.
+		c.publish(feedOpDelete, key, nil, 0)
+	}
+	c.keyChanged(key)
+	return err
+}
+
+func (c *Memcache) tryCompaction(t *DiscardableTable) bool {
+	e := t.Element()
+	if t.NumEntries() == 0 {
+		// Move empty tables to the back to allow them to be recycled.
+		t.Reset()
+		c.tables.MoveToBack(e)
+		// Didn't technically compact, but achieved the same result.
+		return true
+	}
+
+	// TODO: Compaction.
+	return false
+}
+
+// Compacts the most fragmented tables while deleted entries take up more than
+// compactionThreshold of table memory. Does nothing if another table can't be
+// created without evicting, since the oldest tables would be evicted anyway.
+// Returns the number of bytes reclaimed.
+func (c *Memcache) compactFragmented() int {
+	if c.compactionThreshold == 0 || c.tableMem+c.tableSize > c.maxTableMem {
+		return 0
+	}
+
+	var fragmented []*DiscardableTable
+	deletedSpace := 0
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*DiscardableTable)
+		if d := t.DeletedSpace(); d > 0 {
+			fragmented = append(fragmented, t)
+			deletedSpace += d
+		}
+	}
+	threshold := int(c.compactionThreshold * float64(c.tableMem))
+	if deletedSpace <= threshold {
+		return 0
+	}
+
+	start := time.Now()
+	sort.Slice(fragmented, func(i, j int) bool {
+		return fragmented[i].DeletedSpace() > fragmented[j].DeletedSpace()
+	})
+	reclaimed := 0
+	compacted := 0
+	for _, t := range fragmented {
+		if deletedSpace <= threshold {
+			break
+		}
+		d := t.DeletedSpace()
+		if !c.tryCompaction(t) {
+			t.GC()
+		}
+		deletedSpace -= d
+		reclaimed += d
+		compacted++
+	}
+	compactionReclaimed.Add(float64(reclaimed))
+	if debugLog {
+		log.Printf("Compacted %d tables, reclaiming %d MB in %0.3f sec", compacted,
+			reclaimed/megabyte, time.Since(start).Seconds())
+	}
+	return reclaimed
+}
+
+// RunGC compacts every table in the cache, reclaiming space used by deleted
+// entries so that it can be reused for new entries. Returns the number of
+// bytes reclaimed.
+func (c *Memcache) RunGC() int {
+	start := time.Now()
+	reclaimed := 0
+
+	c.lock.Lock()
+	for e := c.tables.Front(); e != nil; {
+		next := e.Next()
+		t := e.Value.(*DiscardableTable)
+		deletedSpace := t.DeletedSpace()
+		if !c.tryCompaction(t) && deletedSpace > 0 {
+			t.GC()
+		}
+		reclaimed += deletedSpace
+		e = next
+	}
+	c.lock.Unlock()
+
+	if debugLog {
+		log.Printf("RunGC reclaimed %d MB in %0.3f sec", reclaimed/megabyte,
+			time.Since(start).Seconds())
+	}
+	return reclaimed
+}
+
+// EvictAndReclaim deletes the key, and immediately garbage collects the tables
+// containing it, instead of waiting for their deleted space to reach the GC
+// threshold. Returns the number of bytes reclaimed, which includes space used
+// by other deleted entries in the tables, or 0 if the key isn't in the cache.
+func (c *Memcache) EvictAndReclaim(key []byte) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(key) == 0 || c.expireKey(key) {
+		return 0
+	}
+
+	tables := c.keyTables(key)
+	usedSpace := func() int {
+		used := 0
+		seen := make(map[*DiscardableTable]bool, len(tables))
+		for _, t := range tables {
+			if !seen[t] {
+				used += t.LiveSpace() + t.DeletedSpace()
+				seen[t] = true
+			}
+		}
+		return used
+	}
+
+	before := usedSpace()
+	c.delete(key)
+	for _, t := range tables {
+		if t.DeletedSpace() > 0 {
+			t.GC()
+		}
+	}
+	return before - usedSpace()
+}
+
+// Returns the tables containing the key's value, or its chunks, which may
+// include duplicates. Only requires the read lock.
+func (c *Memcache) keyTables(key []byte) []*DiscardableTable {
+	if t, _ := c.find(key, c.hashFunc(key)); t != nil {
+		return []*DiscardableTable{t}
+	}
+	m, ok := c.chunkedManifest(key)
+	if !ok {
+		return nil
+	}
+	var tables []*DiscardableTable
+	for i := 0; i < m.chunks; i++ {
+		ck := c.chunkKey(key, m.gen, i)
+		if t, _ := c.find(ck, c.hashFunc(ck)); t != nil {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// Deletes the key, returning whether it existed.
+func (c *Memcache) deleteWithHash(key []byte, hash uint64) bool {
+	if len(c.chunked) > 0 && len(key) <= c.maxKeySize && c.deleteChunked(key) {
+		// A key is never stored both as chunks and as a single entry.
+		return true
+	}
+	for ; ; hash++ {
+		t, ok := c.keys[hash]
+		if !ok {
+			break
+		} else if t == nil {
 			// Slot for deleted entry.
 			// TODO: Consider migrating probed entries closer to their optimal slot.
 			continue
@@ -445,15 +2167,55 @@ func (c *Memcache) deleteWithHash(key []byte, hash uint64) {
 			c.erase(hash)
 			c.tryCompaction(t)
 			// Since the tables are exclusive, we can stop here.
-			break
+			return true
 		}
 	}
+	return false
 }
 
 func (c *Memcache) Delete(key []byte) {
-	hash := c.hashFunc(key)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.delete(key)
+}
 
+func (c *Memcache) delete(key []byte) {
+	if len(key) == 0 {
+		return
+	}
+	if len(c.expiries) > 0 {
+		delete(c.expiries, string(key))
+	}
+	c.clearMiss(key)
+	c.clearFlags(key)
+	c.deleteWithHash(key, c.hashFunc(key))
+	c.keyChanged(key)
+	c.publish(feedOpDelete, key, nil, 0)
+}
+
+// Discards every table. Must be called with the lock held.
+func (c *Memcache) discardTables() {
+	c.allKeysChanged()
+	for c.tables.Len() > 0 {
+		e := c.tables.Front()
+		t := e.Value.(*DiscardableTable)
+		c.tableMem -= int64(t.Size())
+		t.Discard()
+		c.tables.Remove(e)
+	}
+}
+
+// Clear deletes every key in the cache, and releases all table memory.
+func (c *Memcache) Clear() {
 	c.lock.Lock()
-	c.deleteWithHash(key, hash)
-	c.lock.Unlock()
+	defer c.lock.Unlock()
+	c.discardTables()
+	// Replacing the maps is quicker than cleaning up each table's hashes.
+	c.keys = make(keyTable)
+	c.expiries = make(map[string]int64)
+	c.misses = make(map[string]int64)
+	c.flags = make(map[string]uint32)
+	c.flagsMem = 0
+	c.chunked = make(map[string]chunkManifest)
+	c.publish(feedOpReset, nil, nil, 0)
 }
@@ -1,8 +1,18 @@
 package dory
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,6 +46,7 @@ func TestMemcache_HashCollisions(t *testing.T) {
 		},
 	}
 	c := NewMemcache(opts)
+	defer c.Close()
 
 	assert.False(t, hasString(c, "foo"))
 	assert.False(t, hasString(c, "bar"))
@@ -77,13 +88,355 @@ func TestMemcache_HashCollisions(t *testing.T) {
 	assert.Equal(t, "", getString(c, "baz"))
 }
 
+func TestMemcache_ProbeStats(t *testing.T) {
+	opts := MemcacheOptions{
+		HashFunction: func(b []byte) uint64 {
+			return 7
+		},
+	}
+	c := NewMemcache(opts)
+	defer c.Close()
+
+	avg, max := c.ProbeStats()
+	assert.Equal(t, 0.0, avg)
+	assert.Equal(t, 0, max)
+
+	putString(c, "foo", "11")
+	putString(c, "bar", "22")
+	putString(c, "baz", "33")
+	// All keys are in the same table, so are found in the first slot.
+	avg, max = c.ProbeStats()
+	assert.Equal(t, 0.0, avg)
+	assert.Equal(t, 0, max)
+
+	// Deleting leaves an empty slot which needs to be probed past.
+	deleteString(c, "foo")
+	avg, max = c.ProbeStats()
+	assert.Equal(t, 1.0, avg)
+	assert.Equal(t, 1, max)
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	table := c.tables.Front().Value.(*DiscardableTable)
+	dist, ok := c.probeDistance(table, []byte("bar"))
+	assert.True(t, ok)
+	assert.Equal(t, 1, dist)
+	_, ok = c.probeDistance(table, []byte("foo"))
+	assert.False(t, ok)
+}
+
+func TestMemcache_RunGC(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{})
+	defer c.Close()
+
+	putString(c, "foo", "11")
+	putString(c, "bar", "22")
+	putString(c, "baz", "33")
+	assert.Equal(t, 0, c.RunGC())
+
+	deleteString(c, "foo")
+	putString(c, "bar", "44")
+	assert.Greater(t, c.RunGC(), 0)
+	assert.Equal(t, 0, c.RunGC())
+	assert.False(t, hasString(c, "foo"))
+	assert.Equal(t, "44", getString(c, "bar"))
+	assert.Equal(t, "33", getString(c, "baz"))
+}
+
+func TestMemcache_EvictAndReclaim(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{})
+	defer c.Close()
+
+	putString(c, "foo", "11")
+	putString(c, "bar", "22")
+	assert.Equal(t, 0, c.EvictAndReclaim([]byte("missing")))
+	assert.Greater(t, c.EvictAndReclaim([]byte("foo")), 0)
+	assert.Equal(t, 0, c.RunGC())
+	assert.Equal(t, 0, c.EvictAndReclaim([]byte("foo")))
+	assert.False(t, hasString(c, "foo"))
+	assert.Equal(t, "22", getString(c, "bar"))
+}
+
+func TestMemcache_CompactFragmented(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		MemoryFunction:      ConstantMemory(megabyte),
+		TableSize:           64 * 1024,
+		MaxValSize:          1024,
+		CompactionThreshold: 0.05,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		c.Put([]byte(fmt.Sprint(i)), val)
+	}
+	// Deleting every 10th key fragments every table, but not enough to trigger
+	// each table's automatic GC.
+	for i := 0; i < 200; i += 10 {
+		c.Delete([]byte(fmt.Sprint(i)))
+	}
+
+	deletedSpace := func() int {
+		total := 0
+		for _, info := range c.Tables() {
+			total += info.DeletedSpace
+		}
+		return total
+	}
+	assert.Greater(t, deletedSpace(), 0)
+
+	// Out of memory, so there's no point compacting.
+	c.lock.Lock()
+	c.maxTableMem = c.tableMem
+	assert.Equal(t, 0, c.compactFragmented())
+	c.maxTableMem = megabyte
+	assert.Greater(t, c.compactFragmented(), 0)
+	threshold := int(0.05 * float64(c.tableMem))
+	c.lock.Unlock()
+	assert.LessOrEqual(t, deletedSpace(), threshold)
+
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, i%10 != 0, hasString(c, fmt.Sprint(i)))
+	}
+}
+
+func TestMemcache_LargeValues(t *testing.T) {
+	opts := MemcacheOptions{
+		MemoryFunction:      ConstantMemory(4 * megabyte),
+		TableSize:           64 * 1024,
+		MaxValSize:          64 * 1024,
+		LargeValueThreshold: 16 * 1024,
+		LargeTableSize:      megabyte,
+	}
+	c := NewMemcache(opts)
+	defer c.Close()
+
+	smallVal := make([]byte, 1024)
+	largeVal := make([]byte, 32*1024)
+	rand.Read(smallVal)
+	rand.Read(largeVal)
+	c.Put([]byte("small"), smallVal)
+	c.Put([]byte("large"), largeVal)
+	assert.Equal(t, smallVal, c.Get([]byte("small"), nil))
+	assert.Equal(t, largeVal, c.Get([]byte("large"), nil))
+
+	assert.Equal(t, 2, c.tables.Len())
+	assert.Equal(t, int64(64*1024+megabyte), c.tableMem)
+
+	// Fill the cache with large values, which should evict the small table.
+	for i := 0; i < 4*megabyte/len(largeVal); i++ {
+		c.Put([]byte(fmt.Sprintf("large%d", i)), largeVal)
+	}
+	assert.False(t, c.Has([]byte("small")))
+	assert.LessOrEqual(t, c.tableMem, int64(4*megabyte))
+}
+
+func TestMemcache_TooLarge(t *testing.T) {
+	assert.Panics(t, func() {
+		NewMemcache(MemcacheOptions{
+			TableSize:  64 * 1024,
+			MaxValSize: 128 * 1024,
+		})
+	})
+
+	opts := MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxKeySize: 16,
+		MaxValSize: 1024,
+	}
+	c := NewMemcache(opts)
+	defer c.Close()
+
+	putString(c, "foo", "11")
+	assert.Equal(t, ErrTooLarge, c.Put([]byte("foo"), make([]byte, 1025)))
+	assert.Equal(t, ErrTooLarge, c.Put(make([]byte, 17), []byte("22")))
+	assert.False(t, hasString(c, "foo"))
+	assert.NoError(t, c.Put([]byte("bar"), make([]byte, 1024)))
+	assert.True(t, hasString(c, "bar"))
+}
+
+func TestMemcache_Inspect(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	_, ok := c.Inspect([]byte("foo"))
+	assert.False(t, ok)
+
+	putString(c, "foo", "11")
+	putString(c, "bar", "2222")
+	info, ok := c.Inspect([]byte("foo"))
+	assert.True(t, ok)
+	assert.Equal(t, 0, info.Offset)
+	assert.Equal(t, 3+2+prefixLen, info.EntrySize)
+	assert.Equal(t, 64*1024, info.TableSize)
+	info, ok = c.Inspect([]byte("bar"))
+	assert.True(t, ok)
+	assert.Equal(t, 3+2+prefixLen, info.Offset)
+	assert.Equal(t, 3+4+prefixLen, info.EntrySize)
+}
+
+func TestMemcache_DumpLoad(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{})
+	defer c.Close()
+	putString(c, "foo", "11")
+	putString(c, "bar", "22")
+	putString(c, "baz", "33")
+	putString(c, "quux", "44")
+	deleteString(c, "foo")
+	putString(c, "bar", "55")
+
+	var buf bytes.Buffer
+	n, err := c.DumpTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	// "quux" should be skipped because the key is too large.
+	c2 := NewMemcache(MemcacheOptions{MaxKeySize: 3})
+	defer c2.Close()
+	loaded, skipped, err := c2.LoadFrom(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+	assert.Equal(t, 1, skipped)
+	assert.False(t, hasString(c2, "foo"))
+	assert.Equal(t, "55", getString(c2, "bar"))
+	assert.Equal(t, "33", getString(c2, "baz"))
+	assert.False(t, hasString(c2, "quux"))
+}
+
+func TestMemcache_DumpLoadChunked(t *testing.T) {
+	opts := MemcacheOptions{
+		TableSize:         64 * 1024,
+		MaxKeySize:        64,
+		MaxValSize:        1024,
+		MaxChunkedValSize: 20000,
+	}
+	c := NewMemcache(opts)
+	defer c.Close()
+	big := make([]byte, 3000)
+	rand.Read(big)
+	assert.NoError(t, c.Put([]byte("big"), big))
+	putString(c, "foo", "11")
+
+	var buf bytes.Buffer
+	n, err := c.DumpTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	// The chunks aren't dumped, only the whole value.
+	c2 := NewMemcache(opts)
+	defer c2.Close()
+	loaded, skipped, err := c2.LoadFrom(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+	assert.Equal(t, 0, skipped)
+	assert.Equal(t, big, c2.Get([]byte("big"), nil))
+	assert.Equal(t, "11", getString(c2, "foo"))
+}
+
+func TestMemcache_DumpLoadTTL(t *testing.T) {
+	opts := MemcacheOptions{
+		TableSize:         64 * 1024,
+		MaxKeySize:        64,
+		MaxValSize:        1024,
+		MaxChunkedValSize: 20000,
+	}
+	c := NewMemcache(opts)
+	defer c.Close()
+	now := time.Now()
+	c.nowFunc = func() time.Time { return now }
+	putString(c, "foo", "11")
+	assert.NoError(t, c.PutWithTTL([]byte("bar"), []byte("22"), time.Minute))
+	assert.NoError(t, c.PutWithTTL([]byte("baz"), []byte("33"), time.Second))
+	big := make([]byte, 3000)
+	rand.Read(big)
+	assert.NoError(t, c.PutWithTTL([]byte("big"), big, time.Minute))
+	assert.NoError(t, c.PutWithTTL([]byte("old"), big, time.Second))
+	// "baz" and "old" expire, but aren't swept.
+	now = now.Add(2 * time.Second)
+
+	var buf bytes.Buffer
+	_, err := c.DumpTo(&buf)
+	assert.NoError(t, err)
+
+	c2 := NewMemcache(opts)
+	defer c2.Close()
+	loaded, skipped, err := c2.LoadFrom(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, loaded)
+	assert.Equal(t, 0, skipped)
+	assert.Equal(t, "11", getString(c2, "foo"))
+	assert.Equal(t, "22", getString(c2, "bar"))
+	assert.Equal(t, big, c2.Get([]byte("big"), nil))
+	assert.False(t, hasString(c2, "baz"))
+	assert.False(t, hasString(c2, "old"))
+
+	// The remaining TTLs are kept.
+	c2.lock.Lock()
+	defer c2.lock.Unlock()
+	assert.Equal(t, time.Duration(0), c2.ttl([]byte("foo")))
+	for _, key := range []string{"bar", "big"} {
+		ttl := c2.ttl([]byte(key))
+		assert.True(t, ttl > 50*time.Second && ttl <= 58*time.Second, "%s: %v", key, ttl)
+	}
+}
+
+func TestLoggingCache(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{})
+	defer c.Close()
+	var log bytes.Buffer
+	lc := NewLoggingCache(c, &log)
+	assert.NoError(t, lc.Put([]byte("foo"), []byte("11")))
+	assert.NoError(t, lc.Put([]byte("bar"), []byte("22")))
+	lc.Delete([]byte("foo"))
+	assert.NoError(t, lc.Put([]byte("bar"), []byte("33")))
+	assert.NoError(t, lc.Err())
+	assert.False(t, hasString(c, "foo"))
+	assert.Equal(t, "33", getString(c, "bar"))
+
+	// Replaying the log into a cache which has "foo" deletes it.
+	c2 := NewMemcache(MemcacheOptions{})
+	defer c2.Close()
+	putString(c2, "foo", "44")
+	loaded, skipped, err := c2.LoadFrom(&log)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, loaded)
+	assert.Equal(t, 0, skipped)
+	assert.False(t, hasString(c2, "foo"))
+	assert.Equal(t, "33", getString(c2, "bar"))
+}
+
+func TestLoggingCache_PutError(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{MaxValSize: 16})
+	defer c.Close()
+	var log bytes.Buffer
+	lc := NewLoggingCache(c, &log)
+	assert.NoError(t, lc.Put([]byte("foo"), []byte("11")))
+	// The failed Put deletes the existing value, which is logged.
+	assert.Equal(t, ErrTooLarge, lc.Put([]byte("foo"), make([]byte, 17)))
+	assert.NoError(t, lc.Err())
+	assert.False(t, hasString(c, "foo"))
+
+	c2 := NewMemcache(MemcacheOptions{})
+	defer c2.Close()
+	loaded, skipped, err := c2.LoadFrom(&log)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+	assert.Equal(t, 0, skipped)
+	assert.False(t, hasString(c2, "foo"))
+}
+
 func BenchmarkMemcacheGet(b *testing.B) {
 	const numVal = 100000
 
 	opts := MemcacheOptions{
-		TableSize: 128 * 1024,
+		TableSize:  128 * 1024,
+		MaxValSize: valSize,
 	}
 	c := NewMemcache(opts)
+	defer c.Close()
 
 	values := make(map[string]bool, numVal)
 	var keyBuf [keySize]byte
@@ -111,13 +464,99 @@ func BenchmarkMemcacheGet(b *testing.B) {
 	}
 }
 
+func BenchmarkMemcacheGetParallel(b *testing.B) {
+	const numVal = 100000
+
+	for _, disablePromotion := range []bool{false, true} {
+		name := "Promotion"
+		if disablePromotion {
+			name = "NoPromotion"
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := MemcacheOptions{
+				TableSize:        128 * 1024,
+				MaxValSize:       valSize,
+				DisablePromotion: disablePromotion,
+			}
+			c := NewMemcache(opts)
+			defer c.Close()
+
+			keys := make([][]byte, numVal)
+			var valBuf [valSize]byte
+			for i := range keys {
+				keys[i] = make([]byte, keySize)
+				rand.Read(keys[i])
+				rand.Read(valBuf[:])
+				c.Put(keys[i], valBuf[:])
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				var buf [valSize]byte
+				for pb.Next() {
+					c.Get(keys[r.Intn(numVal)], buf[:0])
+				}
+			})
+		})
+	}
+}
+
+// Measures contention on the cache lock from concurrent Has, which only takes
+// the read lock, with and without concurrent writes.
+func BenchmarkMemcacheHasParallel(b *testing.B) {
+	const numVal = 100000
+
+	for _, writeEvery := range []int{0, 16} {
+		name := "ReadOnly"
+		if writeEvery > 0 {
+			name = fmt.Sprintf("WriteEvery%d", writeEvery)
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := MemcacheOptions{
+				TableSize:  128 * 1024,
+				MaxValSize: valSize,
+			}
+			c := NewMemcache(opts)
+			defer c.Close()
+
+			keys := make([][]byte, numVal)
+			var valBuf [valSize]byte
+			for i := range keys {
+				keys[i] = make([]byte, keySize)
+				rand.Read(keys[i])
+				rand.Read(valBuf[:])
+				c.Put(keys[i], valBuf[:])
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				var val [valSize]byte
+				for i := 1; pb.Next(); i++ {
+					key := keys[r.Intn(numVal)]
+					if writeEvery > 0 && i%writeEvery == 0 {
+						c.Put(key, val[:])
+					} else {
+						c.Has(key)
+					}
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkMemcachePut(b *testing.B) {
 	const numVal = 100000
 
 	opts := MemcacheOptions{
-		TableSize: 1024 * 1024,
+		TableSize:  1024 * 1024,
+		MaxValSize: valSize,
 	}
 	c := NewMemcache(opts)
+	defer c.Close()
 
 	values := make(map[string][]byte, numVal)
 	var keyBuf [keySize]byte
@@ -143,3 +582,1560 @@ func BenchmarkMemcachePut(b *testing.B) {
 		}
 	}
 }
+
+func TestMemcache_TTL(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	assert.NoError(t, c.PutWithTTL([]byte("foo"), []byte("11"), time.Second))
+	assert.NoError(t, c.PutWithTTL([]byte("bar"), []byte("22"), time.Minute))
+	putString(c, "baz", "33")
+	assert.True(t, hasString(c, "foo"))
+
+	now = now.Add(2 * time.Second)
+	assert.False(t, hasString(c, "foo"))
+	assert.Nil(t, c.Get([]byte("foo"), nil))
+	assert.True(t, hasString(c, "bar"))
+	c.Atomically(func(tx *Txn) {
+		assert.Equal(t, 58*time.Second, tx.TTL([]byte("bar")))
+		assert.Equal(t, time.Duration(0), tx.TTL([]byte("baz")))
+	})
+
+	// A Put without a TTL clears the existing TTL.
+	putString(c, "bar", "44")
+	now = now.Add(time.Hour)
+	assert.True(t, hasString(c, "bar"))
+	assert.True(t, hasString(c, "baz"))
+}
+
+func TestMemcache_Watch(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	version := func(key string) uint64 {
+		var v uint64
+		c.Atomically(func(tx *Txn) {
+			v = tx.KeyVersion([]byte(key))
+		})
+		return v
+	}
+
+	putString(c, "foo", "11")
+	v := c.Watch([]byte("foo"))
+	assert.Equal(t, v, c.Watch([]byte("foo")))
+	assert.Equal(t, v, version("foo"))
+	assert.Equal(t, uint64(0), version("bar"))
+
+	// Reads, including promotion, and GC don't change the version.
+	assert.Equal(t, "11", getString(c, "foo"))
+	c.RunGC()
+	assert.Equal(t, v, version("foo"))
+
+	putString(c, "foo", "22")
+	assert.NotEqual(t, v, version("foo"))
+	v = version("foo")
+	deleteString(c, "foo")
+	assert.NotEqual(t, v, version("foo"))
+
+	// Watching a key which doesn't exist detects it being added.
+	v = c.Watch([]byte("bar"))
+	assert.NoError(t, c.PutWithTTL([]byte("bar"), []byte("33"), time.Second))
+	assert.NotEqual(t, v, version("bar"))
+	v = version("bar")
+	now = now.Add(2 * time.Second)
+	assert.False(t, hasString(c, "bar"))
+	assert.NotEqual(t, v, version("bar"))
+
+	// Eviction changes the version.
+	putString(c, "bar", "44")
+	v = version("bar")
+	c.lock.Lock()
+	c.discardTable(c.tables.Front())
+	c.lock.Unlock()
+	assert.False(t, hasString(c, "bar"))
+	assert.NotEqual(t, v, version("bar"))
+
+	// So does recycling a table.
+	putString(c, "bar", "55")
+	v = version("bar")
+	c.lock.Lock()
+	e := c.tables.Front()
+	c.tables.Remove(e)
+	nt := c.recycleTable(e.Value.(*DiscardableTable))
+	nt.SetElement(c.tables.PushFront(nt))
+	c.lock.Unlock()
+	assert.False(t, hasString(c, "bar"))
+	assert.NotEqual(t, v, version("bar"))
+
+	// And the background sweep of expired keys.
+	assert.NoError(t, c.PutWithTTL([]byte("bar"), []byte("66"), time.Second))
+	v = version("bar")
+	now = now.Add(2 * time.Second)
+	c.lock.Lock()
+	assert.Equal(t, 1, c.sweepExpired())
+	c.lock.Unlock()
+	assert.NotEqual(t, v, version("bar"))
+
+	v = version("bar")
+	c.Clear()
+	assert.NotEqual(t, v, version("bar"))
+
+	c.Unwatch([]byte("foo"))
+	assert.NotEqual(t, uint64(0), version("foo"))
+	c.Unwatch([]byte("foo"))
+	c.Unwatch([]byte("bar"))
+	assert.Equal(t, uint64(0), version("foo"))
+	assert.Empty(t, c.watched)
+	assert.Panics(t, func() { c.Unwatch([]byte("foo")) })
+}
+
+func TestMemcache_Flags(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	assert.False(t, c.SetFlags([]byte("foo"), 1))
+	putString(c, "foo", "11")
+	putString(c, "bar", "22")
+	assert.True(t, c.SetFlags([]byte("foo"), 1))
+	val, flags := c.GetWithFlags([]byte("foo"), nil)
+	assert.Equal(t, []byte("11"), val)
+	assert.Equal(t, uint32(1), flags)
+	val, flags = c.GetWithFlags([]byte("baz"), nil)
+	assert.Nil(t, val)
+	assert.Equal(t, uint32(0), flags)
+	flags, ok := c.Flags([]byte("bar"))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0), flags)
+	_, ok = c.Flags([]byte("baz"))
+	assert.False(t, ok)
+
+	// Promotion and GC keep the flags, but storing the key clears them.
+	c.RunGC()
+	assert.Equal(t, "11", getString(c, "foo"))
+	flags, _ = c.Flags([]byte("foo"))
+	assert.Equal(t, uint32(1), flags)
+	putString(c, "foo", "33")
+	flags, _ = c.Flags([]byte("foo"))
+	assert.Equal(t, uint32(0), flags)
+
+	// The flags' memory is counted until they're cleared.
+	c.SetFlags([]byte("foo"), 2)
+	c.SetFlags([]byte("foo"), 4)
+	assert.Equal(t, int64(3+flagsEntryOverhead), c.flagsMem)
+	deleteString(c, "foo")
+	assert.Empty(t, c.flags)
+	assert.Equal(t, int64(0), c.flagsMem)
+
+	// Expired keys lose their flags.
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+	assert.NoError(t, c.PutWithTTL([]byte("foo"), []byte("44"), time.Second))
+	c.SetFlags([]byte("foo"), 5)
+	now = now.Add(2 * time.Second)
+	val, flags = c.GetWithFlags([]byte("foo"), nil)
+	assert.Nil(t, val)
+	assert.Equal(t, uint32(0), flags)
+	assert.Empty(t, c.flags)
+
+	// Flags of evicted keys are swept.
+	c.SetFlags([]byte("bar"), 3)
+	c.lock.Lock()
+	c.discardTable(c.tables.Front())
+	assert.Equal(t, 1, c.sweepFlags())
+	c.lock.Unlock()
+	assert.Empty(t, c.flags)
+	assert.Equal(t, int64(0), c.flagsMem)
+}
+
+func TestMemcache_HotKeys(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:        64 * 1024,
+		MaxValSize:       1024,
+		HotKeySampleRate: 2,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+	c.hotKeys = newHotKeys(2, now)
+	assert.True(t, c.TracksHotKeys())
+
+	for i := 0; i < 200; i++ {
+		putString(c, fmt.Sprint(i), "x")
+	}
+	for i := 0; i < 200; i++ {
+		// Key 0 is read 200 times, key 1 100 times, and the others once each.
+		getString(c, "0")
+		if i%2 == 0 {
+			getString(c, "1")
+		}
+		getString(c, fmt.Sprint(i))
+	}
+
+	now = now.Add(20 * time.Second)
+	keys := c.HotKeys(2)
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, []byte("0"), keys[0].Key)
+	assert.Equal(t, []byte("1"), keys[1].Key)
+	// Key 0 was read 201 times in 20 seconds.
+	assert.InDelta(t, 201.0/20, keys[0].Rate, 3)
+	assert.Greater(t, keys[0].Rate, keys[1].Rate)
+	assert.LessOrEqual(t, len(c.HotKeys(1000)), maxHotKeys)
+
+	// A new window starts, but rates are reported from the previous window
+	// until the new one has enough reads.
+	now = now.Add(hotKeyWindow)
+	keys = c.HotKeys(1)
+	assert.Equal(t, []byte("0"), keys[0].Key)
+	now = now.Add(hotKeyMinWindow)
+	assert.Empty(t, c.HotKeys(1))
+
+	c2 := NewMemcache(MemcacheOptions{})
+	defer c2.Close()
+	assert.False(t, c2.TracksHotKeys())
+	assert.Nil(t, c2.HotKeys(10))
+}
+
+func TestMemcache_SetMemoryLimit(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		MemoryFunction: ConstantMemory(8 * 64 * 1024),
+		TableSize:      64 * 1024,
+		MaxValSize:     1024,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 250; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	assert.Equal(t, 4, c.Stats().Tables)
+
+	// The limit changes straight away, and tables are evicted asynchronously.
+	c.SetMemoryLimit(2 * 64 * 1024)
+	assert.Equal(t, int64(2*64*1024), c.Stats().MaxTableMem)
+	assert.Eventually(t, func() bool {
+		return c.Stats().Tables == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, hasString(c, "249"))
+	assert.False(t, hasString(c, "0"))
+
+	c.SetMemoryLimit(0)
+	assert.Equal(t, int64(8*64*1024), c.Stats().MaxTableMem)
+	assert.Panics(t, func() { c.SetMemoryLimit(-1) })
+}
+
+func TestMemcache_KeepTTL(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	assert.NoError(t, c.PutWithTTL([]byte("foo"), []byte("11"), time.Minute))
+	assert.NoError(t, c.PutWithTTL([]byte("bar"), []byte("22"), time.Second))
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, c.PutWithTTL([]byte("foo"), []byte("33"), KeepTTL))
+	assert.Equal(t, []byte("33"), c.Get([]byte("foo"), nil))
+	// An expired key's TTL isn't kept, since the key no longer exists.
+	assert.NoError(t, c.PutWithTTL([]byte("bar"), []byte("44"), KeepTTL))
+	assert.NoError(t, c.PutWithTTL([]byte("baz"), []byte("55"), KeepTTL))
+	c.Atomically(func(tx *Txn) {
+		assert.Equal(t, 50*time.Second, tx.TTL([]byte("foo")))
+		assert.Equal(t, time.Duration(0), tx.TTL([]byte("bar")))
+		assert.Equal(t, time.Duration(0), tx.TTL([]byte("baz")))
+	})
+
+	now = now.Add(time.Minute)
+	assert.False(t, hasString(c, "foo"))
+	assert.True(t, hasString(c, "bar"))
+	assert.True(t, hasString(c, "baz"))
+}
+
+func TestMemcache_SweepExpired(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.PutWithTTL([]byte(fmt.Sprint(i)), val, time.Second))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	tables := c.tables.Len()
+	assert.True(t, tables > 1)
+	assert.Equal(t, 0, c.sweepExpired())
+
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, 200, c.sweepExpired())
+	assert.Equal(t, 0, len(c.expiries))
+	assert.Equal(t, 0, len(c.keys))
+	c.downsizeTables()
+	assert.Equal(t, 0, c.tables.Len())
+	assert.Equal(t, int64(0), c.tableMem)
+}
+
+func TestMemcache_DisablePromotion(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		c := NewMemcache(MemcacheOptions{
+			TableSize:        64 * 1024,
+			MaxValSize:       1024,
+			DisablePromotion: disable,
+		})
+		defer c.Close()
+
+		val := make([]byte, 1000)
+		for i := 0; i < 600; i++ {
+			assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+		}
+		info, ok := c.Inspect([]byte("0"))
+		assert.True(t, ok)
+		assert.Equal(t, uint64(0), info.Generation)
+
+		assert.NotNil(t, c.Get([]byte("0"), nil))
+		info, ok = c.Inspect([]byte("0"))
+		assert.True(t, ok)
+		if disable {
+			assert.Equal(t, uint64(0), info.Generation)
+		} else {
+			assert.NotEqual(t, uint64(0), info.Generation)
+		}
+	}
+}
+
+func TestMemcache_PromotionMinAge(t *testing.T) {
+	for _, minAge := range []int{0, 1000} {
+		c := NewMemcache(MemcacheOptions{
+			TableSize:       64 * 1024,
+			MaxValSize:      1024,
+			PromotionMinAge: minAge,
+		})
+		defer c.Close()
+
+		val := make([]byte, 1000)
+		for i := 0; i < 600; i++ {
+			assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+		}
+		assert.NotNil(t, c.Get([]byte("0"), nil))
+		info, ok := c.Inspect([]byte("0"))
+		assert.True(t, ok)
+		if minAge > 0 {
+			// The key's table isn't old enough to be promoted.
+			assert.Equal(t, uint64(0), info.Generation)
+		} else {
+			assert.NotEqual(t, uint64(0), info.Generation)
+		}
+	}
+}
+
+func TestMemcache_ZeroOnDiscard(t *testing.T) {
+	const chunkSize = 64 * 1024
+	secret := []byte("secret-value")
+	for _, zero := range []bool{false, true} {
+		buf := make([]byte, 2*chunkSize)
+		c := NewMemcache(MemcacheOptions{
+			MaxValSize:    1024,
+			Arena:         NewArena(buf, chunkSize),
+			ZeroOnDiscard: zero,
+		})
+		defer c.Close()
+
+		// Emptying a table resets it.
+		assert.NoError(t, c.Put([]byte("foo"), secret))
+		c.Delete([]byte("foo"))
+		assert.Equal(t, !zero, bytes.Contains(buf, secret))
+
+		assert.NoError(t, c.Put([]byte("foo"), secret))
+		c.lock.Lock()
+		c.discardTable(c.tables.Back())
+		c.lock.Unlock()
+		assert.Equal(t, !zero, bytes.Contains(buf, secret))
+	}
+}
+
+func TestMemcache_PromotionTableFraction(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:              64 * 1024,
+		MaxValSize:             1024,
+		PromotionTableFraction: 1,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 600; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	// The oldest table is never older than the number of tables.
+	assert.NotNil(t, c.Get([]byte("0"), nil))
+	info, ok := c.Inspect([]byte("0"))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(0), info.Generation)
+
+	assert.Panics(t, func() {
+		NewMemcache(MemcacheOptions{PromotionTableFraction: 1.5})
+	})
+}
+
+func TestMemcache_Arena(t *testing.T) {
+	const chunkSize = 64 * 1024
+	arena := NewArena(make([]byte, 4*chunkSize+100), chunkSize)
+	assert.Equal(t, int64(4*chunkSize), arena.Size())
+	c := NewMemcache(MemcacheOptions{
+		MaxValSize: 1024,
+		Arena:      arena,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	stats := c.Stats()
+	assert.Equal(t, 4, stats.Tables)
+	assert.Equal(t, arena.Size(), stats.TableMem)
+	assert.Equal(t, 0, len(arena.free))
+	assert.False(t, hasString(c, "0"))
+	assert.True(t, hasString(c, "999"))
+
+	// Discarded tables return their chunk to the arena.
+	c.lock.Lock()
+	c.discardTable(c.tables.Back())
+	c.lock.Unlock()
+	assert.Equal(t, 1, len(arena.free))
+	assert.NoError(t, c.Put([]byte("foo"), val))
+	assert.True(t, hasString(c, "foo"))
+
+	assert.Panics(t, func() {
+		NewMemcache(MemcacheOptions{
+			TableSize: 2 * chunkSize,
+			Arena:     NewArena(make([]byte, 4*chunkSize), chunkSize),
+		})
+	})
+	assert.Panics(t, func() {
+		NewMemcache(MemcacheOptions{
+			Arena: NewArena(make([]byte, chunkSize-1), chunkSize),
+		})
+	})
+}
+
+func TestMemcache_MapPool(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:      64 * 1024,
+		MaxValSize:     1024,
+		MemoryFunction: ConstantMemory(4 * 64 * 1024),
+		MapPoolTables:  2,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	assert.Equal(t, 4, c.tables.Len())
+	bufs := make(map[*byte]bool)
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		bufs[&e.Value.(*DiscardableTable).buf[0]] = true
+	}
+
+	// Only 2 discarded tables are kept in the pool.
+	for i := 0; i < 3; i++ {
+		c.discardTable(c.tables.Back())
+	}
+	assert.Equal(t, 2, len(c.mapPool.free))
+	for _, buf := range c.mapPool.free {
+		assert.True(t, bufs[&buf[0]])
+	}
+
+	// New tables reuse pooled mappings.
+	c.createTable(c.tableSize)
+	assert.Equal(t, 1, len(c.mapPool.free))
+	assert.True(t, bufs[&c.tables.Front().Value.(*DiscardableTable).buf[0]])
+
+	// The pool drains when it isn't being used.
+	assert.NoError(t, c.mapPool.trim())
+	assert.Equal(t, 1, len(c.mapPool.free))
+	assert.NoError(t, c.mapPool.trim())
+	assert.Equal(t, 0, len(c.mapPool.free))
+}
+
+func TestMemcache_PutBatch(t *testing.T) {
+	newCache := func() *Memcache {
+		return NewMemcache(MemcacheOptions{
+			TableSize:  64 * 1024,
+			MaxValSize: 48 * 1024,
+		})
+	}
+
+	// Small values followed by large ones, which can't fill the gaps left in
+	// the earlier tables when stored in order.
+	var keys, vals [][]byte
+	for i := 0; i < 9; i++ {
+		size := 20000
+		if i >= 6 {
+			size = 44000
+		}
+		keys = append(keys, []byte(fmt.Sprint(i)))
+		vals = append(vals, bytes.Repeat([]byte{byte(i)}, size))
+	}
+
+	seq := newCache()
+	for i := range keys {
+		assert.NoError(t, seq.Put(keys[i], vals[i]))
+	}
+	batch := newCache()
+	assert.NoError(t, batch.PutBatch(keys, vals))
+	for i := range keys {
+		assert.Equal(t, vals[i], batch.Get(keys[i], nil))
+	}
+	// Storing the largest entries first packs them into fewer tables.
+	assert.Less(t, batch.Stats().Tables, seq.Stats().Tables)
+
+	// The last value of a duplicate key wins.
+	assert.NoError(t, batch.PutBatch(
+		[][]byte{[]byte("foo"), []byte("foo")},
+		[][]byte{[]byte("a longer value"), []byte("bar")}))
+	assert.Equal(t, []byte("bar"), batch.Get([]byte("foo"), nil))
+
+	err := batch.PutBatch(
+		[][]byte{[]byte("big"), []byte("small")},
+		[][]byte{make([]byte, 64*1024), []byte("baz")})
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Equal(t, []byte("baz"), batch.Get([]byte("small"), nil))
+}
+
+func TestMemcache_WasCached(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:          64 * 1024,
+		MaxValSize:         1024,
+		MemoryFunction:     ConstantMemory(2 * 64 * 1024),
+		SeenKeysFilterBits: 64 * 1024,
+	})
+	defer c.Close()
+	assert.True(t, c.TracksSeenKeys())
+
+	val := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	// Evicted keys were cached.
+	assert.False(t, hasString(c, "0"))
+	assert.True(t, c.WasCached([]byte("0")))
+	assert.True(t, c.WasCached([]byte("999")))
+
+	falsePositives := 0
+	for i := 1000; i < 2000; i++ {
+		if c.WasCached([]byte(fmt.Sprint(i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 10)
+
+	c = NewMemcache(MemcacheOptions{})
+	defer c.Close()
+	putString(c, "foo", "bar")
+	assert.False(t, c.TracksSeenKeys())
+	assert.False(t, c.WasCached([]byte("foo")))
+}
+
+func TestMemcache_Loader(t *testing.T) {
+	var loads []string
+	c := NewMemcache(MemcacheOptions{
+		Loader: func(key []byte) ([]byte, bool) {
+			loads = append(loads, string(key))
+			if string(key) == "missing" {
+				return nil, false
+			}
+			return append([]byte("loaded-"), key...), true
+		},
+	})
+	defer c.Close()
+
+	putString(c, "foo", "bar")
+	assert.Equal(t, "bar", getString(c, "foo"))
+	assert.Empty(t, loads)
+
+	// Loaded values are stored, so only the first miss calls the loader.
+	assert.Equal(t, "loaded-baz", getString(c, "baz"))
+	assert.Equal(t, "loaded-baz", getString(c, "baz"))
+	assert.True(t, hasString(c, "baz"))
+	assert.Equal(t, []string{"baz"}, loads)
+
+	assert.Nil(t, c.Get([]byte("missing"), nil))
+	assert.False(t, hasString(c, "missing"))
+	assert.Equal(t, []string{"baz", "missing"}, loads)
+}
+
+func TestMemcache_SingleFlightGets(t *testing.T) {
+	var loads sync.Map
+	release := make(chan struct{})
+	c := NewMemcache(MemcacheOptions{
+		Loader: func(key []byte) ([]byte, bool) {
+			count, _ := loads.LoadOrStore(string(key), new(int32))
+			*count.(*int32)++
+			<-release
+			return []byte("val"), true
+		},
+		SingleFlightGets: true,
+	})
+	defer c.Close()
+
+	const numGets = 10
+	var wg sync.WaitGroup
+	results := make([][]byte, numGets)
+	for i := 0; i < numGets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.Get([]byte("foo"), nil)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for _, val := range results {
+		assert.Equal(t, []byte("val"), val)
+	}
+	count, _ := loads.Load("foo")
+	assert.Equal(t, int32(1), *count.(*int32))
+}
+
+func TestMemcache_SingleFlightPromotion(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:        64 * 1024,
+		MaxValSize:       1024,
+		SingleFlightGets: true,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	rand.Read(val)
+	for i := 0; i < 600; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+
+	// Concurrent Gets of an old key all return its value, and it's promoted.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := []byte("prefix")
+			assert.Equal(t, append([]byte("prefix"), val...), c.Get([]byte("0"), buf))
+		}()
+	}
+	wg.Wait()
+	info, ok := c.Inspect([]byte("0"))
+	assert.True(t, ok)
+	assert.NotEqual(t, uint64(0), info.Generation)
+}
+
+func TestMemcache_PutMiss(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	putString(c, "foo", "11")
+	assert.NoError(t, c.PutMiss([]byte("foo"), time.Second))
+	assert.NoError(t, c.PutMiss([]byte("bar"), time.Minute))
+	assert.False(t, hasString(c, "foo"))
+	val, miss := c.GetOrMiss([]byte("foo"), nil)
+	assert.Nil(t, val)
+	assert.True(t, miss)
+	_, miss = c.GetOrMiss([]byte("baz"), nil)
+	assert.False(t, miss)
+
+	// Misses expire.
+	now = now.Add(2 * time.Second)
+	_, miss = c.GetOrMiss([]byte("foo"), nil)
+	assert.False(t, miss)
+	_, miss = c.GetOrMiss([]byte("bar"), nil)
+	assert.True(t, miss)
+	c.lock.Lock()
+	assert.Equal(t, 1, c.sweepMisses())
+	c.lock.Unlock()
+
+	// Storing a value clears the miss.
+	putString(c, "bar", "22")
+	val, miss = c.GetOrMiss([]byte("bar"), nil)
+	assert.Equal(t, []byte("22"), val)
+	assert.False(t, miss)
+	assert.Empty(t, c.misses)
+}
+
+func TestMemcache_LoaderMissTTL(t *testing.T) {
+	loads := 0
+	c := NewMemcache(MemcacheOptions{
+		Loader: func(key []byte) ([]byte, bool) {
+			loads++
+			return nil, false
+		},
+		MissTTL: time.Minute,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	// The miss is cached, so the loader is only called again once it expires.
+	assert.Nil(t, c.Get([]byte("foo"), nil))
+	assert.Nil(t, c.Get([]byte("foo"), nil))
+	_, miss := c.GetOrMiss([]byte("foo"), nil)
+	assert.True(t, miss)
+	assert.Equal(t, 1, loads)
+
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, c.Get([]byte("foo"), nil))
+	assert.Equal(t, 2, loads)
+}
+
+func TestMemcache_KeyFrequency(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		FrequencySketchCounters: 1024,
+	})
+	defer c.Close()
+	assert.True(t, c.TracksFrequencies())
+
+	putString(c, "foo", "11")
+	putString(c, "bar", "22")
+	freq, ok := c.KeyFrequency([]byte("foo"))
+	assert.True(t, ok)
+	assert.Equal(t, 0, freq)
+	for i := 0; i < 10; i++ {
+		getString(c, "foo")
+	}
+	getString(c, "bar")
+	freq, _ = c.KeyFrequency([]byte("foo"))
+	assert.Equal(t, 10, freq)
+	freq, _ = c.KeyFrequency([]byte("bar"))
+	assert.Equal(t, 1, freq)
+	_, ok = c.KeyFrequency([]byte("baz"))
+	assert.False(t, ok)
+
+	// Estimates saturate, and decay.
+	for i := 0; i < 1000; i++ {
+		getString(c, "foo")
+	}
+	freq, _ = c.KeyFrequency([]byte("foo"))
+	assert.Equal(t, 255, freq)
+	for i := 0; i < 4; i++ {
+		c.freqs.decay()
+	}
+	freq, _ = c.KeyFrequency([]byte("foo"))
+	assert.Equal(t, 63, freq)
+
+	c = NewMemcache(MemcacheOptions{})
+	defer c.Close()
+	putString(c, "foo", "bar")
+	getString(c, "foo")
+	assert.False(t, c.TracksFrequencies())
+	_, ok = c.KeyFrequency([]byte("foo"))
+	assert.False(t, ok)
+}
+
+func TestMemcache_Stat(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	_, ok := c.Stat([]byte("foo"))
+	assert.False(t, ok)
+	putString(c, "foo", "hello")
+	size, ok := c.Stat([]byte("foo"))
+	assert.True(t, ok)
+	assert.Equal(t, 5, size)
+
+	assert.NoError(t, c.PutWithTTL([]byte("bar"), []byte("1"), time.Second))
+	now = now.Add(2 * time.Second)
+	_, ok = c.Stat([]byte("bar"))
+	assert.False(t, ok)
+}
+
+func TestMemcache_GetSetRange(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 16,
+	})
+	defer c.Close()
+	now := time.Unix(1000, 0)
+	c.nowFunc = func() time.Time { return now }
+
+	_, ok := c.GetRange([]byte("foo"), 0, -1, nil)
+	assert.False(t, ok)
+	assert.NoError(t, c.PutWithTTL([]byte("foo"), []byte("Hello World"), time.Minute))
+	for _, tc := range []struct {
+		start, end int
+		want       string
+	}{
+		{0, 4, "Hello"}, {-5, -1, "World"}, {0, -1, "Hello World"},
+		{-100, 2, "Hel"}, {6, 100, "World"}, {5, 2, ""}, {100, 200, ""},
+	} {
+		val, ok := c.GetRange([]byte("foo"), tc.start, tc.end, nil)
+		assert.True(t, ok)
+		assert.Equal(t, []byte(tc.want), val, "%d %d", tc.start, tc.end)
+	}
+
+	n, err := c.SetRange([]byte("foo"), 6, []byte("Dory"))
+	assert.NoError(t, err)
+	assert.Equal(t, 11, n)
+	assert.Equal(t, []byte("Hello Doryd"), c.Get([]byte("foo"), nil))
+	// The TTL is kept.
+	c.Atomically(func(tx *Txn) {
+		assert.Equal(t, time.Minute, tx.TTL([]byte("foo")))
+	})
+
+	// Missing keys are zero padded.
+	n, err = c.SetRange([]byte("bar"), 2, []byte("ab"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []byte("\x00\x00ab"), c.Get([]byte("bar"), nil))
+
+	n, err = c.SetRange([]byte("baz"), 0, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, hasString(c, "baz"))
+
+	n, err = c.SetRange([]byte("foo"), 10, []byte("toolong"))
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Equal(t, 11, n)
+	assert.Equal(t, []byte("Hello Doryd"), c.Get([]byte("foo"), nil))
+	_, err = c.SetRange([]byte("foo"), -1, []byte("a"))
+	assert.Equal(t, ErrOutOfRange, err)
+}
+
+func TestMemcache_EvictionSamples(t *testing.T) {
+	for _, samples := range []int{0, 4} {
+		c := NewMemcache(MemcacheOptions{
+			TableSize:        64 * 1024,
+			MaxValSize:       1024,
+			MemoryFunction:   ConstantMemory(4 * 64 * 1024),
+			DisablePromotion: true,
+			EvictionSamples:  samples,
+		})
+		defer c.Close()
+
+		val := make([]byte, 1000)
+		i := 0
+		for ; c.Stats().Tables < 4; i++ {
+			assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+		}
+		// Read a key in the oldest table.
+		for j := 0; j < 10; j++ {
+			assert.NotNil(t, c.Get([]byte("0"), nil))
+		}
+		// Fill the newest table, and create another, evicting a table.
+		for start := i; i < 2*start; i++ {
+			assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+		}
+		assert.Equal(t, 4, c.Stats().Tables)
+		// With sampling, a table which hasn't been read is evicted instead.
+		assert.Equal(t, samples > 0, hasString(c, "0"))
+	}
+}
+
+func TestMemcache_MmapFailure(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	tables := c.Stats().Tables
+	assert.True(t, tables > 1)
+
+	mmapFunc = func(int, bool) ([]byte, error) {
+		return nil, syscall.ENOMEM
+	}
+	defer func() { mmapFunc = mmap }()
+
+	// Instead of panicking, the oldest tables are recycled.
+	for i := 200; i < 400; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	assert.Equal(t, tables, c.Stats().Tables)
+	assert.False(t, hasString(c, "0"))
+	assert.True(t, hasString(c, "399"))
+}
+
+func TestMemcache_ConcurrentAccess(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			val := make([]byte, 100)
+			for i := 0; i < 10000; i++ {
+				key := []byte(fmt.Sprint(i % 1000))
+				switch (g + i) % 4 {
+				case 0:
+					c.Put(key, val)
+				case 1:
+					c.PutWithTTL(key, val, time.Nanosecond)
+				case 2:
+					c.Has(key)
+				default:
+					if v := c.Get(key, nil); v != nil {
+						assert.Equal(t, val, v)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestMemcache_Replication(t *testing.T) {
+	opts := MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	}
+	primary := NewMemcache(opts)
+	defer primary.Close()
+	replica := NewMemcache(opts)
+	defer replica.Close()
+	putString(replica, "stale", "00")
+	putString(primary, "foo", "11")
+	putString(primary, "bar", "22")
+	assert.NoError(t, primary.PutWithTTL([]byte("ttl"), []byte("55"), time.Minute))
+
+	pr, pw := io.Pipe()
+	subErr := make(chan error, 1)
+	go func() {
+		subErr <- primary.Subscribe(pw)
+	}()
+	go replica.Replay(pr)
+
+	// Snapshot. Keys with a TTL are sent last.
+	assert.Eventually(t, func() bool { return hasString(replica, "ttl") },
+		time.Second, time.Millisecond)
+	assert.True(t, hasString(replica, "foo"))
+	assert.True(t, hasString(replica, "bar"))
+	assert.False(t, hasString(replica, "stale"))
+	// Snapshotted keys keep their TTL.
+	replica.lock.Lock()
+	assert.NotEqual(t, time.Duration(0), replica.ttl([]byte("ttl")))
+	replica.lock.Unlock()
+
+	// Live operations.
+	putString(primary, "baz", "33")
+	primary.Delete([]byte("foo"))
+	assert.Eventually(t, func() bool { return !hasString(replica, "foo") },
+		time.Second, time.Millisecond)
+	assert.Equal(t, []byte("33"), replica.Get([]byte("baz"), nil))
+
+	pr.Close()
+	putString(primary, "qux", "44")
+	assert.Equal(t, io.ErrClosedPipe, <-subErr)
+}
+
+func TestMemcache_ReplicationOverflow(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	pr, pw := io.Pipe()
+	subErr := make(chan error, 1)
+	go func() {
+		subErr <- c.Subscribe(pw)
+	}()
+	// Read the initial reset op, so that the subscriber is registered, but
+	// nothing after that.
+	var header [feedHeaderLen]byte
+	_, err := io.ReadFull(pr, header[:])
+	assert.NoError(t, err)
+
+	// The subscriber buffers some operations before blocking on the pipe, so
+	// put more than the queue length.
+	for i := 0; i < 2*subscriberQueueLen; i++ {
+		putString(c, "foo", "11")
+	}
+	// Let the subscriber drain into the pipe, and notice the overflow.
+	go io.Copy(io.Discard, pr)
+	assert.Equal(t, ErrSubscriberOverflow, <-subErr)
+}
+
+func TestMemcache_OnEvict(t *testing.T) {
+	evicted := make(map[string]bool)
+	c := NewMemcache(MemcacheOptions{
+		MemoryFunction: ConstantMemory(2 * 64 * 1024),
+		TableSize:      64 * 1024,
+		MaxValSize:     1024,
+		OnEvict: func(key []byte) {
+			evicted[string(key)] = true
+		},
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	c.Delete([]byte("199"))
+	assert.NotEmpty(t, evicted)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprint(i)
+		// Every key is either still in the cache, evicted, or deleted.
+		assert.True(t, hasString(c, key) != evicted[key] || key == "199", key)
+	}
+	assert.False(t, evicted["199"])
+}
+
+func TestMemcache_ChunkedValues(t *testing.T) {
+	evicted := make(map[string]int)
+	c := NewMemcache(MemcacheOptions{
+		MemoryFunction:    ConstantMemory(4 * 64 * 1024),
+		TableSize:         64 * 1024,
+		MaxKeySize:        64,
+		MaxValSize:        1024,
+		MaxChunkedValSize: 20000,
+		OnEvict: func(key []byte) {
+			evicted[string(key)]++
+		},
+	})
+	defer c.Close()
+	assert.Equal(t, 20000, c.MaxValSize())
+
+	big := make([]byte, 5000)
+	rand.Read(big)
+	assert.NoError(t, c.Put([]byte("big"), big))
+	assert.Equal(t, big, c.Get([]byte("big"), nil))
+	assert.True(t, c.Has([]byte("big")))
+	size, ok := c.Stat([]byte("big"))
+	assert.True(t, ok)
+	assert.Equal(t, 5000, size)
+	assert.Equal(t, 5, c.Stats().Keys)
+	assert.Equal(t, ErrTooLarge, c.Put([]byte("huge"), make([]byte, 20001)))
+
+	// Replacing with a small value deletes the chunks, and vice versa.
+	putString(c, "big", "small")
+	assert.Equal(t, "small", getString(c, "big"))
+	assert.Equal(t, 1, c.Stats().Keys)
+	assert.NoError(t, c.Put([]byte("big"), big))
+	assert.Equal(t, big, c.Get([]byte("big"), nil))
+	c.Delete([]byte("big"))
+	assert.False(t, c.Has([]byte("big")))
+	assert.Equal(t, 0, c.Stats().Keys)
+
+	// Evicting any chunk drops the whole value, which is reported once.
+	assert.NoError(t, c.Put([]byte("big"), big))
+	val := make([]byte, 1000)
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	assert.Nil(t, c.Get([]byte("big"), nil))
+	assert.Equal(t, 1, evicted["big"])
+	assert.Empty(t, c.chunked)
+}
+
+func TestMemcache_WriteValueTo(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:         64 * 1024,
+		MaxKeySize:        64,
+		MaxValSize:        1024,
+		MaxChunkedValSize: 20000,
+	})
+	defer c.Close()
+
+	big := make([]byte, 5000)
+	rand.Read(big)
+	assert.NoError(t, c.Put([]byte("big"), big))
+	putString(c, "small", "value")
+
+	var buf bytes.Buffer
+	n, ok, err := c.WriteValueTo([]byte("big"), &buf)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(5000), n)
+	assert.Equal(t, big, buf.Bytes())
+
+	buf.Reset()
+	n, ok, err = c.WriteValueTo([]byte("small"), &buf)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, "value", buf.String())
+
+	n, ok, err = c.WriteValueTo([]byte("missing"), &buf)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), n)
+
+	// Replacing the value part way through is detected.
+	w := writerFunc(func(p []byte) (int, error) {
+		assert.NoError(t, c.Put([]byte("big"), big))
+		return len(p), nil
+	})
+	n, ok, err = c.WriteValueTo([]byte("big"), w)
+	assert.Equal(t, ErrValueChanged, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(c.chunkSize()), n)
+}
+
+func TestMemcache_OpenValue(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:         64 * 1024,
+		MaxKeySize:        64,
+		MaxValSize:        1024,
+		MaxChunkedValSize: 20000,
+	})
+	defer c.Close()
+
+	big := make([]byte, 5000)
+	rand.Read(big)
+	assert.NoError(t, c.Put([]byte("big"), big))
+	putString(c, "small", "value")
+
+	r, ok := c.OpenValue([]byte("big"))
+	assert.True(t, ok)
+	// Read in pieces which don't line up with the chunks.
+	got, err := io.ReadAll(iotest.HalfReader(r))
+	assert.NoError(t, err)
+	assert.Equal(t, big, got)
+	assert.NoError(t, r.Close())
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, ErrReaderClosed, err)
+
+	r, ok = c.OpenValue([]byte("small"))
+	assert.True(t, ok)
+	// The value was read when opened, so is unaffected by deletion.
+	deleteString(c, "small")
+	got, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(got))
+	r.Close()
+
+	_, ok = c.OpenValue([]byte("missing"))
+	assert.False(t, ok)
+
+	// Replacing the value part way through is detected.
+	r, ok = c.OpenValue([]byte("big"))
+	assert.True(t, ok)
+	n, err := io.ReadFull(r, make([]byte, c.chunkSize()))
+	assert.NoError(t, err)
+	assert.Equal(t, c.chunkSize(), n)
+	assert.NoError(t, c.Put([]byte("big"), big))
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, ErrValueChanged, err)
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, ErrValueChanged, err)
+	r.Close()
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestMemcache_GenerationWrap(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		MemoryFunction: ConstantMemory(4 * 64 * 1024),
+		TableSize:      64 * 1024,
+		MaxValSize:     1024,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	// Move the generations to just before the counter wraps around.
+	const offset = math.MaxUint64 - 5
+	c.lock.Lock()
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		e.Value.(*DiscardableTable).meta = e.Value.(*DiscardableTable).Meta().(uint64) + offset
+	}
+	c.count += offset
+	c.lock.Unlock()
+
+	for i := 100; i < 1000; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	c.lock.Lock()
+	assert.Less(t, c.count, uint64(100))
+	// Newest tables first.
+	prev := c.count
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		gen := e.Value.(*DiscardableTable).Meta().(uint64)
+		assert.Less(t, gen, prev)
+		prev = gen
+	}
+	c.lock.Unlock()
+	age, ok := c.KeyAge([]byte("999"))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), age)
+}
+
+func TestMemcache_PutEvicting(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		MemoryFunction: ConstantMemory(2 * 64 * 1024),
+		TableSize:      64 * 1024,
+		MaxValSize:     1024,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	evictedAt := -1
+	for i := 0; i < 200; i++ {
+		evicted, err := c.PutEvicting([]byte(fmt.Sprint(i)), val, 0)
+		assert.NoError(t, err)
+		if evicted && evictedAt < 0 {
+			evictedAt = i
+		}
+	}
+	// Two tables hold about 128 entries, so the first eviction happens once
+	// they're full.
+	assert.True(t, evictedAt > 100 && evictedAt < 140, "evicted at %d", evictedAt)
+	assert.False(t, hasString(c, "0"))
+}
+
+func TestMemcache_ReserveTables(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:     64 * 1024,
+		MaxValSize:    1024,
+		ReserveTables: 2,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	for i := 0; i < 300; i++ {
+		c.Delete([]byte(fmt.Sprint(i)))
+	}
+
+	c.lock.Lock()
+	assert.True(t, c.tables.Len() > 2)
+	c.downsizeTables()
+	assert.Equal(t, 2, c.tables.Len())
+	assert.Equal(t, int64(2*64*1024), c.tableMem)
+	c.lock.Unlock()
+
+	// The reserved tables are reused.
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	c.lock.Lock()
+	assert.Equal(t, 2, c.tables.Len())
+	assert.Equal(t, int64(2*64*1024), c.tableMem)
+	c.lock.Unlock()
+}
+
+func TestMemcache_Close(t *testing.T) {
+	before := runtime.NumGoroutine()
+	c := NewMemcache(MemcacheOptions{
+		TableSize:     64 * 1024,
+		MaxValSize:    1024,
+		ScrubInterval: time.Hour,
+	})
+	assert.Equal(t, before+2, runtime.NumGoroutine())
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	assert.True(t, c.Stats().TableMem > 0)
+
+	c.Close()
+	assert.Equal(t, before, runtime.NumGoroutine())
+	assert.Equal(t, int64(0), c.Stats().TableMem)
+	// Closing again is a no-op.
+	c.Close()
+}
+
+func TestSelfTest(t *testing.T) {
+	assert.NoError(t, SelfTest(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	}))
+	assert.NoError(t, SelfTest(MemcacheOptions{
+		TableSize:     64 * 1024,
+		MaxValSize:    100,
+		ZeroOnDiscard: true,
+		MapPoolTables: 1,
+	}))
+}
+
+func TestMemcache_Scrub(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+
+	c.lock.Lock()
+	numTables := c.tables.Len()
+	assert.True(t, numTables > 2)
+	// Corrupt the value size of the first entry in the oldest table.
+	oldest := c.tables.Back().Value.(*DiscardableTable)
+	oldest.buf[7] = 0x7f
+	c.lock.Unlock()
+
+	corrupt := 0
+	for i := 0; i < numTables; i++ {
+		if c.scrubNextTable() {
+			corrupt++
+		}
+	}
+	assert.Equal(t, 1, corrupt)
+	assert.False(t, c.Has([]byte("0")))
+	assert.True(t, c.Has([]byte("199")))
+
+	c.lock.Lock()
+	assert.Equal(t, numTables-1, c.tables.Len())
+	c.lock.Unlock()
+
+	// The scrubber wraps around, and finds no more corrupt tables.
+	for i := 0; i < 2*numTables; i++ {
+		assert.False(t, c.scrubNextTable())
+	}
+}
+
+func TestMemcache_AddReplace(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	stored, err := c.Replace([]byte("foo"), []byte("bar"), 0)
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	assert.False(t, hasString(c, "foo"))
+
+	stored, err = c.Add([]byte("foo"), []byte("bar"), 0)
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	stored, err = c.Add([]byte("foo"), []byte("baz"), 0)
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	assert.Equal(t, []byte("bar"), c.Get([]byte("foo"), nil))
+
+	stored, err = c.Replace([]byte("foo"), []byte("baz"), 0)
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	assert.Equal(t, []byte("baz"), c.Get([]byte("foo"), nil))
+
+	_, err = c.Add([]byte("big"), make([]byte, 2000), 0)
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestMemcache_Cas(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	_, _, found := c.GetWithCas([]byte("foo"), nil)
+	assert.False(t, found)
+	stored, err := c.PutWithCas([]byte("foo"), []byte("bar"), 0)
+	assert.NoError(t, err)
+	assert.False(t, stored)
+
+	putString(c, "foo", "bar")
+	val, cas, found := c.GetWithCas([]byte("foo"), nil)
+	assert.True(t, found)
+	assert.Equal(t, []byte("bar"), val)
+	assert.NotEqual(t, uint64(0), cas)
+	_, cas2, _ := c.GetWithCas([]byte("foo"), nil)
+	assert.Equal(t, cas, cas2)
+
+	stored, err = c.PutWithCas([]byte("foo"), []byte("baz"), cas)
+	assert.NoError(t, err)
+	assert.True(t, stored)
+	// The token changed, so a second store with it fails.
+	stored, err = c.PutWithCas([]byte("foo"), []byte("qux"), cas)
+	assert.NoError(t, err)
+	assert.False(t, stored)
+	assert.Equal(t, []byte("baz"), c.Get([]byte("foo"), nil))
+
+	// Storing the same value again also changes the token, including after
+	// the table is compacted.
+	_, cas, _ = c.GetWithCas([]byte("foo"), nil)
+	putString(c, "foo", "baz")
+	c.RunGC()
+	_, cas2, _ = c.GetWithCas([]byte("foo"), nil)
+	assert.NotEqual(t, cas, cas2)
+}
+
+func TestMemcache_OverwriteInPlace(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+
+	deletedSpace := func() int {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		space := 0
+		for _, info := range c.tableInfos() {
+			space += info.DeletedSpace
+		}
+		return space
+	}
+
+	// Same size values in the newest table are overwritten in place.
+	putString(c, "bar", "11")
+	for i := 0; i < 100; i++ {
+		putString(c, "foo", fmt.Sprintf("%04d", i))
+	}
+	assert.Equal(t, "0099", getString(c, "foo"))
+	assert.Equal(t, 0, deletedSpace())
+	putString(c, "foo", "12345")
+	assert.NotEqual(t, 0, deletedSpace())
+
+	// Keys in older tables aren't.
+	val := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	c.lock.Lock()
+	ft, _ := c.find([]byte("foo"), c.hashFunc([]byte("foo")))
+	assert.False(t, c.isNewestTable(ft))
+	off := ft.EntryOffset([]byte("foo"))
+	c.lock.Unlock()
+	putString(c, "foo", "67890")
+	assert.Equal(t, "67890", getString(c, "foo"))
+	c.lock.Lock()
+	assert.NotEqual(t, off, ft.EntryOffset([]byte("foo")))
+	c.lock.Unlock()
+}
+
+func TestMemcache_CasContention(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:  64 * 1024,
+		MaxValSize: 1024,
+	})
+	defer c.Close()
+	putString(c, "counter", "0")
+
+	const workers = 8
+	const increments = 200
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				val, cas, found := c.GetWithCas([]byte("counter"), nil)
+				if !assert.True(t, found) {
+					return
+				}
+				count, _ := strconv.Atoi(string(val))
+				stored, err := c.PutWithCas([]byte("counter"), []byte(strconv.Itoa(count+1)), cas)
+				assert.NoError(t, err)
+				if stored {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []byte(strconv.Itoa(workers*increments)), c.Get([]byte("counter"), nil))
+}
+
+func TestMemcache_SoftLimit(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		MemoryFunction:    ConstantMemory(4 * 64 * 1024),
+		TableSize:         64 * 1024,
+		MaxValSize:        1024,
+		SoftLimitFraction: 0.5,
+	})
+	defer c.Close()
+
+	val := make([]byte, 1000)
+	var err error
+	i := 0
+	for ; i < 1000 && err == nil; i++ {
+		err = c.Put([]byte(fmt.Sprint(i)), val)
+	}
+	assert.Equal(t, ErrSoftLimit, err)
+	assert.False(t, hasString(c, fmt.Sprint(i-1)))
+	c.lock.Lock()
+	assert.Equal(t, int64(2*64*1024), c.tableMem)
+	c.lock.Unlock()
+
+	// Nothing was evicted, and existing keys can still be overwritten.
+	for j := 0; j < i-1; j++ {
+		assert.True(t, hasString(c, fmt.Sprint(j)))
+	}
+	for j := 0; j < 10; j++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(j)), val))
+		assert.True(t, hasString(c, fmt.Sprint(j)))
+	}
+}
+
+func TestMemcache_KeyAge(t *testing.T) {
+	c := NewMemcache(MemcacheOptions{
+		TableSize:        64 * 1024,
+		MaxValSize:       1024,
+		DisablePromotion: true,
+	})
+	defer c.Close()
+
+	_, found := c.KeyAge([]byte("0"))
+	assert.False(t, found)
+
+	val := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, c.Put([]byte(fmt.Sprint(i)), val))
+	}
+	oldAge, found := c.KeyAge([]byte("0"))
+	assert.True(t, found)
+	newAge, found := c.KeyAge([]byte("199"))
+	assert.True(t, found)
+	assert.Equal(t, uint64(1), newAge)
+	assert.True(t, oldAge > newAge)
+
+	// Rewriting the key makes it young again.
+	assert.NoError(t, c.Put([]byte("0"), val))
+	age, _ := c.KeyAge([]byte("0"))
+	assert.Equal(t, uint64(1), age)
+}
@@ -0,0 +1,75 @@
+package dory
+
+import (
+	"time"
+)
+
+// PutMiss records that the key is known to be absent, for the ttl, so that
+// callers can avoid repeatedly querying a backing store for keys which don't
+// exist. Any existing value of the key is deleted. GetOrMiss reports the key as
+// a known miss, and Get doesn't call the Loader for it, until the ttl expires
+// or a value is stored for the key. Known misses aren't replicated or dumped.
+func (c *Memcache) PutMiss(key []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	} else if len(key) > c.maxKeySize {
+		return ErrTooLarge
+	} else if ttl <= 0 {
+		panic("invalid ttl")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.delete(key)
+	c.misses[string(key)] = c.nowFunc().Add(ttl).UnixNano()
+	return nil
+}
+
+// GetOrMiss is like Get, but also returns whether a missing key is known to be
+// absent, because it was recorded by PutMiss.
+func (c *Memcache) GetOrMiss(key, buf []byte) ([]byte, bool) {
+	val := c.Get(key, buf)
+	if val != nil {
+		return val, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return nil, c.isMiss(key)
+}
+
+// Returns whether the key is recorded as a known miss which hasn't expired.
+// Only requires the read lock.
+func (c *Memcache) isMiss(key []byte) bool {
+	if len(c.misses) == 0 {
+		return false
+	}
+	deadline, ok := c.misses[string(key)]
+	return ok && c.nowFunc().UnixNano() < deadline
+}
+
+// Forgets that the key is a known miss, because it's been stored or deleted.
+func (c *Memcache) clearMiss(key []byte) {
+	if len(c.misses) > 0 {
+		delete(c.misses, string(key))
+	}
+}
+
+// Deletes known misses whose ttl has expired. At most expirySweepLimit misses
+// are examined per call. Returns the number of misses deleted.
+func (c *Memcache) sweepMisses() int {
+	now := c.nowFunc().UnixNano()
+	examined := 0
+	deleted := 0
+	for key, deadline := range c.misses {
+		if examined >= expirySweepLimit {
+			break
+		}
+		examined++
+		if now >= deadline {
+			delete(c.misses, key)
+			deleted++
+		}
+	}
+	return deleted
+}
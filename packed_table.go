@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	"github.com/dgryski/go-farm"
+	prom "github.com/prometheus/client_golang/prometheus"
 )
 
 const (
@@ -19,10 +23,38 @@ const (
 
 	// Length of the size prefix for a key/value pair.
 	prefixLen = 8
+
+	// Serialization format version, and the length of the serialized header
+	// (version byte, entry count, data length).
+	serialVersion   = 1
+	serialHeaderLen = 9
+)
+
+var (
+	tableGcs = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_table_gc_total",
+		Help: "Number of table GCs, including automatic GCs triggered by deletes.",
+	})
+	// GC usually runs with the cache lock held, so this adds directly to the
+	// latency of other operations.
+	tableGcDuration = prom.NewHistogram(prom.HistogramOpts{
+		Name:    "dory_table_gc_duration_seconds",
+		Help:    "Time taken to GC a table.",
+		Buckets: prom.ExponentialBuckets(1e-6, 4, 12),
+	})
 )
 
+func init() {
+	prom.MustRegister(tableGcs)
+	prom.MustRegister(tableGcDuration)
+}
+
 var (
 	ErrNoSpace = errors.New("insufficent space left")
+
+	ErrInvalidData = errors.New("invalid serialized table data")
+
+	ErrCorrupt = errors.New("corrupt table")
 )
 
 // PackedTable is a simple key/value table that stores key and value data
@@ -52,6 +84,12 @@ type PackedTable struct {
 	added        int
 	deleted      int
 	deletedSpace int
+
+	// Incremented whenever entries are moved or erased by GC or Reset, or a
+	// value is overwritten in place. Otherwise, entries are only ever appended
+	// within an epoch, so an entry's epoch and offset uniquely identify each
+	// store of a key.
+	epoch uint32
 }
 
 // Construct a new PackedTable using the given slice to store key/value data.
@@ -79,6 +117,7 @@ func (t *PackedTable) Reset() {
 	t.deleted = 0
 	t.deletedSpace = 0
 	t.keys = make(map[uint32]int32)
+	t.epoch++
 }
 
 func (t *PackedTable) readSize(off int) (int, int) {
@@ -144,6 +183,22 @@ func (t *PackedTable) findKey(key []byte) int {
 	return -1
 }
 
+// EntryOffset returns the offset of the key's entry in the table's slice, or
+// -1 if the key does not exist.
+func (t *PackedTable) EntryOffset(key []byte) int {
+	if len(key) == 0 {
+		panic("zero-sized key")
+	}
+
+	return t.findKey(key)
+}
+
+// Epoch returns the table's current epoch, which changes whenever GC or Reset
+// moves or erases entries, or a value is overwritten in place.
+func (t *PackedTable) Epoch() uint32 {
+	return t.epoch
+}
+
 // EntrySize returns the amount of space used in the table's slice by the given
 // key/value. May be used to determine if there is sufficient space to store
 // the key/value.
@@ -180,6 +235,83 @@ func (t *PackedTable) NumDeleted() int {
 	return t.deleted
 }
 
+// ProbeStats returns the average and maximum distance of each entry from its
+// ideal slot in the index. Long probe chains indicate clustering in the
+// index, which slows down lookups.
+func (t *PackedTable) ProbeStats() (float64, int) {
+	total := 0
+	max := 0
+	for hash, off := range t.keys {
+		if off < 0 {
+			continue
+		}
+		keySize, _ := t.readSize(int(off))
+		keyOff := int(off) + prefixLen
+		dist := int(hash - t.hashFn(t.buf[keyOff:keyOff+keySize]))
+		total += dist
+		if dist > max {
+			max = dist
+		}
+	}
+	if t.NumEntries() == 0 {
+		return 0, 0
+	}
+	return float64(total) / float64(t.NumEntries()), max
+}
+
+// Verify checks that the table's entries and index are consistent, and
+// returns an error wrapping ErrCorrupt if not. This walks every entry in the
+// table, so is slow.
+func (t *PackedTable) Verify() error {
+	live := make(map[int32]bool, t.NumEntries())
+	entries := 0
+	deleted := 0
+	deletedSpace := 0
+	for off := 0; off < t.off; {
+		if off+prefixLen > t.off {
+			return fmt.Errorf("%w: truncated entry header at %d", ErrCorrupt, off)
+		}
+		keySize, valSize := t.readSize(off)
+		isDeleted := (keySize & keySizeDeletedFlag) != 0
+		keySize &= ^keySizeFlagMask
+		entrySize := keySize + valSize + prefixLen
+		if valSize > len(t.buf) || off+entrySize > t.off {
+			return fmt.Errorf("%w: entry at %d overruns table", ErrCorrupt, off)
+		}
+		if isDeleted {
+			deleted++
+			deletedSpace += entrySize
+		} else {
+			live[int32(off)] = true
+			entries++
+		}
+		off += entrySize
+	}
+	if entries != t.NumEntries() || deleted != t.deleted || deletedSpace != t.deletedSpace {
+		return fmt.Errorf("%w: found %d entries, %d deleted (%d bytes), expected %d, %d (%d bytes)",
+			ErrCorrupt, entries, deleted, deletedSpace, t.NumEntries(), t.deleted, t.deletedSpace)
+	}
+
+	indexed := 0
+	for hash, off := range t.keys {
+		if off < 0 {
+			continue
+		} else if !live[off] {
+			return fmt.Errorf("%w: index points to invalid offset %d", ErrCorrupt, off)
+		}
+		keySize, _ := t.readSize(int(off))
+		keyOff := int(off) + prefixLen
+		if t.hashEntry(t.buf[keyOff:keyOff+keySize]) != hash {
+			return fmt.Errorf("%w: key at %d not reachable from its hash", ErrCorrupt, off)
+		}
+		indexed++
+	}
+	if indexed != entries {
+		return fmt.Errorf("%w: %d entries indexed, expected %d", ErrCorrupt, indexed, entries)
+	}
+	return nil
+}
+
 // Has returns whether or not the table contains the requested key.
 func (t *PackedTable) Has(key []byte) bool {
 	if len(key) == 0 {
@@ -233,33 +365,110 @@ func (t *PackedTable) deleteEntry(hash uint32, off int, deleteHashEntry bool) {
 // Put adds the key/value into the table, if there is sufficient free space.
 // Returns nil on success, or ErrNoSpace if there is insufficient free space.
 // If the table already contains the key, the existing key/value will be
-// deleted (as if Delete() was called), and the new entry inserted.
+// deleted (as if Delete() was called), and the new entry inserted. As an
+// exception, a value of the same size as the existing value is overwritten in
+// place, which always succeeds and doesn't need any free space.
 func (t *PackedTable) Put(key, val []byte) error {
 	if len(key) == 0 {
 		panic("zero-sized key")
 	}
 
+	hash := t.hashEntry(key)
+	off, ok := t.keys[hash]
+	if ok && off >= 0 && t.overwriteEntry(int(off), val) {
+		return nil
+	}
+
 	size := t.EntrySize(key, val)
 	if size > t.FreeSpace() {
 		return ErrNoSpace
 	}
+	if ok && off >= 0 {
+		t.deleteEntry(hash, int(off), false)
+	}
 
+	return t.insertEntry(hash, key, val)
+}
+
+// PutReturning is the same as Put, but also returns a copy of the previous
+// value for the key (appended to buf), or nil if the key did not exist. Like
+// Put, a value of the same size is overwritten in place. If there is
+// insufficient free space, ErrNoSpace is returned and the existing entry is
+// left untouched.
+func (t *PackedTable) PutReturning(key, val, buf []byte) ([]byte, error) {
+	if len(key) == 0 {
+		panic("zero-sized key")
+	}
+
+	var old []byte
 	hash := t.hashEntry(key)
-	if off, ok := t.keys[hash]; ok && off >= 0 {
+	off, ok := t.keys[hash]
+	if ok && off >= 0 {
+		// Copy before overwriting or deleting, since deleting may trigger a GC
+		// which moves entries around.
+		keySize, valSize := t.readSize(int(off))
+		valOff := int(off) + prefixLen + keySize
+		old = append(buf, t.buf[valOff:valOff+valSize]...)
+		if old == nil {
+			// Distinguish an empty previous value from a missing one.
+			old = []byte{}
+		}
+		if t.overwriteEntry(int(off), val) {
+			return old, nil
+		}
+	}
+
+	size := t.EntrySize(key, val)
+	if size > t.FreeSpace() {
+		return nil, ErrNoSpace
+	}
+	if ok && off >= 0 {
 		t.deleteEntry(hash, int(off), false)
 	}
 
-	off := t.writeSize(len(key), len(val))
-	n := copy(t.buf[t.off:], key)
-	t.off += n
-	if n != len(key) {
-		panic("n != len(key)")
+	err := t.insertEntry(hash, key, val)
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// Overwrite replaces the key's value in place, if the key exists and val is
+// the same size as its current value, which needs no free space and leaves no
+// deleted space behind. Returns whether the value was overwritten.
+func (t *PackedTable) Overwrite(key, val []byte) bool {
+	if len(key) == 0 {
+		panic("zero-sized key")
+	}
+
+	off := t.findKey(key)
+	return off >= 0 && t.overwriteEntry(off, val)
+}
+
+// Overwrites the value of the entry at |off| with val, if it's the same size.
+// Returns whether the value was overwritten.
+func (t *PackedTable) overwriteEntry(off int, val []byte) bool {
+	keySize, valSize := t.readSize(off)
+	if valSize != len(val) {
+		return false
 	}
-	n = copy(t.buf[t.off:], val)
-	t.off += n
-	if n != len(val) {
-		panic("n != len(val)")
+	valOff := off + prefixLen + keySize
+	copy(t.buf[valOff:valOff+valSize], val)
+	// The entry hasn't moved, but is a new store of the key.
+	t.epoch++
+	return true
+}
+
+func (t *PackedTable) insertEntry(hash uint32, key, val []byte) error {
+	// Callers check for sufficient space, but a bad size check shouldn't
+	// corrupt the table.
+	if t.EntrySize(key, val) > t.FreeSpace() {
+		return ErrNoSpace
 	}
+
+	off := t.writeSize(len(key), len(val))
+	t.off += copy(t.buf[t.off:], key)
+	t.off += copy(t.buf[t.off:], val)
 	t.keys[hash] = int32(off)
 	t.added++
 	return nil
@@ -310,6 +519,11 @@ func (t *PackedTable) GC() {
 		// No deleted entries => no GC needed.
 		return
 	}
+	start := time.Now()
+	defer func() {
+		tableGcs.Inc()
+		tableGcDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	oldLen := t.off
 
@@ -321,6 +535,7 @@ func (t *PackedTable) GC() {
 	t.added = 0
 	t.deleted = 0
 	t.deletedSpace = 0
+	t.epoch++
 	for off := 0; off < oldLen; {
 		keySize, valSize := t.readSize(off)
 		entrySize := (keySize & ^keySizeFlagMask) + valSize + prefixLen
@@ -335,3 +550,127 @@ func (t *PackedTable) GC() {
 		off += entrySize
 	}
 }
+
+// Clone returns a compacted copy of the table, backed by a newly allocated
+// buffer of the same size. The clone shares no memory with the original, so
+// either may be modified or discarded independently.
+func (t *PackedTable) Clone() *PackedTable {
+	c := NewPackedTable(make([]byte, len(t.buf)), t.autoGcThreshold)
+	c.hashFn = t.hashFn
+	for off := 0; off < t.off; {
+		keySize, valSize := t.readSize(off)
+		entrySize := (keySize & ^keySizeFlagMask) + valSize + prefixLen
+		if (keySize & keySizeDeletedFlag) == 0 {
+			key := t.buf[off+prefixLen : off+prefixLen+keySize]
+			hash := c.hashEntry(key)
+			copy(c.buf[c.off:], t.buf[off:off+entrySize])
+			c.keys[hash] = int32(c.off)
+			c.off += entrySize
+			c.added++
+		}
+		off += entrySize
+	}
+	return c
+}
+
+// WriteTo writes the live entries in the table to w, in a format which can be
+// read back using ReadPackedTable. Deleted entries are skipped. Returns the
+// number of bytes written.
+func (t *PackedTable) WriteTo(w io.Writer) (int64, error) {
+	var header [serialHeaderLen]byte
+	header[0] = serialVersion
+	binary.LittleEndian.PutUint32(header[1:], uint32(t.NumEntries()))
+	binary.LittleEndian.PutUint32(header[5:], uint32(t.LiveSpace()))
+	n, err := w.Write(header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	written, err := t.writeEntries(w, nil)
+	return int64(n) + written, err
+}
+
+// writeEntries writes the live entries in the table to w, each as a key size,
+// value size, key, and value (i.e. the same format as entries in the buffer).
+// Entries whose key |skip| returns true for are left out, if skip is non-nil.
+func (t *PackedTable) writeEntries(w io.Writer, skip func(key []byte) bool) (int64, error) {
+	var written int64
+	// Entries are already stored contiguously in the serialized format, so
+	// write out runs of live entries in one go.
+	runStart := 0
+	for off := 0; off < t.off; {
+		keySize, valSize := t.readSize(off)
+		entrySize := (keySize & ^keySizeFlagMask) + valSize + prefixLen
+		if (keySize&keySizeDeletedFlag) != 0 ||
+			(skip != nil && skip(t.buf[off+prefixLen:off+prefixLen+keySize])) {
+			if runStart < off {
+				n, err := w.Write(t.buf[runStart:off])
+				written += int64(n)
+				if err != nil {
+					return written, err
+				}
+			}
+			runStart = off + entrySize
+		}
+		off += entrySize
+	}
+	if runStart < t.off {
+		n, err := w.Write(t.buf[runStart:t.off])
+		written += int64(n)
+		return written, err
+	}
+	return written, nil
+}
+
+// ReadPackedTable reads a table previously written using WriteTo, using buf
+// to store key/value data. Returns ErrNoSpace if buf is too small to hold the
+// data, or ErrInvalidData if the data is malformed. Automatic GC is disabled
+// on the returned table.
+func ReadPackedTable(r io.Reader, buf []byte) (*PackedTable, error) {
+	var header [serialHeaderLen]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != serialVersion {
+		return nil, ErrInvalidData
+	}
+	count := int(binary.LittleEndian.Uint32(header[1:]))
+	dataLen := int(binary.LittleEndian.Uint32(header[5:]))
+	if dataLen > len(buf) {
+		return nil, ErrNoSpace
+	}
+
+	t := NewPackedTable(buf, 0)
+	_, err = io.ReadFull(r, buf[:dataLen])
+	if err != nil {
+		return nil, err
+	}
+
+	for t.off < dataLen {
+		if t.off+prefixLen > dataLen {
+			return nil, ErrInvalidData
+		}
+		keySize, valSize := t.readSize(t.off)
+		if keySize == 0 || (keySize&keySizeFlagMask) != 0 || (valSize&keySizeFlagMask) != 0 {
+			return nil, ErrInvalidData
+		}
+		entrySize := keySize + valSize + prefixLen
+		if t.off+entrySize > dataLen {
+			return nil, ErrInvalidData
+		}
+
+		key := t.buf[t.off+prefixLen : t.off+prefixLen+keySize]
+		hash := t.hashEntry(key)
+		if _, ok := t.keys[hash]; ok {
+			// Duplicate key.
+			return nil, ErrInvalidData
+		}
+		t.keys[hash] = int32(t.off)
+		t.off += entrySize
+		t.added++
+	}
+	if t.added != count {
+		return nil, ErrInvalidData
+	}
+	return t, nil
+}
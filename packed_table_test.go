@@ -2,8 +2,12 @@ package dory
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"math/rand"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const (
@@ -174,12 +178,67 @@ func TestPackedTableOverwrite(t *testing.T) {
 	}
 }
 
+func TestPackedTablePutReturning(t *testing.T) {
+	key := []byte("foo")
+	val1 := []byte("hello")
+	val2 := []byte("world")
+
+	buffer := NewPackedTable(make([]byte, bufferSize), 0)
+	old, err := buffer.PutReturning(key, val1, nil)
+	if err != nil {
+		t.Errorf("Unexpected put error %v", err)
+	}
+	if old != nil {
+		t.Errorf("Unexpected old value %s", string(old))
+	}
+	old, err = buffer.PutReturning(key, val2, []byte("x"))
+	if err != nil {
+		t.Errorf("Unexpected put error %v", err)
+	}
+	if !bytes.Equal(old, []byte("xhello")) {
+		t.Errorf("Unexpected old value %s", string(old))
+	}
+	buf := buffer.Get(key)
+	if !bytes.Equal(buf, val2) {
+		t.Errorf("Unexpected get result %s", string(buf))
+	}
+	// The same size value was overwritten in place.
+	if buffer.NumEntries() != 1 || buffer.NumDeleted() != 0 {
+		t.Errorf("Unexpected stats")
+	}
+
+	old, err = buffer.PutReturning(key, []byte("longer"), nil)
+	if err != nil {
+		t.Errorf("Unexpected put error %v", err)
+	}
+	if !bytes.Equal(old, val2) {
+		t.Errorf("Unexpected old value %s", string(old))
+	}
+	if buffer.NumEntries() != 1 || buffer.NumDeleted() != 1 {
+		t.Errorf("Unexpected stats")
+	}
+
+	old, err = buffer.PutReturning(key, make([]byte, bufferSize), nil)
+	if err != ErrNoSpace {
+		t.Errorf("Unexpected put error %v", err)
+	}
+	if old != nil {
+		t.Errorf("Unexpected old value %s", string(old))
+	}
+	buf = buffer.Get(key)
+	if !bytes.Equal(buf, []byte("longer")) {
+		t.Errorf("Unexpected get result %s", string(buf))
+	}
+}
+
 func TestPackedTableOverwriteGC(t *testing.T) {
 	key := []byte("dkjfhkdjdfhd")
-	val := []byte("dfjhgkfdjghkfdj hkdfjhdfkjhgfdkhdfk")
+	vals := [][]byte{[]byte("dfjhgkfdjghkfdj hkdfjhdfkjhgfdkhdfk"), []byte("dfjhgkfdjghkfdj")}
 
 	buffer := NewPackedTable(make([]byte, bufferSize), 0)
 	for i := 0; i < 1000000; i++ {
+		// Alternate value sizes, since same-size values are overwritten in place.
+		val := vals[i%2]
 		// Without GC, this will fail after a while.
 		if err := buffer.Put(key, val); err != nil {
 			t.Fatalf("Unexpected put error %v", err)
@@ -194,10 +253,12 @@ func TestPackedTableOverwriteGC(t *testing.T) {
 
 func TestPackedTableOverwriteAutoGC(t *testing.T) {
 	key := []byte("dkjfhkdjdfhd")
-	val := []byte("dfjhgkfdjghkfdj hkdfjhdfkjhgfdkhdfk")
+	vals := [][]byte{[]byte("dfjhgkfdjghkfdj hkdfjhdfkjhgfdkhdfk"), []byte("dfjhgkfdjghkfdj")}
 
 	buffer := NewPackedTable(make([]byte, bufferSize), bufferSize/2)
 	for i := 0; i < 1000000; i++ {
+		// Alternate value sizes, since same-size values are overwritten in place.
+		val := vals[i%2]
 		// Without GC, this will fail after a while.
 		if err := buffer.Put(key, val); err != nil {
 			t.Fatalf("Unexpected put error %v", err)
@@ -209,6 +270,103 @@ func TestPackedTableOverwriteAutoGC(t *testing.T) {
 	}
 }
 
+func TestPackedTableGCMetrics(t *testing.T) {
+	buffer := NewPackedTable(make([]byte, bufferSize), 0)
+	gcs := testutil.ToFloat64(tableGcs)
+	buffer.GC()
+	// Nothing to collect, so not counted.
+	if n := testutil.ToFloat64(tableGcs); n != gcs {
+		t.Errorf("Unexpected GC count %v, expected %v", n, gcs)
+	}
+
+	if err := buffer.Put([]byte("foo"), []byte("bar")); err != nil {
+		t.Fatalf("Unexpected put error %v", err)
+	}
+	buffer.Delete([]byte("foo"))
+	buffer.GC()
+	if n := testutil.ToFloat64(tableGcs); n != gcs+1 {
+		t.Errorf("Unexpected GC count %v, expected %v", n, gcs+1)
+	}
+}
+
+func TestPackedTableOverwriteInPlace(t *testing.T) {
+	key := []byte("foo")
+
+	buffer := NewPackedTable(make([]byte, bufferSize), 0)
+	if err := buffer.Put(key, []byte("hello")); err != nil {
+		t.Fatalf("Unexpected put error %v", err)
+	}
+	if err := buffer.Put([]byte("bar"), make([]byte, buffer.FreeSpace()-prefixLen-3)); err != nil {
+		t.Fatalf("Unexpected put error %v", err)
+	}
+	if buffer.FreeSpace() != 0 {
+		t.Fatalf("Unexpected free space %d", buffer.FreeSpace())
+	}
+	offset := buffer.EntryOffset(key)
+
+	// Same size values succeed even though the table is full.
+	for _, val := range []string{"world", "12345"} {
+		if err := buffer.Put(key, []byte(val)); err != nil {
+			t.Fatalf("Unexpected put error %v", err)
+		}
+		if buf := buffer.Get(key); !bytes.Equal(buf, []byte(val)) {
+			t.Errorf("Unexpected get result %s", string(buf))
+		}
+	}
+	epoch := buffer.Epoch()
+	old, err := buffer.PutReturning(key, []byte("abcde"), nil)
+	if err != nil {
+		t.Fatalf("Unexpected put error %v", err)
+	}
+	if !bytes.Equal(old, []byte("12345")) {
+		t.Errorf("Unexpected old value %s", string(old))
+	}
+	if !buffer.Overwrite(key, []byte("fghij")) || buffer.Overwrite(key, []byte("long")) {
+		t.Errorf("Unexpected overwrite result")
+	}
+	if buf := buffer.Get(key); !bytes.Equal(buf, []byte("fghij")) {
+		t.Errorf("Unexpected get result %s", string(buf))
+	}
+	// Each overwrite is a new store of the key.
+	if buffer.Epoch() != epoch+2 {
+		t.Errorf("Unexpected epoch %d", buffer.Epoch())
+	}
+	if buffer.NumDeleted() != 0 || buffer.DeletedSpace() != 0 || buffer.EntryOffset(key) != offset {
+		t.Errorf("Unexpected stats")
+	}
+	if err := buffer.Verify(); err != nil {
+		t.Errorf("Unexpected verify error %v", err)
+	}
+
+	if err := buffer.Put(key, []byte("longer")); err != ErrNoSpace {
+		t.Errorf("Unexpected put error %v", err)
+	}
+}
+
+func TestPackedTableProbeStats(t *testing.T) {
+	buffer := NewPackedTable(make([]byte, bufferSize), 0)
+	if avg, max := buffer.ProbeStats(); avg != 0 || max != 0 {
+		t.Errorf("Unexpected probe stats %v, %d", avg, max)
+	}
+
+	// Every key collides, so each is displaced one slot further than the last.
+	buffer.hashFn = func([]byte) uint32 { return 1 }
+	for _, key := range []string{"foo", "bar", "baz"} {
+		if err := buffer.Put([]byte(key), []byte("val")); err != nil {
+			t.Fatalf("Unexpected put error %v", err)
+		}
+	}
+	if avg, max := buffer.ProbeStats(); avg != 1 || max != 2 {
+		t.Errorf("Unexpected probe stats %v, %d", avg, max)
+	}
+
+	// Deleting a key leaves its slot in the probe chain.
+	buffer.Delete([]byte("foo"))
+	if avg, max := buffer.ProbeStats(); avg != 1.5 || max != 2 {
+		t.Errorf("Unexpected probe stats %v, %d", avg, max)
+	}
+}
+
 func TestPackedTableReset(t *testing.T) {
 	key := []byte("foo")
 	val1 := []byte("hello")
@@ -240,6 +398,105 @@ func TestPackedTableReset(t *testing.T) {
 	}
 }
 
+func TestPackedTableClone(t *testing.T) {
+	key1 := []byte("foo")
+	key2 := []byte("bar")
+	key3 := []byte("baz")
+	val1 := []byte("hello")
+	val2 := []byte("world")
+
+	buffer := NewPackedTable(make([]byte, bufferSize), 0)
+	buffer.Put(key1, val1)
+	buffer.Put(key2, val2)
+	buffer.Put(key3, val1)
+	buffer.Delete(key3)
+
+	clone := buffer.Clone()
+	if clone.NumEntries() != 2 || clone.NumDeleted() != 0 || clone.DeletedSpace() != 0 {
+		t.Errorf("Unexpected stats")
+	}
+
+	buffer.Put(key1, val2)
+	buffer.Delete(key2)
+	buffer.Put(key3, val2)
+	buffer.GC()
+	buffer.Reset()
+	buffer.Put(key2, val1)
+
+	if buf := clone.Get(key1); !bytes.Equal(buf, val1) {
+		t.Errorf("Unexpected get result %s", string(buf))
+	}
+	if buf := clone.Get(key2); !bytes.Equal(buf, val2) {
+		t.Errorf("Unexpected get result %s", string(buf))
+	}
+	if has := clone.Has(key3); has {
+		t.Errorf("Unexpected has")
+	}
+}
+
+func TestPackedTableSerialize(t *testing.T) {
+	buffer := NewPackedTable(make([]byte, bufferSize), 0)
+	addedValues := make(map[string]bool)
+	for k, v := range values {
+		if buffer.Put([]byte(k), v) == nil {
+			addedValues[k] = true
+		}
+	}
+	for k := range addedValues {
+		if rand.Float32() > 0.2 {
+			continue
+		}
+		buffer.Delete([]byte(k))
+		delete(addedValues, k)
+	}
+
+	var out bytes.Buffer
+	n, err := buffer.WriteTo(&out)
+	if err != nil {
+		t.Fatalf("Unexpected write error %v", err)
+	}
+	if n != int64(out.Len()) {
+		t.Errorf("Written %d != buffer length %d", n, out.Len())
+	}
+	serialized := out.Bytes()
+
+	read, err := ReadPackedTable(bytes.NewReader(serialized), make([]byte, bufferSize))
+	if err != nil {
+		t.Fatalf("Unexpected read error %v", err)
+	}
+	if read.NumEntries() != len(addedValues) || read.NumDeleted() != 0 {
+		t.Errorf("Unexpected stats")
+	}
+	if read.LiveSpace() != buffer.LiveSpace() {
+		t.Errorf("read.LiveSpace() %d != buffer.LiveSpace() %d",
+			read.LiveSpace(), buffer.LiveSpace())
+	}
+	for k, v := range values {
+		buf := read.Get([]byte(k))
+		if addedValues[k] != (buf != nil) {
+			t.Errorf("exists %v != (buf %v != nil)", addedValues[k], buf)
+		}
+		if buf != nil && !bytes.Equal(buf, v) {
+			t.Errorf("buffer for %s != expected", k)
+		}
+	}
+
+	_, err = ReadPackedTable(bytes.NewReader(serialized), make([]byte, 1024))
+	if err != ErrNoSpace {
+		t.Errorf("Unexpected read error %v", err)
+	}
+	_, err = ReadPackedTable(bytes.NewReader(serialized[:len(serialized)-1]),
+		make([]byte, bufferSize))
+	if err == nil {
+		t.Errorf("Unexpected read success")
+	}
+	serialized[0]++
+	_, err = ReadPackedTable(bytes.NewReader(serialized), make([]byte, bufferSize))
+	if err != ErrInvalidData {
+		t.Errorf("Unexpected read error %v", err)
+	}
+}
+
 func BenchmarkPackedTableHas(b *testing.B) {
 	buffer := NewPackedTable(make([]byte, bufferSize), 0)
 	key := shortKey
@@ -463,3 +720,26 @@ func BenchmarkPackedTableGC_64(b *testing.B) {
 func BenchmarkPackedTableGC_1024(b *testing.B) {
 	benchmarkPackedTableGC_N(b, 1024)
 }
+
+func TestPackedTableVerify(t *testing.T) {
+	buf := make([]byte, 4096)
+	table := NewPackedTable(buf, 0)
+	for i := 0; i < 20; i++ {
+		table.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
+	}
+	table.Delete([]byte("key3"))
+	table.Put([]byte("key5"), []byte("replaced"))
+	if err := table.Verify(); err != nil {
+		t.Errorf("Verify() = %v, want nil", err)
+	}
+	table.GC()
+	if err := table.Verify(); err != nil {
+		t.Errorf("Verify() after GC = %v, want nil", err)
+	}
+
+	// Corrupt the value size of the first entry.
+	buf[7] = 0x7f
+	if err := table.Verify(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Verify() = %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,298 @@
+package dory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Replication feed operations. Each operation is a header consisting of the
+// op, 4-byte little-endian key length, 4-byte little-endian value length, and
+// 8-byte little-endian TTL in milliseconds, followed by the key and value.
+const (
+	feedOpNop byte = iota
+	// Clears the replica. Sent at the start of each feed.
+	feedOpReset
+	// A chunk of entries in the format written by DumpTo, stored in the value.
+	feedOpSnapshot
+	feedOpPut
+	feedOpDelete
+
+	feedHeaderLen = 1 + 4 + 4 + 8
+
+	// Number of operations queued for a subscriber before it is considered to
+	// have fallen behind, and is disconnected.
+	subscriberQueueLen = 64 * 1024
+
+	// Heartbeats are sent when there are no operations, so that subscribers
+	// whose connection has gone away are noticed.
+	feedHeartbeatInterval = 10 * time.Second
+
+	replicaMinRetryDelay = time.Second
+	replicaMaxRetryDelay = 30 * time.Second
+)
+
+var (
+	ErrSubscriberOverflow = errors.New("replication subscriber fell behind")
+
+	subscriberOverflows = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_replication_overflows_total",
+		Help: "Number of replication subscribers disconnected for falling behind.",
+	})
+)
+
+func init() {
+	prom.MustRegister(subscriberOverflows)
+}
+
+type subscriber struct {
+	ops chan []byte
+	// Set, and ops closed, when the subscriber falls behind. Guarded by the
+	// cache lock.
+	overflowed bool
+}
+
+func encodeFeedOp(op byte, key, val []byte, ttl time.Duration) []byte {
+	buf := make([]byte, feedHeaderLen, feedHeaderLen+len(key)+len(val))
+	buf[0] = op
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(buf[5:], uint32(len(val)))
+	binary.LittleEndian.PutUint64(buf[9:], uint64(ttl/time.Millisecond))
+	buf = append(buf, key...)
+	return append(buf, val...)
+}
+
+// Sends the operation to all subscribers. Must be called with the write lock
+// held, so that subscribers see operations in the order they were applied.
+func (c *Memcache) publish(op byte, key, val []byte, ttl time.Duration) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+
+	buf := encodeFeedOp(op, key, val, ttl)
+	for s := range c.subscribers {
+		if s.overflowed {
+			continue
+		}
+		select {
+		case s.ops <- buf:
+		default:
+			// Never block writes on a slow subscriber.
+			s.overflowed = true
+			close(s.ops)
+			subscriberOverflows.Inc()
+		}
+	}
+}
+
+// Subscribe writes a replication feed to w, which can be applied to another
+// Memcache using Replay. The feed starts with a snapshot of the cache,
+// followed by every subsequent Put and Delete. Subscribe blocks until writing
+// to w fails, or the subscriber falls behind, in which case
+// ErrSubscriberOverflow is returned. Expiry and eviction are not replicated.
+func (c *Memcache) Subscribe(w io.Writer) error {
+	s := &subscriber{ops: make(chan []byte, subscriberQueueLen)}
+	c.lock.Lock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[*subscriber]struct{})
+	}
+	c.subscribers[s] = struct{}{}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.subscribers, s)
+		c.lock.Unlock()
+	}()
+
+	bufw := bufio.NewWriter(w)
+	flush := func() error {
+		err := bufw.Flush()
+		if f, ok := w.(interface{ Flush() }); ok && err == nil {
+			// Typically a http.ResponseWriter.
+			f.Flush()
+		}
+		return err
+	}
+
+	_, err := bufw.Write(encodeFeedOp(feedOpReset, nil, nil, 0))
+	if err != nil {
+		return err
+	}
+	// Operations applied while the snapshot is being taken are queued, and
+	// replayed after the snapshot.
+	err = c.dumpTables(func(chunk []byte) error {
+		_, err := bufw.Write(encodeFeedOp(feedOpSnapshot, nil, chunk, 0))
+		return err
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(feedHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case op, ok := <-s.ops:
+			if !ok {
+				return ErrSubscriberOverflow
+			}
+			_, err = bufw.Write(op)
+			// Batch up any other queued operations before flushing.
+			for n := len(s.ops); err == nil && n > 0; n-- {
+				op, ok = <-s.ops
+				if !ok {
+					return ErrSubscriberOverflow
+				}
+				_, err = bufw.Write(op)
+			}
+		case <-heartbeat.C:
+			_, err = bufw.Write(encodeFeedOp(feedOpNop, nil, nil, 0))
+		}
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Replay applies a replication feed written by Subscribe to the cache, until
+// reading from r fails. Returns nil if the feed ends cleanly.
+func (c *Memcache) Replay(r io.Reader) error {
+	bufr := bufio.NewReader(r)
+	var header [feedHeaderLen]byte
+	var buf []byte
+	for {
+		_, err := io.ReadFull(bufr, header[:])
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		op := header[0]
+		keyLen := int(binary.LittleEndian.Uint32(header[1:]))
+		valLen := int(binary.LittleEndian.Uint32(header[5:]))
+		ttl := time.Duration(binary.LittleEndian.Uint64(header[9:])) * time.Millisecond
+
+		if keyLen > c.MaxKeySize() && (op == feedOpPut || op == feedOpDelete) {
+			// Keys this large can't be stored in this cache, so ignore them.
+			_, err = bufr.Discard(keyLen + valLen)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if keyLen > c.MaxKeySize() || valLen > 1<<30 {
+			return fmt.Errorf("dory: invalid replication op %d, key %d, value %d",
+				op, keyLen, valLen)
+		}
+		// Values too large for this cache are skipped, but any existing value is
+		// stale, so delete it instead.
+		skipVal := op == feedOpPut && valLen > c.MaxValSize()
+		readLen := keyLen + valLen
+		if skipVal {
+			readLen = keyLen
+		}
+
+		if cap(buf) < readLen {
+			buf = make([]byte, readLen)
+		}
+		buf = buf[:readLen]
+		_, err = io.ReadFull(bufr, buf)
+		if err != nil {
+			return err
+		}
+		if skipVal {
+			_, err = bufr.Discard(valLen)
+			if err != nil {
+				return err
+			}
+			op = feedOpDelete
+		}
+		key := buf[:keyLen]
+		val := buf[keyLen:readLen]
+
+		switch op {
+		case feedOpNop:
+		case feedOpReset:
+			c.Clear()
+		case feedOpSnapshot:
+			_, _, err = c.LoadFrom(bytes.NewReader(val))
+			if err != nil {
+				return err
+			}
+		case feedOpPut:
+			// Errors are ignored, since the primary might store entries that
+			// this cache can't.
+			c.PutWithTTL(key, val, ttl)
+		case feedOpDelete:
+			c.Delete(key)
+		default:
+			return fmt.Errorf("dory: unknown replication op %d", op)
+		}
+	}
+}
+
+// ReplicaClient keeps a Memcache up to date with a primary, by applying the
+// primary's replication feed served over HTTP. Delivery is best effort. If the
+// connection is lost, or the replica falls behind, it reconnects and starts
+// again from a fresh snapshot, so staleness is bounded by the time taken to
+// reconnect.
+type ReplicaClient struct {
+	c   *Memcache
+	url string
+}
+
+func NewReplicaClient(c *Memcache, url string) *ReplicaClient {
+	return &ReplicaClient{
+		c:   c,
+		url: url,
+	}
+}
+
+// Run replicates from the primary forever.
+func (r *ReplicaClient) Run() {
+	delay := replicaMinRetryDelay
+	for {
+		start := time.Now()
+		err := r.replicate()
+		log.Printf("Replication from %s stopped: %v", r.url, err)
+
+		if time.Since(start) > replicaMaxRetryDelay {
+			// Replication was working for a while, so retry quickly.
+			delay = replicaMinRetryDelay
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > replicaMaxRetryDelay {
+			delay = replicaMaxRetryDelay
+		}
+	}
+}
+
+func (r *ReplicaClient) replicate() error {
+	resp, err := http.Get(r.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	err = r.c.Replay(resp.Body)
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
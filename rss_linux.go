@@ -0,0 +1,22 @@
+package dory
+
+import (
+	"fmt"
+	"os"
+)
+
+// Returns the resident set size of the process, in bytes, or -1 if it can't
+// be determined.
+func getRss() int64 {
+	buf, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return -1
+	}
+	// Fields are: size resident shared text lib data dt, in pages.
+	var size, resident int64
+	_, err = fmt.Sscanf(string(buf), "%d %d", &size, &resident)
+	if err != nil {
+		return -1
+	}
+	return resident * int64(os.Getpagesize())
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package dory
+
+// Returns the resident set size of the process, in bytes, or -1 if it can't
+// be determined.
+func getRss() int64 {
+	return -1
+}
@@ -0,0 +1,93 @@
+package dory
+
+import (
+	"log"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scrubbedTables = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_scrub_tables_total",
+		Help: "Number of tables checked by the integrity scrubber.",
+	})
+	corruptTables = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_scrub_corrupt_tables_total",
+		Help: "Number of tables found to be corrupt by the integrity scrubber, and discarded.",
+	})
+)
+
+func init() {
+	prom.MustRegister(scrubbedTables)
+	prom.MustRegister(corruptTables)
+}
+
+// scrubber verifies one table every interval, cycling through all tables.
+func (c *Memcache) scrubber(interval time.Duration) {
+	defer c.bgWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.scrubNextTable()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Returns the oldest table with a generation of at least |gen|, or nil if
+// there is none. Must be called with the lock held.
+func (c *Memcache) nextScrubTable(gen uint64) *DiscardableTable {
+	var next *DiscardableTable
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*DiscardableTable)
+		tgen := t.Meta().(uint64)
+		if tgen >= gen && (next == nil || tgen < next.Meta().(uint64)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// Verifies the next table to be scrubbed, discarding it if it is corrupt.
+// Returns whether a corrupt table was found.
+func (c *Memcache) scrubNextTable() bool {
+	c.lock.RLock()
+	t := c.nextScrubTable(c.scrubGen)
+	if t == nil {
+		// Reached the newest table, so start again from the oldest.
+		t = c.nextScrubTable(0)
+	}
+	if t == nil {
+		c.lock.RUnlock()
+		return false
+	}
+	gen := t.Meta().(uint64)
+	err := t.Verify()
+	c.lock.RUnlock()
+	scrubbedTables.Inc()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scrubGen = gen + 1
+	if err == nil {
+		return false
+	}
+	log.Printf("Discarding table %d: %v", gen, err)
+	corruptTables.Inc()
+	if t.table == nil {
+		// Discarded or recycled since being verified.
+		return true
+	}
+	// Not discardTable(), since the corrupt table's keys can't be trusted for
+	// eviction notifications.
+	c.tableChanged(t)
+	c.tableMem -= int64(t.Size())
+	t.Discard()
+	c.cleanupTable(t)
+	c.tables.Remove(t.Element())
+	return true
+}
@@ -0,0 +1,138 @@
+package dory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// SelfTest checks that the cache works on this host, by running a cycle of
+// puts, gets, overwrites, deletes, GC and eviction against a small cache
+// created with opts. This catches problems with the environment, such as mmap
+// being restricted, at startup rather than under load. The memory limit in
+// opts is replaced, and options which would stop tables being evicted, or
+// start background work, are disabled. Returns the first problem found,
+// including any panic.
+func SelfTest(opts MemcacheOptions) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("self-test: panic: %v", r)
+		}
+	}()
+
+	tableSize := opts.TableSize
+	if tableSize == 0 {
+		tableSize = DefaultTableSize
+		if opts.Arena != nil {
+			tableSize = opts.Arena.ChunkSize()
+		}
+	}
+	opts.MemoryFunction = ConstantMemory(int64(2 * tableSize))
+	opts.LargeValueThreshold = 0
+	opts.SoftLimitFraction = 0
+	opts.OnEvict = nil
+	opts.ScrubInterval = 0
+	opts.CompactionThreshold = 0
+	c := NewMemcache(opts)
+	defer c.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("dory-self-test-%d", i))
+	}
+	valSize := 256
+	if valSize > c.maxValSize {
+		valSize = c.maxValSize
+	}
+	val := func(i, version int) []byte {
+		v := bytes.Repeat([]byte{byte(version)}, valSize)
+		binary.LittleEndian.PutUint32(v, uint32(i))
+		return v
+	}
+	// Few enough keys that, with the overwrites, they fit in one table, so none
+	// are evicted until the cache is deliberately filled.
+	numKeys := tableSize / (2 * (valSize + 64))
+	check := func(i, version int) error {
+		got := c.Get(key(i), nil)
+		if version < 0 {
+			if got != nil {
+				return fmt.Errorf("self-test: deleted key %q found", key(i))
+			}
+		} else if !bytes.Equal(got, val(i, version)) {
+			return fmt.Errorf("self-test: key %q has the wrong value", key(i))
+		}
+		return nil
+	}
+
+	// Put, overwrite every other key, and delete every fourth key.
+	for i := 0; i < numKeys; i++ {
+		if err := c.Put(key(i), val(i, 1)); err != nil {
+			return fmt.Errorf("self-test: put: %w", err)
+		}
+	}
+	for i := 0; i < numKeys; i += 2 {
+		if err := c.Put(key(i), val(i, 2)); err != nil {
+			return fmt.Errorf("self-test: overwrite: %w", err)
+		}
+	}
+	for i := 0; i < numKeys; i += 4 {
+		c.Delete(key(i))
+	}
+	want := func(i int) int {
+		if i%4 == 0 {
+			return -1
+		} else if i%2 == 0 {
+			return 2
+		}
+		return 1
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := check(i, want(i)); err != nil {
+			return err
+		}
+	}
+
+	// The overwritten and deleted entries must be reclaimed by GC, without
+	// disturbing the remaining ones.
+	if c.RunGC() == 0 {
+		return fmt.Errorf("self-test: GC reclaimed no space")
+	}
+	for i := 0; i < numKeys; i++ {
+		if err := check(i, want(i)); err != nil {
+			return err
+		}
+	}
+	if err := c.verifyTables(); err != nil {
+		return err
+	}
+
+	// Fill more than the memory limit, so that tables are evicted.
+	n := 4 * tableSize / valSize
+	for i := 0; i < n; i++ {
+		if err := c.Put(key(i), val(i, 3)); err != nil {
+			return fmt.Errorf("self-test: put: %w", err)
+		}
+	}
+	if err := check(n-1, 3); err != nil {
+		return err
+	}
+	if c.Has(key(0)) {
+		return fmt.Errorf("self-test: no keys evicted")
+	}
+	if mem := c.Stats().TableMem; mem > int64(2*tableSize) {
+		return fmt.Errorf("self-test: table memory %d exceeds limit %d", mem, 2*tableSize)
+	}
+	return c.verifyTables()
+}
+
+// Verifies the integrity of every table.
+func (c *Memcache) verifyTables() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for e := c.tables.Front(); e != nil; e = e.Next() {
+		t := e.Value.(*DiscardableTable)
+		if err := t.Verify(); err != nil {
+			return fmt.Errorf("self-test: table %d: %w", t.Meta().(uint64), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rejectedConns = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_rejected_connections_total",
+		Help: "Number of client connections closed because their address isn't allowed.",
+	})
+)
+
+func init() {
+	prom.MustRegister(rejectedConns)
+}
+
+// AddrFilter decides which client addresses may connect, using lists of
+// allowed and denied CIDR ranges. An address is allowed if it isn't in a
+// denied range, and either there are no allowed ranges, or it is in one.
+type AddrFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewAddrFilter returns an AddrFilter for comma-separated lists of allowed and
+// denied CIDR ranges, either of which may be empty.
+func NewAddrFilter(allow, deny string) (*AddrFilter, error) {
+	f := &AddrFilter{}
+	var err error
+	f.allow, err = parseCidrs(allow)
+	if err != nil {
+		return nil, err
+	}
+	f.deny, err = parseCidrs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseCidrs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("AddrFilter: invalid CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Allowed returns whether a client at addr may connect. Addresses which
+// aren't TCP or UDP addresses are only allowed if there are no allowed
+// ranges. Each rejected address is counted in the metrics.
+func (f *AddrFilter) Allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+
+	allowed := f.allowedIP(ip)
+	if !allowed {
+		rejectedConns.Inc()
+	}
+	return allowed
+}
+
+func (f *AddrFilter) allowedIP(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestAddrFilter(t *testing.T) {
+	f, err := NewAddrFilter("10.0.0.0/8, 192.168.1.0/24", "10.1.0.0/16")
+	assert.NoError(t, err)
+	assert.True(t, f.Allowed(tcpAddr("10.2.3.4")))
+	assert.True(t, f.Allowed(tcpAddr("192.168.1.10")))
+	assert.False(t, f.Allowed(tcpAddr("10.1.2.3")))
+	assert.False(t, f.Allowed(tcpAddr("192.168.2.10")))
+	assert.False(t, f.Allowed(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}))
+
+	f, err = NewAddrFilter("", "127.0.0.0/8")
+	assert.NoError(t, err)
+	assert.False(t, f.Allowed(tcpAddr("127.0.0.1")))
+	assert.True(t, f.Allowed(tcpAddr("10.0.0.1")))
+	assert.True(t, f.Allowed(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}))
+
+	_, err = NewAddrFilter("10.0.0.0", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+)
+
+// respCommandInfo describes a redis command, for validating requests and for
+// the COMMAND reply.
+type respCommandInfo struct {
+	name []byte
+	// Number of arguments, including the command name. As in redis, a negative
+	// arity means at least -arity arguments.
+	arity int
+	// Whether the command modifies the cache, so is rejected by read replicas.
+	write bool
+	// Whether the command can be queued as part of a MULTI transaction.
+	transactional bool
+	// Whether the command only uses dory.Cache operations, so can be used with
+	// caches other than dory.Memcache.
+	basic bool
+}
+
+// Every command supported by RedisServer.
+var respCommands = []respCommandInfo{
+	{name: respCmdSet, arity: -3, write: true, transactional: true, basic: true},
+	{name: respCmdMset, arity: -3, write: true, transactional: true},
+	{name: respCmdAdd, arity: -3, write: true, transactional: true},
+	{name: respCmdReplace, arity: -3, write: true, transactional: true},
+	{name: respCmdSetRange, arity: 4, write: true, transactional: true},
+	{name: respCmdDel, arity: -2, write: true, transactional: true, basic: true},
+	{name: respCmdGet, arity: 2, transactional: true, basic: true},
+	{name: respCmdGetRange, arity: 4, transactional: true},
+	{name: respCmdStrlen, arity: 2, transactional: true},
+	{name: respCmdExists, arity: -2, transactional: true, basic: true},
+	{name: respCmdWasCached, arity: 2},
+	{name: respCmdDebug, arity: -2},
+	{name: respCmdObject, arity: -2},
+	{name: respCmdMemory, arity: -2},
+	{name: respCmdConfig, arity: -2},
+	{name: respCmdEvict, arity: 2, write: true},
+	{name: respCmdSetFlags, arity: 3, write: true},
+	{name: respCmdGetFlags, arity: 2},
+	{name: respCmdCommand, arity: -1, basic: true},
+	{name: respCmdMulti, arity: 1},
+	{name: respCmdExec, arity: 1},
+	{name: respCmdDiscard, arity: 1},
+	{name: respCmdWatch, arity: -2},
+	{name: respCmdUnwatch, arity: 1},
+	{name: respCmdSetBufferSize, arity: 2},
+	{name: respCmdWatchEvictions, arity: 1},
+}
+
+// Returns the description of the command, or nil if it isn't supported.
+func lookupCommand(cmd *respArray) *respCommandInfo {
+	if len(cmd.vals) < 1 {
+		return nil
+	}
+	cmdBuf, ok := cmd.vals[0].(*[]byte)
+	if !ok {
+		return nil
+	}
+	for i := range respCommands {
+		if equalsCommand(*cmdBuf, respCommands[i].name) {
+			return &respCommands[i]
+		}
+	}
+	return nil
+}
+
+// Returns a wrong number of arguments error if the command has the wrong
+// number of arguments, otherwise nil.
+func (info *respCommandInfo) checkArity(cmd *respArray) error {
+	if (info.arity >= 0 && len(cmd.vals) != info.arity) ||
+		(info.arity < 0 && len(cmd.vals) < -info.arity) {
+		return wrongArgsError(string(info.name))
+	}
+	return nil
+}
+
+// doCommandCommand replies to COMMAND with each command's name, arity and
+// flags, or to COMMAND COUNT with the number of commands.
+func (s *RedisServer) doCommandCommand(cmd *respArray, w *bufio.Writer) error {
+	if len(cmd.vals) == 2 && equalsCommand(*cmd.vals[1].(*[]byte), respCommandCount) {
+		return s.writeInteger(w, int64(len(respCommands)))
+	} else if len(cmd.vals) != 1 {
+		return commandError("unknown subcommand '%s'. Only COMMAND and COMMAND COUNT are supported",
+			string(*cmd.vals[1].(*[]byte)))
+	}
+
+	err := s.writeArrayHeader(w, len(respCommands))
+	for i := range respCommands {
+		if err != nil {
+			break
+		}
+		info := &respCommands[i]
+		flag := "readonly"
+		if info.write {
+			flag = "write"
+		}
+		err = s.writeArrayHeader(w, 3)
+		if err == nil {
+			err = s.writeBulk(w, info.name)
+		}
+		if err == nil {
+			err = s.writeInteger(w, int64(info.arity))
+		}
+		if err == nil {
+			err = s.writeArrayHeader(w, 1)
+		}
+		if err == nil {
+			err = s.writeSimpleString(w, flag)
+		}
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Number of notifications queued for each watching connection. Further
+	// notifications are dropped until the connection catches up.
+	evictionQueueLen = 4096
+)
+
+var (
+	evictionNotificationsDropped = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_eviction_notifications_dropped_total",
+		Help: "Number of eviction notifications dropped because a watcher was too slow.",
+	})
+)
+
+func init() {
+	prom.MustRegister(evictionNotificationsDropped)
+}
+
+// EvictionWatchers distributes eviction notifications to connections which
+// have issued WATCH-EVICTIONS. Delivery is best effort: notifications are
+// dropped if a connection isn't keeping up.
+type EvictionWatchers struct {
+	lock     sync.Mutex
+	watchers map[chan []byte]struct{}
+}
+
+func NewEvictionWatchers() *EvictionWatchers {
+	return &EvictionWatchers{
+		watchers: make(map[chan []byte]struct{}),
+	}
+}
+
+// Notify sends the evicted key to all watchers. Suitable for use as a
+// dory.EvictFunc.
+func (w *EvictionWatchers) Notify(key []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.watchers) == 0 {
+		return
+	}
+
+	// The key is only valid during this call, so copy it.
+	key = append([]byte(nil), key...)
+	for ch := range w.watchers {
+		select {
+		case ch <- key:
+		default:
+			evictionNotificationsDropped.Inc()
+		}
+	}
+}
+
+func (w *EvictionWatchers) watch() chan []byte {
+	ch := make(chan []byte, evictionQueueLen)
+	w.lock.Lock()
+	w.watchers[ch] = struct{}{}
+	w.lock.Unlock()
+	return ch
+}
+
+func (w *EvictionWatchers) unwatch(ch chan []byte) {
+	w.lock.Lock()
+	delete(w.watchers, ch)
+	w.lock.Unlock()
+}
+
+// serveEvictions writes a push message, the array ["evicted", key], for every
+// evicted key until the connection is closed. Any further commands from the
+// client are ignored.
+func (s *RedisServer) serveEvictions(r *bufio.Reader, w *bufio.Writer) error {
+	ch := s.evictions.watch()
+	defer s.evictions.unwatch(ch)
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, r)
+		closed <- err
+	}()
+
+	for {
+		select {
+		case key := <-ch:
+			err := s.writeEvicted(w, key)
+			// Batch up any other queued notifications before flushing.
+			for n := len(ch); err == nil && n > 0; n-- {
+				err = s.writeEvicted(w, <-ch)
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		case err := <-closed:
+			return err
+		}
+	}
+}
+
+func (s *RedisServer) writeEvicted(w *bufio.Writer, key []byte) error {
+	err := s.writeArrayHeader(w, 2)
+	if err == nil {
+		err = s.writeBulk(w, respPushEvicted)
+	}
+	if err == nil {
+		err = s.writeBulk(w, key)
+	}
+	return err
+}
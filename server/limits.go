@@ -0,0 +1,55 @@
+package server
+
+import (
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	commandLimitWaits = prom.NewCounterVec(prom.CounterOpts{
+		Name: "dory_resp_command_limit_waits_total",
+		Help: "Number of commands which waited for another command of the same class to finish.",
+	}, []string{"class"})
+)
+
+func init() {
+	prom.MustRegister(commandLimitWaits)
+}
+
+// commandLimit limits the number of commands of a class, such as reads or
+// writes, which run at once across all connections. A nil commandLimit is
+// unlimited.
+type commandLimit struct {
+	slots chan struct{}
+	waits prom.Counter
+}
+
+func newCommandLimit(class string, n int) *commandLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &commandLimit{
+		slots: make(chan struct{}, n),
+		waits: commandLimitWaits.WithLabelValues(class),
+	}
+}
+
+// Waits until a command can run.
+func (l *commandLimit) acquire() {
+	if l == nil {
+		return
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		l.waits.Inc()
+		l.slots <- struct{}{}
+	}
+}
+
+// Releases the slot taken by acquire.
+func (l *commandLimit) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
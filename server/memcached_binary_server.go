@@ -0,0 +1,423 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/akmistry/go-util/bufferpool"
+
+	"github.com/akmistry/dory"
+)
+
+const (
+	mcbMagicRequest  = 0x80
+	mcbMagicResponse = 0x81
+
+	mcbHeaderLen = 24
+
+	mcbOpGet       = 0x00
+	mcbOpSet       = 0x01
+	mcbOpAdd       = 0x02
+	mcbOpReplace   = 0x03
+	mcbOpDelete    = 0x04
+	mcbOpIncrement = 0x05
+	mcbOpDecrement = 0x06
+	mcbOpNoop      = 0x0a
+
+	mcbStatusOk             = 0x0000
+	mcbStatusKeyNotFound    = 0x0001
+	mcbStatusKeyExists      = 0x0002
+	mcbStatusValueTooLarge  = 0x0003
+	mcbStatusInvalidArgs    = 0x0004
+	mcbStatusNonNumeric     = 0x0006
+	mcbStatusUnknownCommand = 0x0081
+	mcbStatusOutOfMemory    = 0x0082
+	mcbStatusNotSupported   = 0x0083
+	mcbStatusInternalError  = 0x0084
+
+	// Counter expiration which fails the operation if the counter doesn't
+	// exist, instead of creating it.
+	mcbCounterExpiryNoCreate = 0xffffffff
+
+	// Maximum length of a request body, beyond the key and value, for extras.
+	mcbMaxExtrasLen = 20
+)
+
+// mcbHeader is the fixed header of a binary protocol request or response. For
+// requests, status holds the vbucket ID, which is ignored.
+type mcbHeader struct {
+	magic     byte
+	opcode    byte
+	keyLen    uint16
+	extrasLen uint8
+	dataType  uint8
+	status    uint16
+	bodyLen   uint32
+	opaque    uint32
+	cas       uint64
+}
+
+func (h *mcbHeader) decode(buf []byte) {
+	h.magic = buf[0]
+	h.opcode = buf[1]
+	h.keyLen = binary.BigEndian.Uint16(buf[2:])
+	h.extrasLen = buf[4]
+	h.dataType = buf[5]
+	h.status = binary.BigEndian.Uint16(buf[6:])
+	h.bodyLen = binary.BigEndian.Uint32(buf[8:])
+	h.opaque = binary.BigEndian.Uint32(buf[12:])
+	h.cas = binary.BigEndian.Uint64(buf[16:])
+}
+
+func (h *mcbHeader) encode(buf []byte) {
+	buf[0] = h.magic
+	buf[1] = h.opcode
+	binary.BigEndian.PutUint16(buf[2:], h.keyLen)
+	buf[4] = h.extrasLen
+	buf[5] = h.dataType
+	binary.BigEndian.PutUint16(buf[6:], h.status)
+	binary.BigEndian.PutUint32(buf[8:], h.bodyLen)
+	binary.BigEndian.PutUint32(buf[12:], h.opaque)
+	binary.BigEndian.PutUint64(buf[16:], h.cas)
+}
+
+// mcbStatusError is a non-zero response status, with a message sent as the
+// response body.
+type mcbStatusError struct {
+	status uint16
+	msg    string
+}
+
+func (e *mcbStatusError) Error() string {
+	return e.msg
+}
+
+var (
+	errMcbKeyNotFound  = &mcbStatusError{mcbStatusKeyNotFound, "Not found"}
+	errMcbKeyExists    = &mcbStatusError{mcbStatusKeyExists, "Data exists for key"}
+	errMcbTooLarge     = &mcbStatusError{mcbStatusValueTooLarge, "Too large"}
+	errMcbInvalidArgs  = &mcbStatusError{mcbStatusInvalidArgs, "Invalid arguments"}
+	errMcbNonNumeric   = &mcbStatusError{mcbStatusNonNumeric, "Non-numeric server-side value for incr or decr"}
+	errMcbUnknown      = &mcbStatusError{mcbStatusUnknownCommand, "Unknown command"}
+	errMcbCas          = &mcbStatusError{mcbStatusNotSupported, "CAS is not supported"}
+	errMcbReadOnly     = &mcbStatusError{mcbStatusNotSupported, "Read only replica"}
+	errMcbInternal     = &mcbStatusError{mcbStatusInternalError, "Internal error"}
+	errMcbOutOfMemory  = &mcbStatusError{mcbStatusOutOfMemory, "Out of memory"}
+	errMcbInvalidMagic = errors.New("MemcachedBinaryServer: invalid request magic")
+)
+
+// MemcachedBinaryServer serves the core of the memcached binary protocol: Get,
+// Set, Add, Replace, Delete, Increment, Decrement and Noop. Quiet variants
+// aren't supported, and nor are CAS values.
+type MemcachedBinaryServer struct {
+	c           *dory.Memcache
+	readBufSize int
+	nowFunc     func() time.Time
+
+	// Whether writes are rejected, because the cache is a read replica.
+	readOnly bool
+}
+
+func NewMemcachedBinaryServer(c *dory.Memcache) *MemcachedBinaryServer {
+	return &MemcachedBinaryServer{
+		c:           c,
+		readBufSize: defaultReadBufferSize,
+		nowFunc:     time.Now,
+	}
+}
+
+// SetReadOnly rejects commands which modify the cache, for read replicas.
+func (s *MemcachedBinaryServer) SetReadOnly() {
+	s.readOnly = true
+}
+
+func (s *MemcachedBinaryServer) Serve(conn io.ReadWriter) error {
+	bufr := bufio.NewReaderSize(conn, s.readBufSize)
+	bufw := bufio.NewWriter(conn)
+	var headerBuf [mcbHeaderLen]byte
+	maxBodyLen := mcbMaxExtrasLen + s.c.MaxKeySize() + s.c.MaxValSize()
+	for {
+		_, err := io.ReadFull(bufr, headerBuf[:])
+		if err == io.EOF {
+			// Connection closed. Non-error.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var req mcbHeader
+		req.decode(headerBuf[:])
+		if req.magic != mcbMagicRequest {
+			return errMcbInvalidMagic
+		}
+
+		if int64(req.bodyLen) > int64(maxBodyLen) {
+			_, err = bufr.Discard(int(req.bodyLen))
+			if err == nil {
+				err = s.writeError(bufw, &req, errMcbTooLarge)
+			}
+		} else if int(req.extrasLen)+int(req.keyLen) > int(req.bodyLen) {
+			_, err = bufr.Discard(int(req.bodyLen))
+			if err == nil {
+				err = s.writeError(bufw, &req, errMcbInvalidArgs)
+			}
+		} else {
+			err = s.readAndDoCommand(&req, bufr, bufw)
+		}
+		if statusErr, ok := err.(*mcbStatusError); ok {
+			err = s.writeError(bufw, &req, statusErr)
+		}
+		if err == nil && bufr.Buffered() == 0 {
+			err = bufw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *MemcachedBinaryServer) readAndDoCommand(req *mcbHeader, r *bufio.Reader, w *bufio.Writer) error {
+	allocLen := int(req.bodyLen)
+	if allocLen < (1 << bufferpool.MinSizeBits) {
+		allocLen = (1 << bufferpool.MinSizeBits)
+	}
+	body := bufferpool.GetUninit(allocLen)
+	defer bufferpool.Put(body)
+	*body = (*body)[:req.bodyLen]
+	_, err := io.ReadFull(r, *body)
+	if err != nil {
+		return err
+	}
+	keyOff := int(req.extrasLen)
+	valOff := keyOff + int(req.keyLen)
+	return s.doCommand(req, (*body)[:keyOff], (*body)[keyOff:valOff], (*body)[valOff:], w)
+}
+
+func (s *MemcachedBinaryServer) writeResponse(w *bufio.Writer, req *mcbHeader, status uint16, extras, val []byte) error {
+	resp := mcbHeader{
+		magic:     mcbMagicResponse,
+		opcode:    req.opcode,
+		extrasLen: uint8(len(extras)),
+		status:    status,
+		bodyLen:   uint32(len(extras) + len(val)),
+		opaque:    req.opaque,
+	}
+	var headerBuf [mcbHeaderLen]byte
+	resp.encode(headerBuf[:])
+	_, err := w.Write(headerBuf[:])
+	if err == nil {
+		_, err = w.Write(extras)
+	}
+	if err == nil {
+		_, err = w.Write(val)
+	}
+	return err
+}
+
+func (s *MemcachedBinaryServer) writeError(w *bufio.Writer, req *mcbHeader, e *mcbStatusError) error {
+	return s.writeResponse(w, req, e.status, nil, []byte(e.msg))
+}
+
+func (s *MemcachedBinaryServer) doCommand(req *mcbHeader, extras, key, val []byte, w *bufio.Writer) error {
+	switch req.opcode {
+	case mcbOpNoop:
+		return s.writeResponse(w, req, mcbStatusOk, nil, nil)
+	case mcbOpGet:
+		return s.doGet(req, extras, key, val, w)
+	case mcbOpSet, mcbOpAdd, mcbOpReplace:
+		return s.doStore(req, extras, key, val, w)
+	case mcbOpDelete:
+		return s.doDelete(req, extras, key, val, w)
+	case mcbOpIncrement, mcbOpDecrement:
+		return s.doCounter(req, extras, key, val, w)
+	}
+	return errMcbUnknown
+}
+
+func (s *MemcachedBinaryServer) checkKey(key []byte) error {
+	if len(key) == 0 {
+		return errMcbInvalidArgs
+	} else if len(key) > s.c.MaxKeySize() {
+		return errMcbTooLarge
+	}
+	return nil
+}
+
+// Returns the TTL for a memcached expiration. A zero TTL means the entry
+// never expires, and a negative TTL means it has already expired.
+func (s *MemcachedBinaryServer) expirationToTTL(expiration uint32) time.Duration {
+	if expiration == 0 {
+		return 0
+	} else if expiration <= memcachedMaxRelativeExptime {
+		return time.Duration(expiration) * time.Second
+	}
+	ttl := time.Unix(int64(expiration), 0).Sub(s.nowFunc())
+	if ttl <= 0 {
+		return -1
+	}
+	return ttl
+}
+
+func (s *MemcachedBinaryServer) doGet(req *mcbHeader, extras, key, val []byte, w *bufio.Writer) error {
+	if len(extras) != 0 || len(val) != 0 {
+		return errMcbInvalidArgs
+	} else if err := s.checkKey(key); err != nil {
+		return err
+	}
+
+	getBuf := bufferpool.GetUninit(getBufSize(s.c))
+	defer bufferpool.Put(getBuf)
+	val, flags := s.c.GetWithFlags(key, (*getBuf)[:0])
+	if val == nil {
+		return errMcbKeyNotFound
+	}
+	var extrasBuf [4]byte
+	binary.BigEndian.PutUint32(extrasBuf[:], flags)
+	return s.writeResponse(w, req, mcbStatusOk, extrasBuf[:], val)
+}
+
+func (s *MemcachedBinaryServer) doStore(req *mcbHeader, extras, key, val []byte, w *bufio.Writer) error {
+	if len(extras) != 8 {
+		return errMcbInvalidArgs
+	} else if err := validateKeyVal(s.c, key, val); err != nil {
+		if err.(*sizeError).tooLarge {
+			return errMcbTooLarge
+		}
+		return errMcbInvalidArgs
+	} else if req.cas != 0 {
+		return errMcbCas
+	} else if s.readOnly {
+		return errMcbReadOnly
+	}
+	flags := binary.BigEndian.Uint32(extras)
+	ttl := s.expirationToTTL(binary.BigEndian.Uint32(extras[4:]))
+
+	stored := true
+	var err error
+	if ttl < 0 {
+		// Storing an already expired item just removes any existing item.
+		s.c.Atomically(func(tx *dory.Txn) {
+			exists := tx.Has(key)
+			if (req.opcode == mcbOpAdd && exists) || (req.opcode == mcbOpReplace && !exists) {
+				stored = false
+				return
+			}
+			tx.Delete(key)
+		})
+	} else {
+		s.c.Atomically(func(tx *dory.Txn) {
+			if req.opcode == mcbOpAdd {
+				stored, err = tx.Add(key, val, ttl)
+			} else if req.opcode == mcbOpReplace {
+				stored, err = tx.Replace(key, val, ttl)
+			} else {
+				err = tx.PutWithTTL(key, val, ttl)
+			}
+			if stored && err == nil && flags != 0 {
+				tx.SetFlags(key, flags)
+			}
+		})
+	}
+	if !stored && err == nil && req.opcode == mcbOpAdd {
+		// Add reports an existing key as such.
+		return errMcbKeyExists
+	} else if !stored && err == nil {
+		return errMcbKeyNotFound
+	} else if errors.Is(err, dory.ErrTooLarge) {
+		return errMcbTooLarge
+	} else if err == dory.ErrSoftLimit {
+		return errMcbOutOfMemory
+	} else if err != nil {
+		return errMcbInternal
+	}
+	return s.writeResponse(w, req, mcbStatusOk, nil, nil)
+}
+
+func (s *MemcachedBinaryServer) doDelete(req *mcbHeader, extras, key, val []byte, w *bufio.Writer) error {
+	if len(extras) != 0 || len(val) != 0 {
+		return errMcbInvalidArgs
+	} else if err := s.checkKey(key); err != nil {
+		return err
+	} else if s.readOnly {
+		return errMcbReadOnly
+	}
+
+	found := false
+	s.c.Atomically(func(tx *dory.Txn) {
+		found = tx.Has(key)
+		if found {
+			tx.Delete(key)
+		}
+	})
+	if !found {
+		return errMcbKeyNotFound
+	}
+	return s.writeResponse(w, req, mcbStatusOk, nil, nil)
+}
+
+// doCounter handles Increment and Decrement. Like memcached, counters are
+// stored as decimal strings, so they can also be read using get. Incrementing
+// wraps around at 2^64, and decrementing stops at 0.
+func (s *MemcachedBinaryServer) doCounter(req *mcbHeader, extras, key, val []byte, w *bufio.Writer) error {
+	if len(extras) != 20 || len(val) != 0 {
+		return errMcbInvalidArgs
+	} else if err := s.checkKey(key); err != nil {
+		return err
+	} else if req.cas != 0 {
+		return errMcbCas
+	} else if s.readOnly {
+		return errMcbReadOnly
+	}
+	delta := binary.BigEndian.Uint64(extras)
+	initial := binary.BigEndian.Uint64(extras[8:])
+	expiration := binary.BigEndian.Uint32(extras[16:])
+
+	var counter uint64
+	var err error
+	s.c.Atomically(func(tx *dory.Txn) {
+		var buf [32]byte
+		cur := tx.Get(key, buf[:0])
+		if cur == nil {
+			if expiration == mcbCounterExpiryNoCreate {
+				err = errMcbKeyNotFound
+				return
+			}
+			counter = initial
+			ttl := s.expirationToTTL(expiration)
+			if ttl < 0 {
+				tx.Delete(key)
+				return
+			}
+			err = tx.PutWithTTL(key, strconv.AppendUint(buf[:0], counter, 10), ttl)
+			return
+		}
+
+		counter, err = strconv.ParseUint(string(cur), 10, 64)
+		if err != nil {
+			err = errMcbNonNumeric
+			return
+		}
+		if req.opcode == mcbOpIncrement {
+			counter += delta
+		} else if delta > counter {
+			counter = 0
+		} else {
+			counter -= delta
+		}
+		// Keep the counter's existing expiry.
+		err = tx.PutWithTTL(key, strconv.AppendUint(buf[:0], counter, 10), tx.TTL(key))
+	})
+	if statusErr, ok := err.(*mcbStatusError); ok {
+		return statusErr
+	} else if err == dory.ErrSoftLimit {
+		return errMcbOutOfMemory
+	} else if err != nil {
+		return errMcbInternal
+	}
+	var resp [8]byte
+	binary.BigEndian.PutUint64(resp[:], counter)
+	return s.writeResponse(w, req, mcbStatusOk, nil, resp[:])
+}
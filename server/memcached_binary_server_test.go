@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akmistry/dory"
+)
+
+func newTestMemcachedBinaryServer() *MemcachedBinaryServer {
+	return NewMemcachedBinaryServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:  1024 * 1024,
+		MaxKeySize: 1024,
+		MaxValSize: 1024,
+	}))
+}
+
+func mcbRequest(opcode byte, opaque uint32, extras, key, val []byte) []byte {
+	req := mcbHeader{
+		magic:     mcbMagicRequest,
+		opcode:    opcode,
+		keyLen:    uint16(len(key)),
+		extrasLen: uint8(len(extras)),
+		bodyLen:   uint32(len(extras) + len(key) + len(val)),
+		opaque:    opaque,
+	}
+	buf := make([]byte, mcbHeaderLen)
+	req.encode(buf)
+	buf = append(buf, extras...)
+	buf = append(buf, key...)
+	return append(buf, val...)
+}
+
+func mcbStoreExtras(flags, expiration uint32) []byte {
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras, flags)
+	binary.BigEndian.PutUint32(extras[4:], expiration)
+	return extras
+}
+
+func mcbCounterExtras(delta, initial uint64, expiration uint32) []byte {
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras, delta)
+	binary.BigEndian.PutUint64(extras[8:], initial)
+	binary.BigEndian.PutUint32(extras[16:], expiration)
+	return extras
+}
+
+type mcbResponse struct {
+	header mcbHeader
+	extras []byte
+	val    []byte
+}
+
+func readMcbResponses(t *testing.T, buf []byte) []mcbResponse {
+	var resps []mcbResponse
+	for len(buf) > 0 {
+		var resp mcbResponse
+		resp.header.decode(buf)
+		assert.Equal(t, byte(mcbMagicResponse), resp.header.magic)
+		body := buf[mcbHeaderLen : mcbHeaderLen+int(resp.header.bodyLen)]
+		resp.extras = body[:resp.header.extrasLen]
+		resp.val = body[resp.header.extrasLen:]
+		resps = append(resps, resp)
+		buf = buf[mcbHeaderLen+int(resp.header.bodyLen):]
+	}
+	return resps
+}
+
+func serveMcb(t *testing.T, s *MemcachedBinaryServer, reqs ...[]byte) []mcbResponse {
+	var out bytes.Buffer
+	err := s.Serve(testConn{bytes.NewReader(bytes.Join(reqs, nil)), &out})
+	assert.NoError(t, err)
+	resps := readMcbResponses(t, out.Bytes())
+	assert.Equal(t, len(reqs), len(resps))
+	for i, resp := range resps {
+		assert.Equal(t, uint32(i), resp.header.opaque)
+	}
+	return resps
+}
+
+func TestMemcachedBinaryServer(t *testing.T) {
+	s := newTestMemcachedBinaryServer()
+	key := []byte("foo")
+	resps := serveMcb(t, s,
+		mcbRequest(mcbOpGet, 0, nil, key, nil),
+		mcbRequest(mcbOpSet, 1, mcbStoreExtras(0, 0), key, []byte("bar")),
+		mcbRequest(mcbOpGet, 2, nil, key, nil),
+		mcbRequest(mcbOpAdd, 3, mcbStoreExtras(0, 0), key, []byte("baz")),
+		mcbRequest(mcbOpReplace, 4, mcbStoreExtras(0, 0), key, []byte("baz")),
+		mcbRequest(mcbOpReplace, 5, mcbStoreExtras(0, 0), []byte("missing"), []byte("baz")),
+		mcbRequest(mcbOpDelete, 6, nil, key, nil),
+		mcbRequest(mcbOpDelete, 7, nil, key, nil),
+		mcbRequest(mcbOpAdd, 8, mcbStoreExtras(0, 0), key, []byte("qux")),
+		mcbRequest(mcbOpNoop, 9, nil, nil, nil),
+		mcbRequest(mcbOpSet, 10, mcbStoreExtras(1, 0), key, []byte("bar")),
+		mcbRequest(mcbOpSet, 11, mcbStoreExtras(0, 0), key, []byte(strings.Repeat("x", 2000))),
+		mcbRequest(0x42, 12, nil, nil, nil),
+		mcbRequest(mcbOpGet, 13, nil, key, nil),
+	)
+
+	expectedStatus := []uint16{
+		mcbStatusKeyNotFound, mcbStatusOk, mcbStatusOk, mcbStatusKeyExists,
+		mcbStatusOk, mcbStatusKeyNotFound, mcbStatusOk, mcbStatusKeyNotFound,
+		mcbStatusOk, mcbStatusOk, mcbStatusOk, mcbStatusValueTooLarge,
+		mcbStatusUnknownCommand, mcbStatusOk,
+	}
+	for i, resp := range resps {
+		assert.Equal(t, expectedStatus[i], resp.header.status, "request %d", i)
+	}
+	assert.Equal(t, []byte{0, 0, 0, 0}, resps[2].extras)
+	assert.Equal(t, []byte("bar"), resps[2].val)
+	assert.Equal(t, []byte{0, 0, 0, 1}, resps[13].extras)
+	assert.Equal(t, []byte("bar"), resps[13].val)
+}
+
+func TestMemcachedBinaryServer_Counter(t *testing.T) {
+	s := newTestMemcachedBinaryServer()
+	key := []byte("counter")
+	resps := serveMcb(t, s,
+		mcbRequest(mcbOpIncrement, 0, mcbCounterExtras(1, 0, mcbCounterExpiryNoCreate), key, nil),
+		mcbRequest(mcbOpIncrement, 1, mcbCounterExtras(1, 10, 0), key, nil),
+		mcbRequest(mcbOpIncrement, 2, mcbCounterExtras(5, 10, 0), key, nil),
+		mcbRequest(mcbOpDecrement, 3, mcbCounterExtras(3, 10, 0), key, nil),
+		mcbRequest(mcbOpDecrement, 4, mcbCounterExtras(100, 10, 0), key, nil),
+		mcbRequest(mcbOpGet, 5, nil, key, nil),
+		mcbRequest(mcbOpSet, 6, mcbStoreExtras(0, 0), key, []byte("abc")),
+		mcbRequest(mcbOpIncrement, 7, mcbCounterExtras(1, 0, 0), key, nil),
+	)
+
+	assert.Equal(t, uint16(mcbStatusKeyNotFound), resps[0].header.status)
+	for i, expected := range []uint64{10, 15, 12, 0} {
+		resp := resps[i+1]
+		assert.Equal(t, uint16(mcbStatusOk), resp.header.status)
+		assert.Equal(t, expected, binary.BigEndian.Uint64(resp.val))
+	}
+	assert.Equal(t, []byte("0"), resps[5].val)
+	assert.Equal(t, uint16(mcbStatusNonNumeric), resps[7].header.status)
+}
+
+func TestMemcachedBinaryServer_ReadOnly(t *testing.T) {
+	s := newTestMemcachedBinaryServer()
+	s.SetReadOnly()
+	key := []byte("foo")
+	resps := serveMcb(t, s,
+		mcbRequest(mcbOpSet, 0, mcbStoreExtras(0, 0), key, []byte("bar")),
+		mcbRequest(mcbOpDelete, 1, nil, key, nil),
+		mcbRequest(mcbOpIncrement, 2, mcbCounterExtras(1, 0, 0), key, nil),
+		mcbRequest(mcbOpGet, 3, nil, key, nil),
+	)
+	for _, resp := range resps[:3] {
+		assert.Equal(t, uint16(mcbStatusNotSupported), resp.header.status)
+	}
+	assert.Equal(t, uint16(mcbStatusKeyNotFound), resps[3].header.status)
+}
+
+func TestMemcachedBinaryServer_InvalidMagic(t *testing.T) {
+	s := newTestMemcachedBinaryServer()
+	req := mcbRequest(mcbOpNoop, 0, nil, nil, nil)
+	req[0] = 0x42
+	err := s.Serve(testConn{bytes.NewReader(req), &bytes.Buffer{}})
+	assert.Error(t, err)
+}
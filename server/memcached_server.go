@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/akmistry/go-util/bufferpool"
+
+	"github.com/akmistry/dory"
+)
+
+const (
+	// Maximum length of a command line, not including data blocks.
+	memcachedMaxLineLength = 64 * 1024
+
+	// Expiry times larger than this are absolute Unix times, instead of
+	// relative to now.
+	memcachedMaxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+var (
+	mcCmdGet     = []byte("get")
+	mcCmdSet     = []byte("set")
+	mcCmdAdd     = []byte("add")
+	mcCmdReplace = []byte("replace")
+	mcCmdDelete  = []byte("delete")
+	mcCmdStats   = []byte("stats")
+	mcNoReply    = []byte("noreply")
+
+	mcResponseStored    = []byte("STORED\r\n")
+	mcResponseNotStored = []byte("NOT_STORED\r\n")
+	mcResponseDeleted   = []byte("DELETED\r\n")
+	mcResponseNotFound  = []byte("NOT_FOUND\r\n")
+	mcResponseEnd       = []byte("END\r\n")
+	mcResponseError     = []byte("ERROR\r\n")
+)
+
+// mcError is an error reply to a memcached command, such as CLIENT_ERROR or
+// SERVER_ERROR. Like respError, it does not terminate the connection.
+type mcError struct {
+	msg string
+}
+
+func (e *mcError) Error() string {
+	return e.msg
+}
+
+var errMcReadOnly = &mcError{"SERVER_ERROR read only replica"}
+
+func mcClientError(format string, a ...interface{}) error {
+	return &mcError{"CLIENT_ERROR " + fmt.Sprintf(format, a...)}
+}
+
+func mcServerError(format string, a ...interface{}) error {
+	return &mcError{"SERVER_ERROR " + fmt.Sprintf(format, a...)}
+}
+
+// MemcachedServer serves a subset of the memcached text protocol: get, set,
+// add, replace, delete and stats.
+type MemcachedServer struct {
+	c           *dory.Memcache
+	readBufSize int
+	start       time.Time
+	nowFunc     func() time.Time
+
+	// Whether writes are rejected, because the cache is a read replica.
+	readOnly bool
+}
+
+func NewMemcachedServer(c *dory.Memcache) *MemcachedServer {
+	return &MemcachedServer{
+		c:           c,
+		readBufSize: defaultReadBufferSize,
+		start:       time.Now(),
+		nowFunc:     time.Now,
+	}
+}
+
+// SetReadOnly rejects commands which modify the cache, for read replicas.
+func (s *MemcachedServer) SetReadOnly() {
+	s.readOnly = true
+}
+
+// Reads a line terminated by CRLF, or LF. The returned slice is only valid
+// until the next read from r.
+func (s *MemcachedServer) readLine(r *bufio.Reader) ([]byte, error) {
+	var out []byte
+	for {
+		buf, err := r.ReadSlice('\n')
+		if len(out)+len(buf) > memcachedMaxLineLength {
+			return nil, fmt.Errorf("MemcachedServer: line length > max %d",
+				memcachedMaxLineLength)
+		}
+		if err == bufio.ErrBufferFull {
+			out = append(out, buf...)
+			continue
+		} else if err != nil {
+			if err == io.EOF && len(out)+len(buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if out != nil {
+			buf = append(out, buf...)
+		}
+		buf = buf[:len(buf)-1]
+		if len(buf) > 0 && buf[len(buf)-1] == '\r' {
+			buf = buf[:len(buf)-1]
+		}
+		return buf, nil
+	}
+}
+
+func (s *MemcachedServer) Serve(conn io.ReadWriter) error {
+	bufr := bufio.NewReaderSize(conn, s.readBufSize)
+	bufw := bufio.NewWriter(conn)
+	var lineBuf []byte
+	for {
+		line, err := s.readLine(bufr)
+		if err == io.EOF {
+			// Connection closed. Non-error.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Copy the line, since it may be overwritten by reading a data block.
+		lineBuf = append(lineBuf[:0], line...)
+		line = lineBuf
+
+		err = s.doCommand(bytes.Fields(line), bufr, bufw)
+		if cmdErr, ok := err.(*mcError); ok {
+			err = s.writeLine(bufw, cmdErr.msg)
+		}
+		if err == nil && bufr.Buffered() == 0 {
+			err = bufw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *MemcachedServer) writeLine(w *bufio.Writer, line string) error {
+	_, err := w.WriteString(line)
+	if err == nil {
+		_, err = w.Write(respCrlf)
+	}
+	return err
+}
+
+func (s *MemcachedServer) doCommand(args [][]byte, r *bufio.Reader, w *bufio.Writer) error {
+	if len(args) == 0 {
+		_, err := w.Write(mcResponseError)
+		return err
+	}
+
+	cmd := args[0]
+	if bytes.Equal(cmd, mcCmdGet) {
+		return s.doGet(args[1:], w)
+	} else if bytes.Equal(cmd, mcCmdSet) || bytes.Equal(cmd, mcCmdAdd) || bytes.Equal(cmd, mcCmdReplace) {
+		return s.doStore(cmd, args[1:], r, w)
+	} else if bytes.Equal(cmd, mcCmdDelete) {
+		return s.doDelete(args[1:], w)
+	} else if bytes.Equal(cmd, mcCmdStats) {
+		return s.doStats(args[1:], w)
+	}
+	_, err := w.Write(mcResponseError)
+	return err
+}
+
+func (s *MemcachedServer) checkKey(key []byte) error {
+	if len(key) > s.c.MaxKeySize() {
+		return mcClientError("key too long")
+	}
+	return nil
+}
+
+// Converts an error from validateKeyVal into the response memcached gives for
+// the same condition.
+func mcSizeError(err *sizeError) error {
+	if err.key && err.tooLarge {
+		return mcClientError("key too long")
+	} else if !err.key && err.tooLarge {
+		return mcServerError("object too large for cache")
+	}
+	return mcClientError("%s", err.msg)
+}
+
+// Removes a trailing noreply argument, returning whether it was present.
+func stripNoReply(args [][]byte) ([][]byte, bool) {
+	if len(args) > 0 && bytes.Equal(args[len(args)-1], mcNoReply) {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+func (s *MemcachedServer) doGet(keys [][]byte, w *bufio.Writer) error {
+	if len(keys) == 0 {
+		_, err := w.Write(mcResponseError)
+		return err
+	}
+	for _, key := range keys {
+		if err := s.checkKey(key); err != nil {
+			return err
+		}
+	}
+
+	getBuf := bufferpool.GetUninit(getBufSize(s.c))
+	defer bufferpool.Put(getBuf)
+	for _, key := range keys {
+		val, flags := s.c.GetWithFlags(key, (*getBuf)[:0])
+		if val == nil {
+			continue
+		}
+		_, err := fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, flags, len(val))
+		if err == nil {
+			_, err = w.Write(val)
+		}
+		if err == nil {
+			_, err = w.Write(respCrlf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(mcResponseEnd)
+	return err
+}
+
+// Returns the TTL for a memcached expiry time. A zero TTL means the entry
+// never expires, and a negative TTL means it has already expired.
+func (s *MemcachedServer) exptimeToTTL(exptime int64) time.Duration {
+	if exptime == 0 {
+		return 0
+	} else if exptime < 0 {
+		return -1
+	} else if exptime <= memcachedMaxRelativeExptime {
+		return time.Duration(exptime) * time.Second
+	}
+	ttl := time.Unix(exptime, 0).Sub(s.nowFunc())
+	if ttl <= 0 {
+		return -1
+	}
+	return ttl
+}
+
+// doStore handles set, add and replace.
+func (s *MemcachedServer) doStore(cmd []byte, args [][]byte, r *bufio.Reader, w *bufio.Writer) error {
+	args, noReply := stripNoReply(args)
+	if len(args) != 4 {
+		_, err := w.Write(mcResponseError)
+		return err
+	}
+	length, err := strconv.Atoi(string(args[3]))
+	if err != nil || length < 0 {
+		return mcClientError("bad data chunk")
+	}
+
+	// The data block is always consumed, even if the command is rejected, so
+	// that it isn't interpreted as a command.
+	if length > s.c.MaxValSize() {
+		_, err = r.Discard(length + 2)
+		if err != nil {
+			return err
+		}
+		return mcServerError("object too large for cache")
+	}
+	allocLen := length + 2
+	if allocLen < (1 << bufferpool.MinSizeBits) {
+		allocLen = (1 << bufferpool.MinSizeBits)
+	}
+	buf := bufferpool.GetUninit(allocLen)
+	defer bufferpool.Put(buf)
+	*buf = (*buf)[:length+2]
+	_, err = io.ReadFull(r, *buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(*buf, respCrlf) {
+		// Skip the rest of the line, to resync with the next command.
+		_, err = s.readLine(r)
+		if err != nil {
+			return err
+		}
+		return mcClientError("bad data chunk")
+	}
+	val := (*buf)[:length]
+	if s.readOnly {
+		return errMcReadOnly
+	}
+
+	key := args[0]
+	if err := validateKeyVal(s.c, key, val); err != nil {
+		return mcSizeError(err.(*sizeError))
+	}
+	flags, err := strconv.ParseUint(string(args[1]), 10, 32)
+	if err != nil {
+		return mcClientError("bad command line format")
+	}
+	exptime, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return mcClientError("bad command line format")
+	}
+
+	ttl := s.exptimeToTTL(exptime)
+	stored := true
+	if ttl < 0 {
+		// Storing an already expired item just removes any existing item.
+		s.c.Atomically(func(tx *dory.Txn) {
+			exists := tx.Has(key)
+			if (bytes.Equal(cmd, mcCmdAdd) && exists) || (bytes.Equal(cmd, mcCmdReplace) && !exists) {
+				stored = false
+				return
+			}
+			tx.Delete(key)
+		})
+	} else {
+		s.c.Atomically(func(tx *dory.Txn) {
+			if bytes.Equal(cmd, mcCmdAdd) {
+				stored, err = tx.Add(key, val, ttl)
+			} else if bytes.Equal(cmd, mcCmdReplace) {
+				stored, err = tx.Replace(key, val, ttl)
+			} else {
+				err = tx.PutWithTTL(key, val, ttl)
+			}
+			if stored && err == nil && flags != 0 {
+				tx.SetFlags(key, uint32(flags))
+			}
+		})
+	}
+	if errors.Is(err, dory.ErrTooLarge) {
+		return mcServerError("object too large for cache")
+	} else if err == dory.ErrSoftLimit {
+		return mcServerError("out of memory storing object")
+	} else if err != nil {
+		return mcServerError("%v", err)
+	}
+	if noReply {
+		return nil
+	} else if !stored {
+		_, err = w.Write(mcResponseNotStored)
+		return err
+	}
+	_, err = w.Write(mcResponseStored)
+	return err
+}
+
+func (s *MemcachedServer) doDelete(args [][]byte, w *bufio.Writer) error {
+	args, noReply := stripNoReply(args)
+	if len(args) != 1 {
+		_, err := w.Write(mcResponseError)
+		return err
+	}
+	if s.readOnly {
+		return errMcReadOnly
+	}
+	key := args[0]
+	if err := s.checkKey(key); err != nil {
+		return err
+	}
+
+	found := false
+	s.c.Atomically(func(tx *dory.Txn) {
+		found = tx.Has(key)
+		if found {
+			tx.Delete(key)
+		}
+	})
+	if noReply {
+		return nil
+	} else if !found {
+		_, err := w.Write(mcResponseNotFound)
+		return err
+	}
+	_, err := w.Write(mcResponseDeleted)
+	return err
+}
+
+func (s *MemcachedServer) doStats(args [][]byte, w *bufio.Writer) error {
+	if len(args) != 0 {
+		// Only general-purpose statistics are supported.
+		_, err := w.Write(mcResponseEnd)
+		return err
+	}
+
+	now := s.nowFunc()
+	stats := s.c.Stats()
+	_, err := fmt.Fprintf(w, "STAT pid %d\r\n"+
+		"STAT uptime %d\r\n"+
+		"STAT time %d\r\n"+
+		"STAT curr_items %d\r\n"+
+		"STAT bytes %d\r\n"+
+		"STAT limit_maxbytes %d\r\n",
+		os.Getpid(), int64(now.Sub(s.start)/time.Second), now.Unix(),
+		stats.Keys, stats.TableMem, stats.MaxTableMem)
+	if err == nil {
+		_, err = w.Write(mcResponseEnd)
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akmistry/dory"
+)
+
+func newTestMemcachedServer() *MemcachedServer {
+	return NewMemcachedServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:  1024 * 1024,
+		MaxKeySize: 1024,
+		MaxValSize: 1024,
+	}))
+}
+
+func TestMemcachedServer(t *testing.T) {
+	s := newTestMemcachedServer()
+	input := "set foo 0 0 3\r\nbar\r\n" +
+		"set baz 0 0 5 noreply\r\nhello\r\n" +
+		"get foo missing baz\r\n" +
+		"delete foo\r\n" +
+		"delete foo\r\n" +
+		"get foo\r\n" +
+		"set big 0 0 2000\r\n" + strings.Repeat("x", 2000) + "\r\n" +
+		"set flagged 4294967295 0 1\r\nx\r\n" +
+		"get flagged\r\n" +
+		"set flagged 0 0 1\r\ny\r\n" +
+		"get flagged\r\n" +
+		"set flagged 4294967296 0 1\r\nz\r\n" +
+		"set bad 0 0 1\r\nxyz\r\n" +
+		"bogus\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "STORED\r\n"+
+		"VALUE foo 0 3\r\nbar\r\nVALUE baz 0 5\r\nhello\r\nEND\r\n"+
+		"DELETED\r\n"+
+		"NOT_FOUND\r\n"+
+		"END\r\n"+
+		"SERVER_ERROR object too large for cache\r\n"+
+		"STORED\r\nVALUE flagged 4294967295 1\r\nx\r\nEND\r\n"+
+		"STORED\r\nVALUE flagged 0 1\r\ny\r\nEND\r\n"+
+		"CLIENT_ERROR bad command line format\r\n"+
+		"CLIENT_ERROR bad data chunk\r\n"+
+		"ERROR\r\n", out.String())
+}
+
+func TestMemcachedServer_AddReplace(t *testing.T) {
+	s := newTestMemcachedServer()
+	input := "replace foo 0 0 3\r\nbar\r\n" +
+		"add foo 0 0 3\r\nbar\r\n" +
+		"add foo 0 0 3\r\nbaz\r\n" +
+		"replace foo 0 0 3\r\nqux\r\n" +
+		"get foo\r\n" +
+		"replace foo 0 -1 3\r\nqux\r\n" +
+		"get foo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "NOT_STORED\r\nSTORED\r\nNOT_STORED\r\nSTORED\r\n"+
+		"VALUE foo 0 3\r\nqux\r\nEND\r\n"+
+		"STORED\r\nEND\r\n", out.String())
+}
+
+func TestMemcachedServer_Exptime(t *testing.T) {
+	s := newTestMemcachedServer()
+	now := time.Unix(1700000000, 0)
+	s.nowFunc = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), s.exptimeToTTL(0))
+	assert.Equal(t, 10*time.Second, s.exptimeToTTL(10))
+	assert.Equal(t, 100*time.Second, s.exptimeToTTL(now.Unix()+100))
+	assert.True(t, s.exptimeToTTL(now.Unix()-100) < 0)
+	assert.True(t, s.exptimeToTTL(-1) < 0)
+
+	input := "set foo 0 0 3\r\nbar\r\n" +
+		"set foo 0 -1 3\r\nbar\r\n" +
+		"get foo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "STORED\r\nSTORED\r\nEND\r\n", out.String())
+}
+
+func TestMemcachedServer_KeyValSize(t *testing.T) {
+	s := newTestMemcachedServer()
+	key := strings.Repeat("k", 1025)
+	input := "set foo 0 0 0\r\n\r\n" +
+		"set " + key + " 0 0 3\r\nbar\r\n" +
+		"get foo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "CLIENT_ERROR value is shorter than min size 1\r\n"+
+		"CLIENT_ERROR key too long\r\n"+
+		"END\r\n", out.String())
+}
+
+func TestMemcachedServer_ChunkedValue(t *testing.T) {
+	// Values larger than the pooled get buffer are appended to it, growing it.
+	s := NewMemcachedServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:         1024 * 1024,
+		MaxKeySize:        1024,
+		MaxValSize:        1024,
+		MaxChunkedValSize: 4 * streamValSize,
+	}))
+	val := strings.Repeat("x", 2*streamValSize)
+	input := fmt.Sprintf("set big 0 0 %d\r\n%s\r\nget big\r\n", len(val), val)
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("STORED\r\nVALUE big 0 %d\r\n%s\r\nEND\r\n", len(val), val), out.String())
+}
+
+func TestMemcachedServer_Stats(t *testing.T) {
+	s := newTestMemcachedServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader("set foo 0 0 3\r\nbar\r\nstats\r\n"), &out})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "STAT curr_items 1\r\n")
+	assert.True(t, strings.HasSuffix(out.String(), "END\r\n"))
+}
+
+func TestMemcachedServer_ReadOnly(t *testing.T) {
+	s := newTestMemcachedServer()
+	s.SetReadOnly()
+	input := "set foo 0 0 3\r\nbar\r\n" +
+		"delete foo\r\n" +
+		"get foo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "SERVER_ERROR read only replica\r\n"+
+		"SERVER_ERROR read only replica\r\n"+
+		"END\r\n", out.String())
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	netReadBytes = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_net_read_bytes_total",
+		Help: "Number of bytes read from client connections.",
+	})
+	netWriteBytes = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_net_write_bytes_total",
+		Help: "Number of bytes written to client connections.",
+	})
+)
+
+func init() {
+	prom.MustRegister(netReadBytes)
+	prom.MustRegister(netWriteBytes)
+}
+
+// CountingConn wraps a connection, counting the bytes read from and written to
+// it. Counts are also added to the process-wide bandwidth metrics.
+type CountingConn struct {
+	conn         io.ReadWriter
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// NewCountingConn returns a CountingConn wrapping conn. A CountingConn can
+// only be used by a single goroutine.
+func NewCountingConn(conn io.ReadWriter) *CountingConn {
+	return &CountingConn{conn: conn}
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	if n > 0 {
+		c.bytesRead += int64(n)
+		netReadBytes.Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.conn.Write(p)
+	if n > 0 {
+		c.bytesWritten += int64(n)
+		netWriteBytes.Add(float64(n))
+	}
+	return n, err
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *CountingConn) BytesRead() int64 {
+	return c.bytesRead
+}
+
+// BytesWritten returns the number of bytes written to the connection.
+func (c *CountingConn) BytesWritten() int64 {
+	return c.bytesWritten
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountingConn(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+
+	s := newTestServer()
+	var out bytes.Buffer
+	conn := NewCountingConn(testConn{strings.NewReader(input), &out})
+	err := s.Serve(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n", out.String())
+	assert.Equal(t, int64(len(input)), conn.BytesRead())
+	assert.Equal(t, int64(out.Len()), conn.BytesWritten())
+}
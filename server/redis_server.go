@@ -5,10 +5,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/akmistry/go-util/bufferpool"
+	prom "github.com/prometheus/client_golang/prometheus"
 
 	"github.com/akmistry/dory"
 )
@@ -24,18 +28,96 @@ const (
 	respStringMaxLength = 64 * 1024
 	respBulkMaxLength   = 8 * 1024 * 1024
 	respArrayMaxLength  = 64
+	respMaxQueued       = 1024
+
+	// Bulk strings at least this large are read into an exactly sized
+	// allocation, instead of a pooled buffer. Pooled buffers are rounded up to
+	// a power of 2 and retained by the pool, which for multi-MB values can
+	// double the memory used while storing them.
+	respLargeBulkLength = 64 * 1024
+
+	// Default size of the per-connection read buffer. Lines longer than this
+	// are read across multiple buffer fills.
+	defaultReadBufferSize = 4096
+
+	// Default size of the per-connection write buffer, and the range of sizes
+	// clients can request with SET-BUFFER-SIZE.
+	defaultWriteBufferSize = 4096
+	minWriteBufferSize     = 256
+	maxWriteBufferSize     = 1024 * 1024
+
+	// Values larger than this are streamed by GET, instead of being copied
+	// into a buffer first.
+	streamValSize = 1024 * 1024
 )
 
 var (
 	respCrlf = []byte{'\r', '\n'}
 
 	respResponseOk           = []byte{'+', 'O', 'K', '\r', '\n'}
+	respResponseQueued       = []byte("+QUEUED\r\n")
+	respResponseEvicted      = []byte("+EVICTED\r\n")
 	respResponseBulkArrayNil = []byte{'$', '-', '1', '\r', '\n'}
 
-	respCmdSet    = []byte{'s', 'e', 't'}
-	respCmdGet    = []byte{'g', 'e', 't'}
-	respCmdDel    = []byte{'d', 'e', 'l'}
-	respCmdExists = []byte{'e', 'x', 'i', 's', 't', 's'}
+	respCmdSet       = []byte{'s', 'e', 't'}
+	respCmdGet       = []byte{'g', 'e', 't'}
+	respCmdDel       = []byte{'d', 'e', 'l'}
+	respCmdExists    = []byte{'e', 'x', 'i', 's', 't', 's'}
+	respCmdMset      = []byte{'m', 's', 'e', 't'}
+	respCmdGetRange  = []byte("getrange")
+	respCmdStrlen    = []byte("strlen")
+	respCmdSetRange  = []byte("setrange")
+	respCmdAdd       = []byte{'a', 'd', 'd'}
+	respCmdReplace   = []byte{'r', 'e', 'p', 'l', 'a', 'c', 'e'}
+	respCmdDebug     = []byte{'d', 'e', 'b', 'u', 'g'}
+	respCmdObject    = []byte{'o', 'b', 'j', 'e', 'c', 't'}
+	respCmdWasCached = []byte("wascached")
+	respCmdCommand   = []byte("command")
+	respCmdMemory    = []byte("memory")
+	respCmdEvict     = []byte("evict")
+	respCmdSetFlags  = []byte("setflags")
+	respCmdGetFlags  = []byte("getflags")
+	respCmdConfig    = []byte("config")
+
+	respCmdMulti   = []byte{'m', 'u', 'l', 't', 'i'}
+	respCmdExec    = []byte{'e', 'x', 'e', 'c'}
+	respCmdDiscard = []byte{'d', 'i', 's', 'c', 'a', 'r', 'd'}
+	respCmdWatch   = []byte{'w', 'a', 't', 'c', 'h'}
+	respCmdUnwatch = []byte{'u', 'n', 'w', 'a', 't', 'c', 'h'}
+
+	respCmdWatchEvictions = []byte("watch-evictions")
+	respCmdSetBufferSize  = []byte("set-buffer-size")
+	respPushEvicted       = []byte("evicted")
+
+	// Pub/sub commands, which aren't supported. Clients which try to subscribe
+	// get a clear error instead of an unknown command error.
+	respPubSubCmds = [][]byte{
+		[]byte("subscribe"), []byte("psubscribe"), []byte("ssubscribe"),
+		[]byte("unsubscribe"), []byte("punsubscribe"), []byte("sunsubscribe"),
+		[]byte("publish"), []byte("spublish"), []byte("pubsub"),
+	}
+
+	respSetEx      = []byte{'e', 'x'}
+	respSetPx      = []byte{'p', 'x'}
+	respSetKeepTTL = []byte("keepttl")
+
+	respDebugReclaim = []byte{'r', 'e', 'c', 'l', 'a', 'i', 'm'}
+	respDebugSleep   = []byte{'s', 'l', 'e', 'e', 'p'}
+	respDebugObject  = []byte{'o', 'b', 'j', 'e', 'c', 't'}
+	respDebugTables  = []byte("tables")
+	respDebugHotKeys = []byte("hotkeys")
+
+	respConfigGet       = []byte("get")
+	respConfigSet       = []byte("set")
+	respConfigMaxMemory = []byte("maxmemory")
+
+	respObjectIdletime = []byte("idletime")
+	respObjectFreq     = []byte("freq")
+
+	respCommandCount = []byte("count")
+
+	respMemoryUsage = []byte("usage")
+	respMemoryStats = []byte("stats")
 
 	respArrayPool = sync.Pool{New: func() interface{} {
 		return &respArray{
@@ -43,24 +125,342 @@ var (
 			vals: make([]interface{}, 0, 4),
 		}
 	}}
+
+	pipelineDepth = prom.NewHistogram(prom.HistogramOpts{
+		Name:    "dory_resp_pipeline_depth",
+		Help:    "Number of commands processed between response flushes.",
+		Buckets: prom.ExponentialBuckets(1, 2, 10),
+	})
 )
 
+func init() {
+	prom.MustRegister(pipelineDepth)
+}
+
+// respError is an error message, either read from a client, or returned by a
+// command. Errors returned by commands are sent to the client as an error
+// reply, and do not terminate the connection.
 type respError struct {
 	msg string
 }
 
+func (e *respError) Error() string {
+	return e.msg
+}
+
+var (
+	errReadOnly  = &respError{"READONLY You can't write against a read only replica."}
+	errSoftLimit = &respError{"OOM write rejected, cache is at its soft memory limit"}
+)
+
+func commandError(format string, a ...interface{}) error {
+	return &respError{"ERR " + fmt.Sprintf(format, a...)}
+}
+
+func wrongArgsError(cmd string) error {
+	return commandError("wrong number of arguments for '%s' command", cmd)
+}
+
+// putError returns the error to reply with when storing a value fails with
+// err, so that clients aren't told a failed write succeeded.
+func putError(err error) error {
+	if err == dory.ErrSoftLimit {
+		return errSoftLimit
+	} else if _, ok := err.(*respError); ok {
+		return err
+	}
+	return commandError("%v", err)
+}
+
+// Returns an error if key or val is outside the sizes the cache will store.
+func (s *RedisServer) checkKeyVal(c dory.Cache, key, val []byte) error {
+	if err := validateKeyVal(c, key, val); err != nil {
+		return commandError("%v", err)
+	}
+	return nil
+}
+
 type respArray struct {
 	vals []interface{}
 }
 
+// cacheOps is the set of cache operations used by commands, implemented by
+// both dory.Memcache and dory.Txn.
+type cacheOps interface {
+	Has(key []byte) bool
+	Get(key, buf []byte) []byte
+	Put(key, val []byte) error
+	PutWithTTL(key, val []byte, ttl time.Duration) error
+	PutEvicting(key, val []byte, ttl time.Duration) (bool, error)
+	PutBatch(keys, vals [][]byte) error
+	Stat(key []byte) (int, bool)
+	GetRange(key []byte, start, end int, buf []byte) ([]byte, bool)
+	SetRange(key []byte, offset int, val []byte) (int, error)
+	Add(key, val []byte, ttl time.Duration) (bool, error)
+	Replace(key, val []byte, ttl time.Duration) (bool, error)
+	Delete(key []byte)
+}
+
+// basicCacheOps implements cacheOps for a dory.Cache which isn't a
+// dory.Memcache. Only the operations used by basic commands are fully
+// supported, and TTLs are not. Operations which can be built from Get and Put
+// are, and the rest return errUnsupportedOp, rather than panicking, in case a
+// command using them is reached.
+type basicCacheOps struct {
+	dory.Cache
+}
+
+var errUnsupportedOp = commandError("operation is not supported by this cache")
+
+func (c basicCacheOps) PutWithTTL(key, val []byte, ttl time.Duration) error {
+	return c.Put(key, val)
+}
+
+func (c basicCacheOps) PutEvicting(key, val []byte, ttl time.Duration) (bool, error) {
+	return false, c.Put(key, val)
+}
+
+func (c basicCacheOps) PutBatch(keys, vals [][]byte) error {
+	var firstErr error
+	for i := range keys {
+		if err := c.Put(keys[i], vals[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c basicCacheOps) Stat(key []byte) (int, bool) {
+	val := c.Get(key, nil)
+	return len(val), val != nil
+}
+
+func (c basicCacheOps) GetRange(key []byte, start, end int, buf []byte) ([]byte, bool) {
+	val := c.Get(key, nil)
+	if val == nil {
+		return nil, false
+	}
+	// Same as dory.Memcache.GetRange.
+	if start < 0 {
+		start += len(val)
+	}
+	if end < 0 {
+		end += len(val)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= len(val) {
+		end = len(val) - 1
+	}
+	if buf == nil {
+		buf = []byte{}
+	}
+	if start > end {
+		return buf, true
+	}
+	return append(buf, val[start:end+1]...), true
+}
+
+func (c basicCacheOps) SetRange(key []byte, offset int, val []byte) (int, error) {
+	return 0, errUnsupportedOp
+}
+
+func (c basicCacheOps) Add(key, val []byte, ttl time.Duration) (bool, error) {
+	return false, errUnsupportedOp
+}
+
+func (c basicCacheOps) Replace(key, val []byte, ttl time.Duration) (bool, error) {
+	return false, errUnsupportedOp
+}
+
+// connState is the per-connection state of a transaction started by MULTI.
+type connState struct {
+	inMulti bool
+	queued  []*respArray
+
+	// Keys watched by WATCH, and their versions when they were watched, in
+	// watchCache. EXEC is aborted if any of them has changed.
+	watched    map[string]uint64
+	watchCache *dory.Memcache
+
+	// Set once the connection has issued WATCH-EVICTIONS, after which it only
+	// receives eviction notifications.
+	watchEvictions bool
+
+	// Write buffer size requested by SET-BUFFER-SIZE, or 0 if none.
+	writeBufSize int
+}
+
+func (st *connState) reset() {
+	for _, cmd := range st.queued {
+		freeRespArray(cmd)
+	}
+	st.queued = st.queued[:0]
+	st.inMulti = false
+	st.unwatch()
+}
+
+// Stops watching all keys watched by WATCH.
+func (st *connState) unwatch() {
+	for key := range st.watched {
+		st.watchCache.Unwatch([]byte(key))
+		delete(st.watched, key)
+	}
+	st.watchCache = nil
+}
+
+// Returns whether none of the watched keys have changed. Must be called in a
+// transaction on c.
+func (st *connState) watchedUnchanged(c *dory.Memcache, tx *dory.Txn) bool {
+	if len(st.watched) == 0 {
+		return true
+	} else if c != st.watchCache {
+		// The cache has been swapped, so every key has effectively changed.
+		return false
+	}
+	for key, version := range st.watched {
+		if tx.KeyVersion([]byte(key)) != version {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheRef wraps the served cache, since atomic.Pointer can't hold an
+// interface.
+type cacheRef struct {
+	dory.Cache
+}
+
 type RedisServer struct {
-	c *dory.Memcache
+	// The cache being served. Each command loads this once, so it can be
+	// swapped while connections are being served.
+	c            atomic.Pointer[cacheRef]
+	readBufSize  int
+	writeBufSize int
+
+	// Whether DEBUG subcommands intended for testing are allowed.
+	debugEnabled bool
+	// Whether writes are rejected, because the cache is a read replica.
+	readOnly bool
+	// Whether SET replies EVICTED instead of OK when it caused an eviction.
+	reportEvictions bool
+	// Source of eviction notifications for WATCH-EVICTIONS, or nil if
+	// disabled.
+	evictions *EvictionWatchers
+	// Whether all connections use the text protocol, instead of detecting it.
+	textProtocol bool
+	// Whether RESP lines may also be terminated by a lone LF, instead of CRLF.
+	lenientLineEndings bool
+	// Limits on the number of read and write commands running at once, or nil
+	// if unlimited.
+	readLimit  *commandLimit
+	writeLimit *commandLimit
 }
 
-func NewRedisServer(c *dory.Memcache) *RedisServer {
-	return &RedisServer{
-		c: c,
+func NewRedisServer(c dory.Cache) *RedisServer {
+	readBufSize := defaultReadBufferSize
+	if c.MaxKeySize() > readBufSize {
+		// Allow keys to be read without multiple buffer fills.
+		readBufSize = c.MaxKeySize()
 	}
+	s := &RedisServer{
+		readBufSize:  readBufSize,
+		writeBufSize: defaultWriteBufferSize,
+	}
+	s.c.Store(&cacheRef{c})
+	return s
+}
+
+// SwapCache atomically replaces the cache being served with c, without
+// interrupting connections, and returns the previous cache. Commands (and
+// MULTI transactions) already running complete against the previous cache,
+// so it's safe to use, but may still be written to briefly after SwapCache
+// returns. c should have the same key and value size limits as the previous
+// cache, since the read buffer size isn't adjusted.
+func (s *RedisServer) SwapCache(c dory.Cache) dory.Cache {
+	return s.c.Swap(&cacheRef{c}).Cache
+}
+
+// Returns the cache currently being served.
+func (s *RedisServer) cache() dory.Cache {
+	return s.c.Load().Cache
+}
+
+// SetReadBufferSize sets the size of the per-connection read buffer for
+// connections subsequently passed to Serve.
+func (s *RedisServer) SetReadBufferSize(size int) {
+	s.readBufSize = size
+}
+
+// SetWriteBufferSize sets the default size of the per-connection write buffer
+// for connections subsequently passed to Serve. Larger buffers let pipelined
+// replies be sent in fewer writes. Clients can override this for their own
+// connection using SET-BUFFER-SIZE.
+func (s *RedisServer) SetWriteBufferSize(size int) {
+	s.writeBufSize = size
+}
+
+// EnableDebugCommands allows the DEBUG commands, such as DEBUG RECLAIM and
+// DEBUG SLEEP, which are intended for testing and should not be exposed in
+// production.
+func (s *RedisServer) EnableDebugCommands() {
+	s.debugEnabled = true
+}
+
+// SetEvictionWatchers enables the WATCH-EVICTIONS command, which notifies
+// clients of keys passed to w.Notify.
+func (s *RedisServer) SetEvictionWatchers(w *EvictionWatchers) {
+	s.evictions = w
+}
+
+// ReportEvictionsOnSet makes SET reply with the status EVICTED, instead of
+// OK, when storing the value caused other entries to be evicted. This tells
+// clients that the cache is at capacity, so that they can slow down.
+func (s *RedisServer) ReportEvictionsOnSet() {
+	s.reportEvictions = true
+}
+
+// SetTextProtocol serves all connections using the plain text line protocol,
+// instead of RESP. Without this, the text protocol is only used for
+// connections whose first byte isn't a valid start of a RESP message.
+func (s *RedisServer) SetTextProtocol() {
+	s.textProtocol = true
+}
+
+// SetLenientLineEndings accepts a lone LF, as well as CRLF, as the line
+// terminator in RESP messages, for interoperating with clients and proxies
+// which don't send CRs. By default, only CRLF is accepted. The text protocol
+// always accepts either.
+func (s *RedisServer) SetLenientLineEndings() {
+	s.lenientLineEndings = true
+}
+
+// SetReadOnly rejects commands which modify the cache, for read replicas.
+func (s *RedisServer) SetReadOnly() {
+	s.readOnly = true
+}
+
+// SetConcurrencyLimits limits the number of commands which read and write the
+// cache that run at once, across all connections, to reads and writes. A limit
+// of 0 is unlimited. Separate limits stop a burst of expensive writes from
+// delaying reads. Commands in a MULTI transaction count as a single write if
+// any of them writes. Must be called before connections are served.
+func (s *RedisServer) SetConcurrencyLimits(reads, writes int) {
+	s.readLimit = newCommandLimit("read", reads)
+	s.writeLimit = newCommandLimit("write", writes)
+}
+
+// Returns the limit for running cmds: the write limit if any of them modify
+// the cache, otherwise the read limit.
+func (s *RedisServer) limitFor(cmds ...*respArray) *commandLimit {
+	for _, cmd := range cmds {
+		if info := lookupCommand(cmd); info != nil && info.write {
+			return s.writeLimit
+		}
+	}
+	return s.readLimit
 }
 
 func indexCrlf(buf []byte) int {
@@ -90,6 +490,9 @@ func indexCrlf(buf []byte) int {
 }
 
 func (s *RedisServer) readLine(r *bufio.Reader, out []byte) ([]byte, error) {
+	if s.lenientLineEndings {
+		return s.readLineLenient(r, out)
+	}
 	for {
 		bufLen := r.Buffered()
 		// Expect at least 2 bytes for the CRLF
@@ -128,6 +531,9 @@ func (s *RedisServer) readLine(r *bufio.Reader, out []byte) ([]byte, error) {
 			readFinished = true
 		}
 
+		if len(out)+end > respStringMaxLength {
+			return out, fmt.Errorf("RedisServer: string length > max %d", respStringMaxLength)
+		}
 		out = append(out, buf[:end]...)
 		// Don't check the return value of Discard() because it is guaranteed to
 		// succeed if 0 <= discardBytes <= r.Buffered(), which is always true here.
@@ -139,6 +545,29 @@ func (s *RedisServer) readLine(r *bufio.Reader, out []byte) ([]byte, error) {
 	return out, nil
 }
 
+// Like readLine, but the line may be terminated by either CRLF or LF.
+func (s *RedisServer) readLineLenient(r *bufio.Reader, out []byte) ([]byte, error) {
+	for {
+		buf, err := r.ReadSlice('\n')
+		// Allow for the CRLF.
+		if len(out)+len(buf) > respStringMaxLength+2 {
+			return out, fmt.Errorf("RedisServer: string length > max %d", respStringMaxLength)
+		}
+		out = append(out, buf...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return out, err
+		}
+		break
+	}
+	out = out[:len(out)-1]
+	if len(out) > 0 && out[len(out)-1] == '\r' {
+		out = out[:len(out)-1]
+	}
+	return out, nil
+}
+
 func (s *RedisServer) readInteger(r *bufio.Reader) (int64, error) {
 	var val int64
 	neg := false
@@ -160,11 +589,15 @@ func (s *RedisServer) readInteger(r *bufio.Reader) (int64, error) {
 			digit := b - '0'
 			if digit > 9 {
 				// Most common case, and quickest to check.
-				if b == '\r' {
-					// End of string. Assume there's a CRLF and discard bytes.
+				if b == '\r' || (b == '\n' && s.lenientLineEndings) {
+					// End of string. Assume a CR is followed by LF and discard bytes.
 					// Don't check the return value of Discard() because any error
 					// will be observed in the next Read.
-					r.Discard(i + 2)
+					if b == '\r' {
+						r.Discard(i + 2)
+					} else {
+						r.Discard(i + 1)
+					}
 					if neg {
 						val = -val
 					}
@@ -222,19 +655,34 @@ func (s *RedisServer) readMessage(r *bufio.Reader) (interface{}, error) {
 			return nil, fmt.Errorf("RedisServer: bulk string length %d > max %d",
 				length, respBulkMaxLength)
 		}
-		allocLen := int(length + 2)
-		if allocLen < (1 << bufferpool.MinSizeBits) {
-			// Round up the buffer allocation to the minimum bufferpool size (16
-			// bytes) to prevent extra allocations.
-			allocLen = (1 << bufferpool.MinSizeBits)
+		var buf *[]byte
+		if length >= respLargeBulkLength {
+			b := make([]byte, int(length+2))
+			buf = &b
+		} else {
+			allocLen := int(length + 2)
+			if allocLen < (1 << bufferpool.MinSizeBits) {
+				// Round up the buffer allocation to the minimum bufferpool size (16
+				// bytes) to prevent extra allocations.
+				allocLen = (1 << bufferpool.MinSizeBits)
+			}
+			buf = bufferpool.GetUninit(allocLen)
+			*buf = (*buf)[:int(length+2)]
+		}
+		if s.lenientLineEndings {
+			// Read up to the first byte of the terminator, and then the LF if the
+			// terminator is CRLF.
+			_, err = io.ReadFull(r, (*buf)[:int(length+1)])
+			if err == nil && (*buf)[length] == '\r' {
+				_, err = r.ReadByte()
+			}
+		} else {
+			_, err = io.ReadFull(r, *buf)
 		}
-		buf := bufferpool.GetUninit(allocLen)
-		*buf = (*buf)[:int(length+2)]
-		_, err = io.ReadFull(r, *buf)
 		if err != nil {
 			return nil, err
 		}
-		// Just assume the last 2 bytes are CRLF and just drop them
+		// Just assume the terminator is CRLF (or LF if lenient) and drop it
 		*buf = (*buf)[:int(length)]
 		return buf, nil
 
@@ -263,8 +711,6 @@ func (s *RedisServer) readMessage(r *bufio.Reader) (interface{}, error) {
 	default:
 		return nil, fmt.Errorf("RedisServer: unexpected data type: 0x%02x", dataType)
 	}
-
-	return nil, nil
 }
 
 func (s *RedisServer) writeOkResponse(w *bufio.Writer) error {
@@ -308,12 +754,60 @@ func (s *RedisServer) writeBulk(w *bufio.Writer, val []byte) error {
 	return err
 }
 
+// Writes the key's value, of the given size, as a bulk string without copying
+// it into a buffer first. If the value changes size or is deleted while it's
+// being written, the reply can't be completed, so an error is returned to
+// close the connection.
+func (s *RedisServer) writeStreamedBulk(w *bufio.Writer, c *dory.Memcache, key []byte, size int) error {
+	err := s.writeTypedInteger(w, respTypeBulkString, int64(size))
+	if err != nil {
+		return err
+	}
+	n, _, err := c.WriteValueTo(key, w)
+	if err != nil {
+		return err
+	} else if n != int64(size) {
+		return dory.ErrValueChanged
+	}
+	_, err = w.Write(respCrlf)
+	return err
+}
+
+func (s *RedisServer) writeError(w *bufio.Writer, msg string) error {
+	return s.writeTypedString(w, respTypeError, msg)
+}
+
+func (s *RedisServer) writeSimpleString(w *bufio.Writer, str string) error {
+	return s.writeTypedString(w, respTypeSimpleString, str)
+}
+
+func (s *RedisServer) writeTypedString(w *bufio.Writer, dataType byte, msg string) error {
+	err := w.WriteByte(dataType)
+	if err != nil {
+		return err
+	}
+	_, err = w.WriteString(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(respCrlf)
+	return err
+}
+
 func (s *RedisServer) writeInteger(w *bufio.Writer, val int64) error {
+	return s.writeTypedInteger(w, respTypeInteger, val)
+}
+
+func (s *RedisServer) writeArrayHeader(w *bufio.Writer, length int) error {
+	return s.writeTypedInteger(w, respTypeArray, int64(length))
+}
+
+func (s *RedisServer) writeTypedInteger(w *bufio.Writer, dataType byte, val int64) error {
 	buf := bufferpool.GetUninit(16)
 	defer bufferpool.Put(buf)
 
 	*buf = (*buf)[:1]
-	(*buf)[0] = respTypeInteger
+	(*buf)[0] = dataType
 	*buf = strconv.AppendInt(*buf, val, 10)
 	*buf = append(*buf, respCrlf...)
 	_, err := w.Write(*buf)
@@ -333,38 +827,357 @@ func equalsCommand(cmd, req []byte) bool {
 	return true
 }
 
-func (s *RedisServer) doCommand(cmd *respArray, w *bufio.Writer) error {
+func isCommand(cmd *respArray, name []byte) bool {
+	if len(cmd.vals) < 1 {
+		return false
+	}
+	cmdBuf, ok := cmd.vals[0].(*[]byte)
+	return ok && equalsCommand(*cmdBuf, name)
+}
+
+// Returns whether the command can be queued as part of a MULTI transaction.
+func isTransactional(cmd *respArray) bool {
+	info := lookupCommand(cmd)
+	return info != nil && info.transactional
+}
+
+// handleCommand runs the command, or queues it if a transaction has been
+// started on the connection. Returns true if the command was queued, in which
+// case ownership of cmd has been passed to st.
+func (s *RedisServer) handleCommand(st *connState, cmd *respArray, w *bufio.Writer) (bool, error) {
+	if info := lookupCommand(cmd); info != nil {
+		if err := info.checkArity(cmd); err != nil {
+			return false, err
+		}
+	}
+
+	if isCommand(cmd, respCmdMulti) {
+		if st.inMulti {
+			return false, commandError("MULTI calls can not be nested")
+		}
+		st.inMulti = true
+		return false, s.writeOkResponse(w)
+	} else if isCommand(cmd, respCmdExec) {
+		if !st.inMulti {
+			return false, commandError("EXEC without MULTI")
+		}
+		limit := s.limitFor(st.queued...)
+		limit.acquire()
+		err := s.execQueued(st, w)
+		limit.release()
+		st.reset()
+		return false, err
+	} else if isCommand(cmd, respCmdDiscard) {
+		if !st.inMulti {
+			return false, commandError("DISCARD without MULTI")
+		}
+		st.reset()
+		return false, s.writeOkResponse(w)
+	} else if isCommand(cmd, respCmdWatch) {
+		if st.inMulti {
+			return false, commandError("WATCH inside MULTI is not allowed")
+		}
+		return false, s.watchKeys(st, cmd.vals[1:], w)
+	} else if isCommand(cmd, respCmdUnwatch) {
+		st.unwatch()
+		return false, s.writeOkResponse(w)
+	} else if st.inMulti {
+		if !isTransactional(cmd) {
+			return false, commandError("command not allowed in MULTI")
+		} else if len(st.queued) >= respMaxQueued {
+			return false, commandError("too many commands in MULTI")
+		}
+		st.queued = append(st.queued, cmd)
+		_, err := w.Write(respResponseQueued)
+		return true, err
+	} else if isCommand(cmd, respCmdSetBufferSize) {
+		size, err := strconv.Atoi(string(*cmd.vals[1].(*[]byte)))
+		if err != nil || size < minWriteBufferSize || size > maxWriteBufferSize {
+			return false, commandError("buffer size must be between %d and %d",
+				minWriteBufferSize, maxWriteBufferSize)
+		}
+		st.writeBufSize = size
+		return false, s.writeOkResponse(w)
+	} else if isCommand(cmd, respCmdWatchEvictions) {
+		if s.evictions == nil {
+			return false, commandError("eviction notifications are not enabled")
+		}
+		st.watchEvictions = true
+		return false, s.writeOkResponse(w)
+	}
+
+	limit := s.limitFor(cmd)
+	limit.acquire()
+	defer limit.release()
+	c := s.cache()
+	if mc, ok := c.(*dory.Memcache); ok {
+		return false, s.doCommand(mc, mc, cmd, w)
+	}
+	return false, s.doCommand(c, basicCacheOps{c}, cmd, w)
+}
+
+// Watches the keys for changes, so that the next EXEC on the connection is
+// aborted if any of them change.
+func (s *RedisServer) watchKeys(st *connState, keys []interface{}, w *bufio.Writer) error {
+	c, ok := s.cache().(*dory.Memcache)
+	if !ok {
+		return commandError("transactions are not supported by this cache")
+	}
+	if st.watchCache != c {
+		// Versions from a swapped out cache are meaningless.
+		st.unwatch()
+		st.watchCache = c
+	}
+	if st.watched == nil {
+		st.watched = make(map[string]uint64)
+	}
+	for _, key := range keys {
+		key := *key.(*[]byte)
+		if _, ok := st.watched[string(key)]; !ok {
+			st.watched[string(key)] = c.Watch(key)
+		}
+	}
+	return s.writeOkResponse(w)
+}
+
+// execQueued runs the connection's queued commands atomically, and writes an
+// array of their replies. If any watched key has changed, the commands are
+// not run, and a null array is written instead.
+func (s *RedisServer) execQueued(st *connState, w *bufio.Writer) error {
+	cmds := st.queued
+	// Buffer the replies so that nothing is written to the network while the
+	// cache is locked.
+	var replies bytes.Buffer
+	replyw := bufio.NewWriter(&replies)
+	c, ok := s.cache().(*dory.Memcache)
+	if !ok {
+		return commandError("transactions are not supported by this cache")
+	}
+	var err error
+	aborted := false
+	c.Atomically(func(tx *dory.Txn) {
+		if !st.watchedUnchanged(c, tx) {
+			aborted = true
+			return
+		}
+		for _, cmd := range cmds {
+			err = s.doCommand(c, tx, cmd, replyw)
+			if cmdErr, ok := err.(*respError); ok {
+				err = s.writeError(replyw, cmdErr.msg)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+	if err == nil {
+		err = replyw.Flush()
+	}
+	if err != nil {
+		return err
+	} else if aborted {
+		return s.writeArrayHeader(w, -1)
+	}
+
+	err = s.writeArrayHeader(w, len(cmds))
+	if err != nil {
+		return err
+	}
+	_, err = replies.WriteTo(w)
+	return err
+}
+
+// Parses the options following the key and value of a SET command, and
+// returns the TTL, or 0 if no TTL was given. Only EX, PX and KEEPTTL are
+// supported. KEEPTTL returns dory.KeepTTL.
+func parseSetOptions(opts []interface{}) (time.Duration, error) {
+	var ttl time.Duration
+	for i := 0; i < len(opts); i++ {
+		opt := opts[i].(*[]byte)
+		var unit time.Duration
+		if equalsCommand(*opt, respSetKeepTTL) {
+			if ttl != 0 {
+				return 0, commandError("syntax error")
+			}
+			ttl = dory.KeepTTL
+			continue
+		} else if equalsCommand(*opt, respSetEx) {
+			unit = time.Second
+		} else if equalsCommand(*opt, respSetPx) {
+			unit = time.Millisecond
+		} else {
+			return 0, commandError("syntax error")
+		}
+		if ttl != 0 || i+1 >= len(opts) {
+			return 0, commandError("syntax error")
+		}
+		i++
+		val, err := strconv.ParseInt(string(*opts[i].(*[]byte)), 10, 64)
+		if err != nil {
+			return 0, commandError("value is not an integer or out of range")
+		} else if val <= 0 || val > math.MaxInt64/int64(unit) {
+			return 0, commandError("invalid expire time in 'set' command")
+		}
+		ttl = time.Duration(val) * unit
+	}
+	return ttl, nil
+}
+
+// doCommand runs cmd against c, which is either cc itself or a transaction
+// on it. Commands other than the basic ones require cc to be a dory.Memcache.
+func (s *RedisServer) doCommand(cc dory.Cache, c cacheOps, cmd *respArray, w *bufio.Writer) error {
 	if len(cmd.vals) < 1 {
-		return fmt.Errorf("RedisServer: invalid command array length %d", len(cmd.vals))
+		return commandError("empty command")
 	}
 
 	cmdBuf, ok := cmd.vals[0].(*[]byte)
 	if !ok {
-		return fmt.Errorf("RedisServer: command not string")
+		return commandError("command not string")
 	}
+	info := lookupCommand(cmd)
+	if info == nil {
+		for _, pubSubCmd := range respPubSubCmds {
+			if equalsCommand(*cmdBuf, pubSubCmd) {
+				return commandError("pub/sub is not supported")
+			}
+		}
+		return commandError("unknown command '%s'", string(*cmdBuf))
+	} else if err := info.checkArity(cmd); err != nil {
+		return err
+	} else if s.readOnly && info.write {
+		return errReadOnly
+	}
+	mc, _ := cc.(*dory.Memcache)
+	if mc == nil && !info.basic {
+		return commandError("'%s' command is not supported by this cache", string(info.name))
+	}
+
 	// TODO: Hash-table command lookup, instead of this big if block.
+
 	if equalsCommand(*cmdBuf, respCmdSet) {
-		if len(cmd.vals) < 3 {
-			return fmt.Errorf("RedisServer: invalid SET array length %d", len(cmd.vals))
+		key := cmd.vals[1].(*[]byte)
+		value := cmd.vals[2].(*[]byte)
+		ttl, err := parseSetOptions(cmd.vals[3:])
+		if err != nil {
+			return err
+		} else if err = s.checkKeyVal(cc, *key, *value); err != nil {
+			return err
+		} else if ttl != 0 && mc == nil {
+			return commandError("TTLs are not supported by this cache")
+		}
+		if s.reportEvictions {
+			var evicted bool
+			evicted, err = c.PutEvicting(*key, *value, ttl)
+			if evicted && err == nil {
+				_, err = w.Write(respResponseEvicted)
+				return err
+			}
+		} else {
+			err = c.PutWithTTL(*key, *value, ttl)
+		}
+		if err != nil {
+			return putError(err)
 		}
+		return s.writeOkResponse(w)
+	} else if equalsCommand(*cmdBuf, respCmdAdd) || equalsCommand(*cmdBuf, respCmdReplace) {
+		// Like SET, but only store if the key is absent (ADD) or present
+		// (REPLACE). Replies 1 if the value was stored, otherwise 0.
+		isAdd := equalsCommand(*cmdBuf, respCmdAdd)
 		key := cmd.vals[1].(*[]byte)
 		value := cmd.vals[2].(*[]byte)
-		s.c.Put(*key, *value)
+		ttl, err := parseSetOptions(cmd.vals[3:])
+		if err != nil {
+			return err
+		} else if err = s.checkKeyVal(cc, *key, *value); err != nil {
+			return err
+		}
+		var stored bool
+		if isAdd {
+			stored, err = c.Add(*key, *value, ttl)
+		} else {
+			stored, err = c.Replace(*key, *value, ttl)
+		}
+		if err != nil {
+			return putError(err)
+		} else if stored {
+			return s.writeInteger(w, 1)
+		}
+		return s.writeInteger(w, 0)
+	} else if equalsCommand(*cmdBuf, respCmdMset) {
+		if len(cmd.vals)%2 != 1 {
+			return wrongArgsError("mset")
+		}
+		n := (len(cmd.vals) - 1) / 2
+		keys := make([][]byte, n)
+		vals := make([][]byte, n)
+		for i := 0; i < n; i++ {
+			keys[i] = *cmd.vals[1+2*i].(*[]byte)
+			vals[i] = *cmd.vals[2+2*i].(*[]byte)
+			if err := s.checkKeyVal(cc, keys[i], vals[i]); err != nil {
+				return err
+			}
+		}
+		if err := c.PutBatch(keys, vals); err != nil {
+			return putError(err)
+		}
 		return s.writeOkResponse(w)
-	} else if equalsCommand(*cmdBuf, respCmdGet) {
-		if len(cmd.vals) < 2 {
-			return fmt.Errorf("RedisServer: invalid GET array length %d", len(cmd.vals))
+	} else if equalsCommand(*cmdBuf, respCmdStrlen) {
+		// A missing key has a length of 0.
+		size, _ := c.Stat(*cmd.vals[1].(*[]byte))
+		return s.writeInteger(w, int64(size))
+	} else if equalsCommand(*cmdBuf, respCmdGetRange) {
+		key := cmd.vals[1].(*[]byte)
+		start, err := strconv.Atoi(string(*cmd.vals[2].(*[]byte)))
+		if err != nil {
+			return commandError("value is not an integer or out of range")
+		}
+		end, err := strconv.Atoi(string(*cmd.vals[3].(*[]byte)))
+		if err != nil {
+			return commandError("value is not an integer or out of range")
 		}
+		getBuf := bufferpool.GetUninit(getBufSize(cc))
+		defer bufferpool.Put(getBuf)
+		// A missing key is treated as an empty string.
+		val, _ := c.GetRange(*key, start, end, (*getBuf)[:0])
+		if val == nil {
+			val = (*getBuf)[:0]
+		}
+		return s.writeBulk(w, val)
+	} else if equalsCommand(*cmdBuf, respCmdSetRange) {
 		key := cmd.vals[1].(*[]byte)
-		getBuf := bufferpool.GetUninit(s.c.MaxValSize())
+		offset, err := strconv.Atoi(string(*cmd.vals[2].(*[]byte)))
+		if err != nil {
+			return commandError("value is not an integer or out of range")
+		} else if offset < 0 {
+			return commandError("offset is out of range")
+		}
+		length, err := c.SetRange(*key, offset, *cmd.vals[3].(*[]byte))
+		if err == dory.ErrTooLarge {
+			return commandError("string exceeds maximum allowed size")
+		} else if err != nil {
+			return putError(err)
+		}
+		return s.writeInteger(w, int64(length))
+	} else if equalsCommand(*cmdBuf, respCmdGet) {
+		key := cmd.vals[1].(*[]byte)
+		if cc.MaxValSize() > streamValSize {
+			// Values can't be streamed within a transaction, since the cache is
+			// locked.
+			if mc != nil && c == cacheOps(mc) {
+				if size, ok := mc.Stat(*key); ok && size > streamValSize {
+					return s.writeStreamedBulk(w, mc, *key, size)
+				}
+			}
+		}
+		getBuf := bufferpool.GetUninit(getBufSize(cc))
 		defer bufferpool.Put(getBuf)
-		val := s.c.Get(*key, (*getBuf)[:0])
+		val := c.Get(*key, (*getBuf)[:0])
 		return s.writeBulk(w, val)
 	} else if equalsCommand(*cmdBuf, respCmdDel) {
 		delCount := 0
 		for i := 1; i < len(cmd.vals); i++ {
 			key := cmd.vals[i].(*[]byte)
-			s.c.Delete(*key)
+			c.Delete(*key)
 			// TODO: Have Delete() return whether the key was actually removed, and
 			// use that to incement delCount
 			delCount++
@@ -374,21 +1187,276 @@ func (s *RedisServer) doCommand(cmd *respArray, w *bufio.Writer) error {
 		existsCount := 0
 		for i := 1; i < len(cmd.vals); i++ {
 			key := cmd.vals[i].(*[]byte)
-			if s.c.Has(*key) {
+			if c.Has(*key) {
 				existsCount++
 			}
 		}
 		return s.writeInteger(w, int64(existsCount))
+	} else if equalsCommand(*cmdBuf, respCmdDebug) {
+		return s.doDebugCommand(mc, cmd, w)
+	} else if equalsCommand(*cmdBuf, respCmdObject) {
+		return s.doObjectCommand(mc, cmd, w)
+	} else if equalsCommand(*cmdBuf, respCmdWasCached) {
+		if !mc.TracksSeenKeys() {
+			return commandError("seen keys are not being tracked")
+		}
+		if mc.WasCached(*cmd.vals[1].(*[]byte)) {
+			return s.writeInteger(w, 1)
+		}
+		return s.writeInteger(w, 0)
+	} else if equalsCommand(*cmdBuf, respCmdCommand) {
+		return s.doCommandCommand(cmd, w)
+	} else if equalsCommand(*cmdBuf, respCmdMemory) {
+		return s.doMemoryCommand(mc, cmd, w)
+	} else if equalsCommand(*cmdBuf, respCmdEvict) {
+		// Like DEL, but reclaims the key's space immediately, and replies with the
+		// number of bytes reclaimed.
+		return s.writeInteger(w, int64(mc.EvictAndReclaim(*cmd.vals[1].(*[]byte))))
+	} else if equalsCommand(*cmdBuf, respCmdSetFlags) {
+		// Flags are the memcached item flags, so are shared with memcached
+		// clients of the same cache.
+		flags, err := strconv.ParseUint(string(*cmd.vals[2].(*[]byte)), 10, 32)
+		if err != nil {
+			return commandError("value is not an integer or out of range")
+		}
+		if mc.SetFlags(*cmd.vals[1].(*[]byte), uint32(flags)) {
+			return s.writeInteger(w, 1)
+		}
+		return s.writeInteger(w, 0)
+	} else if equalsCommand(*cmdBuf, respCmdConfig) {
+		return s.doConfigCommand(mc, cmd, w)
+	} else if equalsCommand(*cmdBuf, respCmdGetFlags) {
+		flags, ok := mc.Flags(*cmd.vals[1].(*[]byte))
+		if !ok {
+			_, err := w.Write(respResponseBulkArrayNil)
+			return err
+		}
+		return s.writeInteger(w, int64(flags))
+	}
+
+	// Connection commands, such as MULTI, are handled by handleCommand.
+	return commandError("'%s' command is not allowed here", string(*cmdBuf))
+}
+
+func (s *RedisServer) doDebugCommand(c *dory.Memcache, cmd *respArray, w *bufio.Writer) error {
+	if len(cmd.vals) < 2 {
+		return wrongArgsError("debug")
+	}
+
+	subCmd := cmd.vals[1].(*[]byte)
+	if s.debugEnabled {
+		if equalsCommand(*subCmd, respDebugReclaim) {
+			reclaimed := c.RunGC()
+			return s.writeInteger(w, int64(reclaimed))
+		} else if equalsCommand(*subCmd, respDebugSleep) {
+			if len(cmd.vals) != 3 {
+				return wrongArgsError("debug|sleep")
+			}
+			secs, err := strconv.ParseFloat(string(*cmd.vals[2].(*[]byte)), 64)
+			if err != nil || secs < 0 {
+				return commandError("value is not a valid float")
+			}
+			time.Sleep(time.Duration(secs * float64(time.Second)))
+			return s.writeOkResponse(w)
+		} else if equalsCommand(*subCmd, respDebugObject) {
+			if len(cmd.vals) != 3 {
+				return wrongArgsError("debug|object")
+			}
+			info, ok := c.Inspect(*cmd.vals[2].(*[]byte))
+			if !ok {
+				return commandError("no such key")
+			}
+			return s.writeSimpleString(w, fmt.Sprintf(
+				"generation:%d offset:%d entry_size:%d table_size:%d",
+				info.Generation, info.Offset, info.EntrySize, info.TableSize))
+		} else if equalsCommand(*subCmd, respDebugTables) {
+			if len(cmd.vals) != 2 {
+				return wrongArgsError("debug|tables")
+			}
+			// One line per table, newest first.
+			infos := c.Tables()
+			err := s.writeArrayHeader(w, len(infos))
+			for _, info := range infos {
+				if err != nil {
+					break
+				}
+				err = s.writeSimpleString(w, fmt.Sprintf(
+					"generation:%d size:%d entries:%d deleted:%d live_space:%d deleted_space:%d free_space:%d",
+					info.Generation, info.Size, info.Entries, info.Deleted, info.LiveSpace,
+					info.DeletedSpace, info.FreeSpace))
+			}
+			return err
+		} else if equalsCommand(*subCmd, respDebugHotKeys) {
+			return s.doDebugHotKeys(c, cmd, w)
+		}
+	}
+
+	return commandError("unknown DEBUG subcommand '%s'", string(*subCmd))
+}
+
+// Replies to DEBUG HOTKEYS [count] with up to count (default 10) of the most
+// read keys, most read first, each as an array of the key and its estimated
+// reads per second.
+func (s *RedisServer) doDebugHotKeys(c *dory.Memcache, cmd *respArray, w *bufio.Writer) error {
+	if len(cmd.vals) > 3 {
+		return wrongArgsError("debug|hotkeys")
+	} else if !c.TracksHotKeys() {
+		return commandError("hot keys are not being tracked")
+	}
+	n := 10
+	if len(cmd.vals) == 3 {
+		var err error
+		n, err = strconv.Atoi(string(*cmd.vals[2].(*[]byte)))
+		if err != nil || n <= 0 {
+			return commandError("value is out of range, must be positive")
+		}
+	}
+
+	keys := c.HotKeys(n)
+	err := s.writeArrayHeader(w, len(keys))
+	for _, k := range keys {
+		if err == nil {
+			err = s.writeArrayHeader(w, 2)
+		}
+		if err == nil {
+			err = s.writeBulk(w, k.Key)
+		}
+		if err == nil {
+			err = s.writeInteger(w, int64(math.Round(k.Rate)))
+		}
+	}
+	return err
+}
+
+func (s *RedisServer) doObjectCommand(c *dory.Memcache, cmd *respArray, w *bufio.Writer) error {
+	if len(cmd.vals) < 2 {
+		return wrongArgsError("object")
+	}
+
+	subCmd := cmd.vals[1].(*[]byte)
+	if equalsCommand(*subCmd, respObjectIdletime) {
+		if len(cmd.vals) != 3 {
+			return wrongArgsError("object|idletime")
+		}
+		// Unlike redis, the idle time is measured in tables created since the
+		// key was last written or promoted, rather than seconds.
+		age, ok := c.KeyAge(*cmd.vals[2].(*[]byte))
+		if !ok {
+			_, err := w.Write(respResponseBulkArrayNil)
+			return err
+		}
+		return s.writeInteger(w, int64(age))
+	} else if equalsCommand(*subCmd, respObjectFreq) {
+		if len(cmd.vals) != 3 {
+			return wrongArgsError("object|freq")
+		} else if !c.TracksFrequencies() {
+			return commandError("access frequencies are not being tracked")
+		}
+		freq, ok := c.KeyFrequency(*cmd.vals[2].(*[]byte))
+		if !ok {
+			_, err := w.Write(respResponseBulkArrayNil)
+			return err
+		}
+		return s.writeInteger(w, int64(freq))
+	}
+
+	return commandError("unknown OBJECT subcommand '%s'", string(*subCmd))
+}
+
+// Handles CONFIG GET maxmemory, which replies with the cache's current table
+// memory limit, and CONFIG SET maxmemory <bytes>, which sets a constant limit,
+// or restores the configured limit if bytes is 0. No other parameters are
+// supported.
+func (s *RedisServer) doConfigCommand(c *dory.Memcache, cmd *respArray, w *bufio.Writer) error {
+	subCmd := cmd.vals[1].(*[]byte)
+	if equalsCommand(*subCmd, respConfigGet) {
+		if len(cmd.vals) != 3 {
+			return wrongArgsError("config|get")
+		}
+		param := *cmd.vals[2].(*[]byte)
+		if !equalsCommand(param, respConfigMaxMemory) {
+			return commandError("unsupported CONFIG parameter '%s'", string(param))
+		}
+		err := s.writeArrayHeader(w, 2)
+		if err == nil {
+			err = s.writeBulk(w, respConfigMaxMemory)
+		}
+		if err == nil {
+			err = s.writeBulk(w, strconv.AppendInt(nil, c.Stats().MaxTableMem, 10))
+		}
+		return err
+	} else if equalsCommand(*subCmd, respConfigSet) {
+		if len(cmd.vals) != 4 {
+			return wrongArgsError("config|set")
+		}
+		param := *cmd.vals[2].(*[]byte)
+		if !equalsCommand(param, respConfigMaxMemory) {
+			return commandError("unsupported CONFIG parameter '%s'", string(param))
+		}
+		limit, err := strconv.ParseInt(string(*cmd.vals[3].(*[]byte)), 10, 64)
+		if err != nil || limit < 0 {
+			return commandError("value is not an integer or out of range")
+		}
+		c.SetMemoryLimit(limit)
+		return s.writeOkResponse(w)
+	}
+	return commandError("unknown CONFIG subcommand '%s'", string(*subCmd))
+}
+
+func (s *RedisServer) doMemoryCommand(c *dory.Memcache, cmd *respArray, w *bufio.Writer) error {
+	subCmd := cmd.vals[1].(*[]byte)
+	if equalsCommand(*subCmd, respMemoryUsage) {
+		if len(cmd.vals) != 3 {
+			return wrongArgsError("memory|usage")
+		}
+		info, ok := c.Inspect(*cmd.vals[2].(*[]byte))
+		if !ok {
+			_, err := w.Write(respResponseBulkArrayNil)
+			return err
+		}
+		return s.writeInteger(w, int64(info.EntrySize))
+	} else if equalsCommand(*subCmd, respMemoryStats) {
+		if len(cmd.vals) != 2 {
+			return wrongArgsError("memory|stats")
+		}
+		stats := c.Stats()
+		fields := []struct {
+			name string
+			val  int64
+		}{
+			{"keys.count", int64(stats.Keys)},
+			{"tables.count", int64(stats.Tables)},
+			{"tables.max", int64(stats.MaxTables)},
+			{"tables.bytes", stats.TableMem},
+			{"tables.max.bytes", stats.MaxTableMem},
+			{"live.bytes", stats.LiveSpace},
+			{"deleted.bytes", stats.DeletedSpace},
+			{"free.bytes", stats.FreeSpace},
+			{"rss.bytes", stats.Rss},
+		}
+		err := s.writeArrayHeader(w, 2*len(fields))
+		for _, f := range fields {
+			if err == nil {
+				err = s.writeBulk(w, []byte(f.name))
+			}
+			if err == nil {
+				err = s.writeInteger(w, f.val)
+			}
+		}
+		return err
 	}
 
-	return fmt.Errorf("RedisServer: unsupported command %s", string(*cmdBuf))
+	return commandError("unknown MEMORY subcommand '%s'", string(*subCmd))
 }
 
 func freeRespArray(a *respArray) {
 	for i, v := range a.vals {
 		switch v := v.(type) {
 		case *[]byte:
-			bufferpool.Put(v)
+			if len(*v) < respLargeBulkLength {
+				// Large bulk strings aren't from the pool, so leave them for the GC.
+				bufferpool.Put(v)
+			}
 		}
 		a.vals[i] = nil
 	}
@@ -397,8 +1465,24 @@ func freeRespArray(a *respArray) {
 }
 
 func (s *RedisServer) Serve(conn io.ReadWriter) error {
-	bufr := bufio.NewReader(conn)
-	bufw := bufio.NewWriter(conn)
+	bufr := bufio.NewReaderSize(conn, s.readBufSize)
+	bufw := bufio.NewWriterSize(conn, s.writeBufSize)
+	if s.textProtocol {
+		return s.serveText(bufr, bufw)
+	}
+	first, err := bufr.Peek(1)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !isRespType(first[0]) {
+		return s.serveText(bufr, bufw)
+	}
+
+	var st connState
+	defer st.reset()
+	// Number of commands processed since the last flush.
+	pipelined := 0
 	for {
 		cmd, err := s.readMessage(bufr)
 		if err == io.EOF {
@@ -412,14 +1496,37 @@ func (s *RedisServer) Serve(conn io.ReadWriter) error {
 		if !ok {
 			return fmt.Errorf("RedisServer: request not array type")
 		}
-		err = s.doCommand(cmdArray, bufw)
+		queued, err := s.handleCommand(&st, cmdArray, bufw)
+		if cmdErr, ok := err.(*respError); ok {
+			// Command errors are reported to the client, but aren't fatal to the
+			// connection.
+			err = s.writeError(bufw, cmdErr.msg)
+		}
 
-		// Return the array to the pool
-		freeRespArray(cmdArray)
+		// Return the array to the pool, unless it's been queued for later
+		if !queued {
+			freeRespArray(cmdArray)
+		}
+		if st.writeBufSize != 0 && st.writeBufSize != bufw.Size() && err == nil {
+			// Switch to the write buffer size requested by the client, after
+			// sending anything already buffered.
+			err = bufw.Flush()
+			bufw = bufio.NewWriterSize(conn, st.writeBufSize)
+		}
+		if st.watchEvictions && err == nil {
+			err = bufw.Flush()
+			if err != nil {
+				return err
+			}
+			return s.serveEvictions(bufr, bufw)
+		}
+		pipelined++
 
 		// Don't flush yet if there are commands still to be read
 		if err == nil && bufr.Buffered() == 0 {
 			err = bufw.Flush()
+			pipelineDepth.Observe(float64(pipelined))
+			pipelined = 0
 		}
 		if err != nil {
 			return err
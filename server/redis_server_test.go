@@ -0,0 +1,936 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/akmistry/dory"
+)
+
+type testConn struct {
+	io.Reader
+	io.Writer
+}
+
+func newTestServer() *RedisServer {
+	return NewRedisServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:  1024 * 1024,
+		MaxKeySize: 16 * 1024,
+		MaxValSize: 1024,
+	}))
+}
+
+func TestRedisServer_SwapCache(t *testing.T) {
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"), &out})
+	assert.NoError(t, err)
+
+	c := dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:  1024 * 1024,
+		MaxKeySize: 16 * 1024,
+		MaxValSize: 1024,
+	})
+	c.Put([]byte("foo"), []byte("baz"))
+	old := s.SwapCache(c)
+	assert.Equal(t, []byte("bar"), old.Get([]byte("foo"), nil))
+
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "$3\r\nbaz\r\n", out.String())
+}
+
+// mapCache is a minimal dory.Cache, for testing servers with caches other
+// than dory.Memcache.
+type mapCache map[string][]byte
+
+func (c mapCache) Has(key []byte) bool {
+	_, ok := c[string(key)]
+	return ok
+}
+
+func (c mapCache) Get(key, buf []byte) []byte {
+	val, ok := c[string(key)]
+	if !ok {
+		return nil
+	}
+	return append(buf, val...)
+}
+
+func (c mapCache) Put(key, val []byte) error {
+	c[string(key)] = append([]byte(nil), val...)
+	return nil
+}
+
+func (c mapCache) Delete(key []byte) {
+	delete(c, string(key))
+}
+
+func (c mapCache) MinKeySize() int { return 1 }
+func (c mapCache) MaxKeySize() int { return 16 }
+func (c mapCache) MinValSize() int { return 1 }
+func (c mapCache) MaxValSize() int { return 16 }
+
+func TestRedisServer_Cache(t *testing.T) {
+	c := make(mapCache)
+	s := NewRedisServer(c)
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$6\r\nEXISTS\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n" +
+		"*5\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n$2\r\nEX\r\n$2\r\n10\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$17\r\n01234567890123456\r\n" +
+		"*2\r\n$6\r\nSTRLEN\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n:1\r\n"+
+		"-ERR TTLs are not supported by this cache\r\n"+
+		"-ERR value exceeds max size 16\r\n"+
+		"-ERR 'strlen' command is not supported by this cache\r\n"+
+		"+OK\r\n+QUEUED\r\n"+
+		"-ERR transactions are not supported by this cache\r\n"+
+		":1\r\n", out.String())
+	assert.Equal(t, mapCache{}, c)
+}
+
+func TestRedisServer_ReadLongLine(t *testing.T) {
+	s := newTestServer()
+	// Lengths around the minimum bufio.Reader size of 16 bytes, so that the CRLF
+	// straddles buffer fills, and much longer than the buffer.
+	for _, length := range []int{1, 14, 15, 16, 17, 31, 32, 33, 1000, 10000} {
+		line := strings.Repeat("a\rb", length)[:length]
+		input := "+" + line + "\r\n" + "+next\r\n"
+		readers := map[string]io.Reader{
+			"plain":   strings.NewReader(input),
+			"onebyte": iotest.OneByteReader(strings.NewReader(input)),
+			"half":    iotest.HalfReader(strings.NewReader(input)),
+		}
+		for name, r := range readers {
+			bufr := bufio.NewReaderSize(r, 16)
+			msg, err := s.readMessage(bufr)
+			assert.NoError(t, err, "%s/%d", name, length)
+			assert.Equal(t, []byte(line), msg, "%s/%d", name, length)
+
+			msg, err = s.readMessage(bufr)
+			assert.NoError(t, err, "%s/%d", name, length)
+			assert.Equal(t, []byte("next"), msg, "%s/%d", name, length)
+		}
+	}
+}
+
+func TestRedisServer_ReadLineTooLong(t *testing.T) {
+	s := newTestServer()
+	input := "+" + strings.Repeat("a", respStringMaxLength+1) + "\r\n"
+	_, err := s.readMessage(bufio.NewReader(strings.NewReader(input)))
+	assert.Error(t, err)
+}
+
+func TestRedisServer_ServeLongKey(t *testing.T) {
+	s := newTestServer()
+	s.SetReadBufferSize(16)
+
+	key := strings.Repeat("k", 10000)
+	input := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$3\r\nfoo\r\n", len(key), key) +
+		fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nfoo\r\n", out.String())
+}
+
+func TestParseSetOptions(t *testing.T) {
+	args := func(strs ...string) []interface{} {
+		var vals []interface{}
+		for _, s := range strs {
+			b := []byte(s)
+			vals = append(vals, &b)
+		}
+		return vals
+	}
+
+	ttl, err := parseSetOptions(args())
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+	ttl, err = parseSetOptions(args("EX", "10"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, ttl)
+	ttl, err = parseSetOptions(args("px", "1500"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1500*time.Millisecond, ttl)
+	ttl, err = parseSetOptions(args("KEEPTTL"))
+	assert.NoError(t, err)
+	assert.Equal(t, dory.KeepTTL, ttl)
+
+	for _, bad := range [][]string{
+		{"EX"}, {"EX", "0"}, {"EX", "-1"}, {"EX", "abc"}, {"EX", "1", "PX", "1"},
+		{"NX"}, {"EX", "9223372036854775807"}, {"KEEPTTL", "EX", "1"},
+		{"PX", "1", "KEEPTTL"}, {"KEEPTTL", "KEEPTTL"},
+	} {
+		_, err = parseSetOptions(args(bad...))
+		assert.Error(t, err, "%v", bad)
+	}
+}
+
+func TestRedisServer_PubSubUnsupported(t *testing.T) {
+	s := newTestServer()
+	input := "*2\r\n$9\r\nSUBSCRIBE\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR pub/sub is not supported\r\n+OK\r\n", out.String())
+}
+
+func TestRedisServer_WatchEvictions(t *testing.T) {
+	s := newTestServer()
+	watchers := NewEvictionWatchers()
+	s.SetEvictionWatchers(watchers)
+
+	inr, inw := io.Pipe()
+	outr, outw := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(testConn{inr, outw})
+	}()
+	bufr := bufio.NewReader(outr)
+	readN := func(n int) string {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(bufr, buf)
+		assert.NoError(t, err)
+		return string(buf)
+	}
+
+	io.WriteString(inw, "*1\r\n$15\r\nWATCH-EVICTIONS\r\n")
+	assert.Equal(t, "+OK\r\n", readN(5))
+
+	// The watcher is registered asynchronously, so keep notifying until the
+	// first notification arrives.
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				watchers.Notify([]byte("foo"))
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	expected := "*2\r\n$7\r\nevicted\r\n$3\r\nfoo\r\n"
+	assert.Equal(t, expected, readN(len(expected)))
+	close(done)
+
+	inw.Close()
+	go io.Copy(io.Discard, bufr)
+	assert.NoError(t, <-served)
+}
+
+func TestRedisServer_WatchEvictionsDisabled(t *testing.T) {
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader("*1\r\n$15\r\nWATCH-EVICTIONS\r\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR eviction notifications are not enabled\r\n", out.String())
+}
+
+func TestRedisServer_ReportEvictionsOnSet(t *testing.T) {
+	s := NewRedisServer(dory.NewMemcache(dory.MemcacheOptions{
+		MemoryFunction: dory.ConstantMemory(64 * 1024),
+		TableSize:      64 * 1024,
+		MaxValSize:     1024,
+	}))
+	s.ReportEvictionsOnSet()
+
+	val := strings.Repeat("v", 1000)
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		fmt.Fprintf(&input, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+			len(key), key, len(val), val)
+	}
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input.String()), &out})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "+OK\r\n"))
+	assert.Contains(t, out.String(), "+EVICTED\r\n")
+}
+
+// failingCache is a mapCache whose writes always fail.
+type failingCache struct {
+	mapCache
+}
+
+func (c failingCache) Put(key, val []byte) error {
+	return errors.New("put failed")
+}
+
+func TestRedisServer_PutError(t *testing.T) {
+	s := NewRedisServer(failingCache{make(mapCache)})
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR put failed\r\n", out.String())
+
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader("SET foo bar\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "ERR put failed\n", out.String())
+}
+
+func TestBasicCacheOps(t *testing.T) {
+	c := basicCacheOps{make(mapCache)}
+	assert.NoError(t, c.PutBatch([][]byte{[]byte("foo"), []byte("bar")},
+		[][]byte{[]byte("hello"), []byte("world")}))
+	assert.Equal(t, []byte("world"), c.Get([]byte("bar"), nil))
+
+	size, ok := c.Stat([]byte("foo"))
+	assert.True(t, ok)
+	assert.Equal(t, 5, size)
+	_, ok = c.Stat([]byte("baz"))
+	assert.False(t, ok)
+
+	val, ok := c.GetRange([]byte("foo"), 1, -2, nil)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("ell"), val)
+	val, ok = c.GetRange([]byte("foo"), 3, 1, nil)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{}, val)
+	_, ok = c.GetRange([]byte("baz"), 0, -1, nil)
+	assert.False(t, ok)
+
+	// Operations which can't be built from Get and Put return an error.
+	_, err := c.Add([]byte("baz"), []byte("11"), 0)
+	assert.Equal(t, errUnsupportedOp, err)
+	_, err = c.Replace([]byte("foo"), []byte("11"), 0)
+	assert.Equal(t, errUnsupportedOp, err)
+	_, err = c.SetRange([]byte("foo"), 0, []byte("11"))
+	assert.Equal(t, errUnsupportedOp, err)
+	assert.Equal(t, errUnsupportedOp, putError(err))
+}
+
+func TestRedisServer_TextProtocol(t *testing.T) {
+	s := newTestServer()
+	input := "SET foo bar baz\r\n" +
+		"GET foo\n" +
+		"\n" +
+		"get missing\n" +
+		"DEL foo\n" +
+		"GET foo\n" +
+		"GET\n" +
+		"PING\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "OK\nbar baz\n(nil)\nOK\n(nil)\n"+
+		"ERR wrong number of arguments for 'get' command\n"+
+		"ERR unknown command 'PING'\n", out.String())
+
+	// A long value, read across multiple buffer fills.
+	s.SetReadBufferSize(16)
+	val := strings.Repeat("v", 1000)
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader("SET k " + val + "\nGET k\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "OK\n"+val+"\n", out.String())
+
+	// Unterminated final line.
+	err = s.Serve(testConn{strings.NewReader("GET k"), io.Discard})
+	assert.Error(t, err)
+}
+
+func TestRedisServer_SetTextProtocol(t *testing.T) {
+	s := newTestServer()
+	s.SetTextProtocol()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader("*1\nSET k v\nGET k\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "ERR unknown command '*1'\nOK\nv\n", out.String())
+}
+
+func TestRedisServer_LenientLineEndings(t *testing.T) {
+	crlfInput := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+	lfInput := "*3\n$3\nSET\n$3\nfoo\n$3\nbar\n" +
+		"*2\n$3\nGET\n$3\nfoo\n" +
+		"*2\r\n$3\r\nGET\n$3\nfoo\r\n"
+
+	// Strict by default.
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(crlfInput), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n", out.String())
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(lfInput), &out})
+	assert.Error(t, err)
+
+	s = newTestServer()
+	s.SetLenientLineEndings()
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(crlfInput), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n", out.String())
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(lfInput), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n$3\r\nbar\r\n", out.String())
+}
+
+func TestRedisServer_AddReplace(t *testing.T) {
+	s := newTestServer()
+	input := "*3\r\n$7\r\nREPLACE\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*3\r\n$3\r\nADD\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*3\r\n$3\r\nADD\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n" +
+		"*5\r\n$7\r\nREPLACE\r\n$3\r\nfoo\r\n$3\r\nqux\r\n$2\r\nEX\r\n$2\r\n10\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$3\r\nADD\r\n$3\r\nfoo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, ":0\r\n:1\r\n:0\r\n:1\r\n$3\r\nqux\r\n"+
+		"-ERR wrong number of arguments for 'add' command\r\n", out.String())
+}
+
+func TestRedisServer_Mset(t *testing.T) {
+	s := newTestServer()
+	input := "*5\r\n$4\r\nMSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n$3\r\nbaz\r\n$3\r\nqux\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nbaz\r\n" +
+		"*4\r\n$4\r\nMSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n$3\r\nbaz\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n$3\r\nqux\r\n"+
+		"-ERR wrong number of arguments for 'mset' command\r\n", out.String())
+}
+
+func TestRedisServer_ValueTooLarge(t *testing.T) {
+	s := newTestServer()
+	val := strings.Repeat("v", 1025)
+	input := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$%d\r\n%s\r\n", len(val), val) +
+		fmt.Sprintf("*3\r\n$3\r\nADD\r\n$3\r\nfoo\r\n$%d\r\n%s\r\n", len(val), val) +
+		fmt.Sprintf("*5\r\n$4\r\nMSET\r\n$3\r\nbar\r\n$3\r\nbaz\r\n$3\r\nfoo\r\n$%d\r\n%s\r\n",
+			len(val), val) +
+		"*2\r\n$6\r\nEXISTS\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$6\r\nEXISTS\r\n$3\r\nbar\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR value exceeds max size 1024\r\n"+
+		"-ERR value exceeds max size 1024\r\n"+
+		"-ERR value exceeds max size 1024\r\n"+
+		":0\r\n:0\r\n", out.String())
+}
+
+func TestRedisServer_KeyValSize(t *testing.T) {
+	s := newTestServer()
+	key := strings.Repeat("k", 16*1024+1)
+	input := "*3\r\n$3\r\nSET\r\n$0\r\n\r\n$3\r\nbar\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$0\r\n\r\n" +
+		fmt.Sprintf("*3\r\n$7\r\nREPLACE\r\n$%d\r\n%s\r\n$3\r\nbar\r\n", len(key), key) +
+		"*2\r\n$6\r\nEXISTS\r\n$3\r\nfoo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR key is shorter than min size 1\r\n"+
+		"-ERR value is shorter than min size 1\r\n"+
+		"-ERR key exceeds max size 16384\r\n"+
+		":0\r\n", out.String())
+
+	s = newTestServer()
+	s.SetTextProtocol()
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader("SET foo " + key + "\nGET foo\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "ERR value exceeds max size 1024\n(nil)\n", out.String())
+}
+
+func TestRedisServer_StreamedGet(t *testing.T) {
+	s := NewRedisServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:         1024 * 1024,
+		MaxKeySize:        1024,
+		MaxValSize:        64 * 1024,
+		MaxChunkedValSize: 4 * 1024 * 1024,
+	}))
+	val := strings.Repeat("0123456789", 300*1024)
+	input := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$3\r\nbig\r\n$%d\r\n%s\r\n", len(val), val) +
+		"*2\r\n$3\r\nGET\r\n$3\r\nbig\r\n" +
+		"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("+OK\r\n$%d\r\n%s\r\n$-1\r\n", len(val), val), out.String())
+}
+
+func TestRedisServer_Multi(t *testing.T) {
+	input := "*1\r\n$4\r\nEXEC\r\n" +
+		"*1\r\n$7\r\nDISCARD\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$2\r\n11\r\n" +
+		"*2\r\n$3\r\nSET\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$5\r\nEVICT\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$7\r\nDISCARD\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	// Commands which fail to queue are rejected, without aborting the
+	// transaction.
+	assert.Equal(t, "-ERR EXEC without MULTI\r\n"+
+		"-ERR DISCARD without MULTI\r\n"+
+		"+OK\r\n"+
+		"-ERR MULTI calls can not be nested\r\n"+
+		"+QUEUED\r\n"+
+		"-ERR wrong number of arguments for 'set' command\r\n"+
+		"-ERR command not allowed in MULTI\r\n"+
+		"+QUEUED\r\n"+
+		"*2\r\n+OK\r\n$2\r\n11\r\n"+
+		"+OK\r\n+QUEUED\r\n+OK\r\n"+
+		"$2\r\n11\r\n", out.String())
+}
+
+func TestRedisServer_Watch(t *testing.T) {
+	s := newTestServer()
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		// Changed after WATCH, so EXEC is aborted.
+		"*2\r\n$5\r\nWATCH\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*2\r\n$5\r\nWATCH\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nqux\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		// EXEC unwatched foo, so this succeeds.
+		"*3\r\n$5\r\nWATCH\r\n$3\r\nbar\r\n$3\r\nbaz\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nqux\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n" +
+		// Changes after UNWATCH don't abort EXEC.
+		"*2\r\n$5\r\nWATCH\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$7\r\nUNWATCH\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n" +
+		"*1\r\n$5\r\nWATCH\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n+OK\r\n+OK\r\n+OK\r\n"+
+		"-ERR WATCH inside MULTI is not allowed\r\n+QUEUED\r\n*-1\r\n$3\r\nbaz\r\n"+
+		"+OK\r\n+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n"+
+		"+OK\r\n+OK\r\n:1\r\n+OK\r\n+QUEUED\r\n*1\r\n$-1\r\n"+
+		"-ERR wrong number of arguments for 'watch' command\r\n", out.String())
+}
+
+func TestRedisServer_Flags(t *testing.T) {
+	s := newTestServer()
+	input := "*3\r\n$8\r\nSETFLAGS\r\n$3\r\nfoo\r\n$1\r\n7\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$8\r\nGETFLAGS\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$8\r\nSETFLAGS\r\n$3\r\nfoo\r\n$1\r\n7\r\n" +
+		"*2\r\n$8\r\nGETFLAGS\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$8\r\nSETFLAGS\r\n$3\r\nfoo\r\n$2\r\n-1\r\n" +
+		// Storing a value clears the flags.
+		"*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n" +
+		"*2\r\n$8\r\nGETFLAGS\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$8\r\nGETFLAGS\r\n$7\r\nmissing\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, ":0\r\n+OK\r\n:0\r\n:1\r\n:7\r\n"+
+		"-ERR value is not an integer or out of range\r\n"+
+		"+OK\r\n:0\r\n$-1\r\n", out.String())
+}
+
+func TestRedisServer_Evict(t *testing.T) {
+	s := newTestServer()
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$5\r\nEVICT\r\n$3\r\nbaz\r\n" +
+		"*2\r\n$5\r\nEVICT\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$5\r\nEVICT\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Regexp(t, "^\\+OK\r\n:0\r\n:[1-9][0-9]*\r\n\\$-1\r\n"+
+		"-ERR wrong number of arguments for 'evict' command\r\n$", out.String())
+}
+
+func TestRedisServer_Strlen(t *testing.T) {
+	s := newTestServer()
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$5\r\nhello\r\n" +
+		"*2\r\n$6\r\nSTRLEN\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$6\r\nSTRLEN\r\n$3\r\nbar\r\n" +
+		"*1\r\n$6\r\nSTRLEN\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n:5\r\n:0\r\n"+
+		"-ERR wrong number of arguments for 'strlen' command\r\n", out.String())
+}
+
+func TestRedisServer_GetSetRange(t *testing.T) {
+	s := newTestServer()
+	input := "*4\r\n$8\r\nSETRANGE\r\n$3\r\nfoo\r\n$1\r\n1\r\n$3\r\nabc\r\n" +
+		"*4\r\n$8\r\nGETRANGE\r\n$3\r\nfoo\r\n$1\r\n0\r\n$2\r\n-2\r\n" +
+		"*4\r\n$8\r\nGETRANGE\r\n$3\r\nbar\r\n$1\r\n0\r\n$2\r\n-1\r\n" +
+		"*4\r\n$8\r\nSETRANGE\r\n$3\r\nfoo\r\n$2\r\n-1\r\n$1\r\nx\r\n" +
+		"*4\r\n$8\r\nSETRANGE\r\n$3\r\nfoo\r\n$4\r\n1024\r\n$1\r\nx\r\n" +
+		"*3\r\n$8\r\nGETRANGE\r\n$3\r\nfoo\r\n$1\r\n0\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, ":4\r\n$3\r\n\x00ab\r\n$0\r\n\r\n"+
+		"-ERR offset is out of range\r\n"+
+		"-ERR string exceeds maximum allowed size\r\n"+
+		"-ERR wrong number of arguments for 'getrange' command\r\n", out.String())
+}
+
+func TestRedisServer_WasCached(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$9\r\nWASCACHED\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$9\r\nWASCACHED\r\n$3\r\nbaz\r\n"
+
+	s := NewRedisServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:          1024 * 1024,
+		MaxValSize:         1024,
+		SeenKeysFilterBits: 1024,
+	}))
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n:1\r\n:1\r\n:0\r\n", out.String())
+
+	s = newTestServer()
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n:1\r\n-ERR seen keys are not being tracked\r\n"+
+		"-ERR seen keys are not being tracked\r\n", out.String())
+}
+
+func TestRedisServer_DebugTables(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$5\r\nDEBUG\r\n$6\r\nTABLES\r\n"
+
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n+OK\r\n:1\r\n-ERR unknown DEBUG subcommand 'TABLES'\r\n",
+		out.String())
+
+	s = newTestServer()
+	s.EnableDebugCommands()
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n+OK\r\n:1\r\n*1\r\n"+
+		"+generation:0 size:1048576 entries:1 deleted:1 live_space:14 deleted_space:14 free_space:1048548\r\n",
+		out.String())
+}
+
+func TestRedisServer_DebugReclaim(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nbaz\r\n$3\r\nqux\r\n" +
+		"*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$5\r\nDEBUG\r\n$7\r\nRECLAIM\r\n"
+
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n+OK\r\n:1\r\n-ERR unknown DEBUG subcommand 'RECLAIM'\r\n",
+		out.String())
+
+	s = newTestServer()
+	s.EnableDebugCommands()
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n+OK\r\n:1\r\n:14\r\n", out.String())
+}
+
+func TestRedisServer_DebugHotKeys(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$5\r\nDEBUG\r\n$7\r\nHOTKEYS\r\n"
+
+	s := newTestServer()
+	s.EnableDebugCommands()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n-ERR hot keys are not being tracked\r\n",
+		out.String())
+
+	s = NewRedisServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:        1024 * 1024,
+		MaxValSize:       1024,
+		HotKeySampleRate: 1,
+	}))
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n-ERR unknown DEBUG subcommand 'HOTKEYS'\r\n",
+		out.String())
+
+	s.EnableDebugCommands()
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(input +
+		"*3\r\n$5\r\nDEBUG\r\n$7\r\nHOTKEYS\r\n$1\r\n0\r\n"), &out})
+	assert.NoError(t, err)
+	// foo has been read twice, and rates are measured over at least a second.
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n*1\r\n*2\r\n$3\r\nfoo\r\n:2\r\n"+
+		"-ERR value is out of range, must be positive\r\n", out.String())
+}
+
+func TestRedisServer_ConfigMaxMemory(t *testing.T) {
+	c := dory.NewMemcache(dory.MemcacheOptions{
+		MemoryFunction: dory.ConstantMemory(8 * 1024 * 1024),
+		TableSize:      1024 * 1024,
+		MaxValSize:     1024,
+	})
+	defer c.Close()
+	s := NewRedisServer(c)
+	getInput := "*3\r\n$6\r\nCONFIG\r\n$3\r\nGET\r\n$9\r\nmaxmemory\r\n"
+	input := getInput +
+		"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$9\r\nmaxmemory\r\n$7\r\n2097152\r\n" +
+		getInput +
+		"*4\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$9\r\nmaxmemory\r\n$2\r\n-1\r\n" +
+		"*3\r\n$6\r\nCONFIG\r\n$3\r\nGET\r\n$7\r\nappendf\r\n" +
+		"*2\r\n$6\r\nCONFIG\r\n$7\r\nREWRITE\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	// The new limit is reported straight away.
+	assert.Equal(t, "*2\r\n$9\r\nmaxmemory\r\n$7\r\n8388608\r\n+OK\r\n"+
+		"*2\r\n$9\r\nmaxmemory\r\n$7\r\n2097152\r\n"+
+		"-ERR value is not an integer or out of range\r\n"+
+		"-ERR unsupported CONFIG parameter 'appendf'\r\n"+
+		"-ERR unknown CONFIG subcommand 'REWRITE'\r\n", out.String())
+}
+
+func TestRedisServer_Arity(t *testing.T) {
+	input := "*1\r\n$3\r\nDEL\r\n" +
+		"*3\r\n$3\r\nGET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$6\r\nEXISTS\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$5\r\nMULTI\r\n" +
+		"*2\r\n$3\r\nSET\r\n$3\r\nfoo\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n"
+
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR wrong number of arguments for 'del' command\r\n"+
+		"-ERR wrong number of arguments for 'get' command\r\n"+
+		":0\r\n+OK\r\n"+
+		"-ERR wrong number of arguments for 'set' command\r\n"+
+		"*0\r\n", out.String())
+}
+
+func TestRedisServer_Command(t *testing.T) {
+	input := "*2\r\n$7\r\nCOMMAND\r\n$5\r\nCOUNT\r\n" +
+		"*2\r\n$7\r\nCOMMAND\r\n$4\r\nINFO\r\n" +
+		"*1\r\n$7\r\nCOMMAND\r\n"
+
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), fmt.Sprintf(":%d\r\n", len(respCommands))+
+		"-ERR unknown subcommand 'INFO'. Only COMMAND and COMMAND COUNT are supported\r\n"+
+		fmt.Sprintf("*%d\r\n", len(respCommands))+
+		"*3\r\n$3\r\nset\r\n:-3\r\n*1\r\n+write\r\n"), out.String())
+	assert.Contains(t, out.String(), "*3\r\n$3\r\nget\r\n:2\r\n*1\r\n+readonly\r\n")
+}
+
+func TestRedisServer_Memory(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*3\r\n$6\r\nMEMORY\r\n$5\r\nUSAGE\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$6\r\nMEMORY\r\n$5\r\nUSAGE\r\n$3\r\nbaz\r\n" +
+		"*2\r\n$6\r\nMEMORY\r\n$5\r\nSTATS\r\n"
+
+	s := newTestServer()
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "+OK\r\n:14\r\n$-1\r\n*18\r\n"+
+		"$10\r\nkeys.count\r\n:1\r\n$12\r\ntables.count\r\n:1\r\n"), out.String())
+	assert.Contains(t, out.String(), "$12\r\ntables.bytes\r\n:1048576\r\n")
+	assert.Contains(t, out.String(), "$10\r\nlive.bytes\r\n:14\r\n")
+	assert.Contains(t, out.String(), "$13\r\ndeleted.bytes\r\n:0\r\n")
+	assert.Contains(t, out.String(), "$10\r\nfree.bytes\r\n:1048562\r\n")
+	assert.Contains(t, out.String(), "$9\r\nrss.bytes\r\n:")
+}
+
+func TestRedisServer_ConcurrencyLimits(t *testing.T) {
+	s := newTestServer()
+	s.SetConcurrencyLimits(0, 1)
+	// Occupy the only write slot.
+	s.writeLimit.acquire()
+
+	// Reads aren't blocked by writes.
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "$-1\r\n", out.String())
+
+	done := make(chan struct{})
+	var setOut bytes.Buffer
+	go func() {
+		defer close(done)
+		err := s.Serve(testConn{strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"), &setOut})
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-done:
+		t.Fatal("SET didn't wait for the write limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.writeLimit.release()
+	<-done
+	assert.Equal(t, "+OK\r\n", setOut.String())
+}
+
+// Records the size of each write.
+type writeRecorder struct {
+	writes []int
+	bytes.Buffer
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestRedisServer_SetBufferSize(t *testing.T) {
+	s := newTestServer()
+	val := strings.Repeat("v", 1000)
+	input := fmt.Sprintf("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$%d\r\n%s\r\n", len(val), val)
+	get := "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+
+	// Pipelined GETs are flushed whenever the default buffer fills.
+	out := &writeRecorder{}
+	err := s.Serve(testConn{strings.NewReader(input + strings.Repeat(get, 20)), out})
+	assert.NoError(t, err)
+	assert.True(t, len(out.writes) > 2)
+
+	// With a larger buffer, the GETs are sent in a single write.
+	out = &writeRecorder{}
+	input += "*2\r\n$15\r\nSET-BUFFER-SIZE\r\n$5\r\n65536\r\n"
+	err = s.Serve(testConn{strings.NewReader(input + strings.Repeat(get, 20)), out})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(out.writes))
+	assert.True(t, strings.HasPrefix(out.String(), "+OK\r\n+OK\r\n$1000\r\n"))
+
+	var errOut bytes.Buffer
+	err = s.Serve(testConn{strings.NewReader("*2\r\n$15\r\nSET-BUFFER-SIZE\r\n$1\r\n1\r\n"), &errOut})
+	assert.NoError(t, err)
+	assert.Equal(t, "-ERR buffer size must be between 256 and 1048576\r\n", errOut.String())
+}
+
+func TestRedisServer_ReadLargeBulk(t *testing.T) {
+	s := newTestServer()
+	for _, length := range []int{10, respLargeBulkLength - 1, respLargeBulkLength, 3 * respLargeBulkLength} {
+		val := strings.Repeat("v", length)
+		input := fmt.Sprintf("$%d\r\n%s\r\n", length, val)
+		msg, err := s.readMessage(bufio.NewReader(strings.NewReader(input)))
+		assert.NoError(t, err)
+		buf := msg.(*[]byte)
+		assert.Equal(t, val, string(*buf))
+		if length >= respLargeBulkLength {
+			// Exactly sized, rather than rounded up to a pooled buffer size.
+			assert.Equal(t, length+2, cap(*buf))
+		}
+	}
+}
+
+func TestRedisServer_SoftLimit(t *testing.T) {
+	s := NewRedisServer(dory.NewMemcache(dory.MemcacheOptions{
+		MemoryFunction:    dory.ConstantMemory(4 * 64 * 1024),
+		TableSize:         64 * 1024,
+		MaxValSize:        1024,
+		SoftLimitFraction: 0.25,
+	}))
+
+	val := strings.Repeat("v", 1000)
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		fmt.Fprintf(&input, "*3\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+			len(key), key, len(val), val)
+	}
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input.String()), &out})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out.String(), "+OK\r\n"))
+	assert.True(t, strings.HasSuffix(out.String(),
+		"-OOM write rejected, cache is at its soft memory limit\r\n"))
+}
+
+func TestRedisServer_ObjectIdletime(t *testing.T) {
+	s := newTestServer()
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*3\r\n$6\r\nOBJECT\r\n$8\r\nIDLETIME\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$6\r\nOBJECT\r\n$8\r\nidletime\r\n$7\r\nmissing\r\n" +
+		"*3\r\n$6\r\nOBJECT\r\n$8\r\nENCODING\r\n$3\r\nfoo\r\n"
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n:1\r\n$-1\r\n-ERR unknown OBJECT subcommand 'ENCODING'\r\n",
+		out.String())
+}
+
+func TestRedisServer_ObjectFreq(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$6\r\nOBJECT\r\n$4\r\nFREQ\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$6\r\nOBJECT\r\n$4\r\nFREQ\r\n$7\r\nmissing\r\n"
+
+	s := NewRedisServer(dory.NewMemcache(dory.MemcacheOptions{
+		TableSize:               1024 * 1024,
+		MaxValSize:              1024,
+		FrequencySketchCounters: 1024,
+	}))
+	var out bytes.Buffer
+	err := s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n$3\r\nbar\r\n:2\r\n$-1\r\n", out.String())
+
+	s = newTestServer()
+	out.Reset()
+	err = s.Serve(testConn{strings.NewReader(input), &out})
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK\r\n$3\r\nbar\r\n$3\r\nbar\r\n"+
+		"-ERR access frequencies are not being tracked\r\n"+
+		"-ERR access frequencies are not being tracked\r\n", out.String())
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/akmistry/go-util/bufferpool"
+)
+
+const (
+	// Extra space allowed in a text protocol line, beyond the key and value,
+	// for the command and separators.
+	textLineOverhead = 16
+)
+
+var (
+	textResponseOk  = []byte("OK\n")
+	textResponseNil = []byte("(nil)\n")
+)
+
+// isRespType returns whether b is the first byte of a RESP message. Clients
+// which start with anything else are served using the text protocol.
+func isRespType(b byte) bool {
+	switch b {
+	case respTypeSimpleString, respTypeError, respTypeInteger, respTypeBulkString, respTypeArray:
+		return true
+	}
+	return false
+}
+
+// readTextLine reads a line terminated by LF, with any trailing CR removed.
+// The returned slice is only valid until the next read from r.
+func (s *RedisServer) readTextLine(r *bufio.Reader, out []byte) ([]byte, error) {
+	c := s.cache()
+	maxLen := c.MaxKeySize() + c.MaxValSize() + textLineOverhead
+	for {
+		buf, err := r.ReadSlice('\n')
+		if len(out)+len(buf) > maxLen {
+			return nil, fmt.Errorf("RedisServer: text line length > max %d", maxLen)
+		}
+		if err == bufio.ErrBufferFull {
+			out = append(out, buf...)
+			continue
+		} else if err != nil {
+			if err == io.EOF && len(out)+len(buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if out != nil {
+			buf = append(out, buf...)
+		}
+		buf = buf[:len(buf)-1]
+		if len(buf) > 0 && buf[len(buf)-1] == '\r' {
+			buf = buf[:len(buf)-1]
+		}
+		return buf, nil
+	}
+}
+
+// serveText serves the plain text line protocol, for clients which can't
+// speak RESP. Each request is a single line, one of:
+//
+//	GET key
+//	SET key value
+//	DEL key
+//
+// The value of SET is the rest of the line, and may contain spaces. Each
+// response is a single line: the value or "(nil)" for GET, "OK" for SET and
+// DEL, or an error message. Values containing newlines can't be stored or
+// retrieved unambiguously using this protocol.
+func (s *RedisServer) serveText(r *bufio.Reader, w *bufio.Writer) error {
+	for {
+		line, err := s.readTextLine(r, nil)
+		if err == io.EOF {
+			// Connection closed. Non-error.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		err = s.doTextCommand(line, w)
+		if cmdErr, ok := err.(*respError); ok {
+			err = s.writeTextLine(w, []byte(cmdErr.msg))
+		}
+		if err == nil && r.Buffered() == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *RedisServer) doTextCommand(line []byte, w *bufio.Writer) error {
+	cmd, args, _ := bytes.Cut(line, []byte{' '})
+	if s.readOnly && (equalsCommand(cmd, respCmdSet) || equalsCommand(cmd, respCmdDel)) {
+		return errReadOnly
+	}
+
+	c := s.cache()
+	if equalsCommand(cmd, respCmdSet) {
+		key, value, ok := bytes.Cut(args, []byte{' '})
+		if !ok || len(key) == 0 || len(value) == 0 {
+			return wrongArgsError("set")
+		}
+		if err := s.checkKeyVal(c, key, value); err != nil {
+			return err
+		}
+		if err := c.Put(key, value); err != nil {
+			return putError(err)
+		}
+		_, err := w.Write(textResponseOk)
+		return err
+	} else if equalsCommand(cmd, respCmdGet) {
+		if len(args) == 0 || bytes.IndexByte(args, ' ') >= 0 {
+			return wrongArgsError("get")
+		}
+		getBuf := bufferpool.GetUninit(getBufSize(c))
+		defer bufferpool.Put(getBuf)
+		val := c.Get(args, (*getBuf)[:0])
+		if val == nil {
+			_, err := w.Write(textResponseNil)
+			return err
+		}
+		return s.writeTextLine(w, val)
+	} else if equalsCommand(cmd, respCmdDel) {
+		if len(args) == 0 || bytes.IndexByte(args, ' ') >= 0 {
+			return wrongArgsError("del")
+		}
+		c.Delete(args)
+		_, err := w.Write(textResponseOk)
+		return err
+	}
+	return commandError("unknown command '%s'", string(cmd))
+}
+
+func (s *RedisServer) writeTextLine(w *bufio.Writer, line []byte) error {
+	_, err := w.Write(line)
+	if err == nil {
+		err = w.WriteByte('\n')
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/akmistry/dory"
+)
+
+// sizeError is returned by validateKeyVal when a key or value is outside the
+// cache's size limits.
+type sizeError struct {
+	msg string
+	// Whether the key, rather than the value, is the wrong size.
+	key bool
+	// Whether the key or value is too large, rather than too small.
+	tooLarge bool
+}
+
+func (e *sizeError) Error() string {
+	return e.msg
+}
+
+// validateKeyVal returns a *sizeError if key or val is outside the cache's
+// size limits, otherwise nil. The cache silently drops entries which don't
+// fit, so every protocol checks writes with this up front, to reject the same
+// writes and let the client know its write didn't succeed.
+func validateKeyVal(c dory.Cache, key, val []byte) error {
+	if len(key) < c.MinKeySize() {
+		return &sizeError{fmt.Sprintf("key is shorter than min size %d", c.MinKeySize()), true, false}
+	} else if len(key) > c.MaxKeySize() {
+		return &sizeError{fmt.Sprintf("key exceeds max size %d", c.MaxKeySize()), true, true}
+	} else if len(val) < c.MinValSize() {
+		return &sizeError{fmt.Sprintf("value is shorter than min size %d", c.MinValSize()), false, false}
+	} else if len(val) > c.MaxValSize() {
+		return &sizeError{fmt.Sprintf("value exceeds max size %d", c.MaxValSize()), false, true}
+	}
+	return nil
+}
+
+// getBufSize returns the size of buffer to read a value of c into. It's capped
+// at streamValSize, since MaxValSize can be very large when chunked values are
+// enabled, and buffers that large wouldn't be pooled. Larger values grow the
+// buffer as they're appended to it.
+func getBufSize(c dory.Cache) int {
+	if size := c.MaxValSize(); size < streamValSize {
+		return size
+	}
+	return streamValSize
+}
@@ -0,0 +1,60 @@
+package dory
+
+import (
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	singleFlightShared = prom.NewCounter(prom.CounterOpts{
+		Name: "dory_single_flight_shared_gets_total",
+		Help: "Number of Gets which shared the result of a concurrent Get of the same key.",
+	})
+)
+
+func init() {
+	prom.MustRegister(singleFlightShared)
+}
+
+// An in-progress call for a key.
+type flightCall struct {
+	done chan struct{}
+	val  []byte
+	ok   bool
+}
+
+// flightGroup combines concurrent calls for the same key into a single call.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// Calls fn, unless a call for the same key is already in progress, in which
+// case waits for that call and returns its result. The returned value may be
+// shared between callers, so must not be modified.
+func (g *flightGroup) do(key []byte, fn func() ([]byte, bool)) ([]byte, bool) {
+	g.lock.Lock()
+	if call, ok := g.calls[string(key)]; ok {
+		g.lock.Unlock()
+		singleFlightShared.Inc()
+		<-call.done
+		return call.val, call.ok
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[string(key)] = call
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, string(key))
+		g.lock.Unlock()
+		close(call.done)
+	}()
+	call.val, call.ok = fn()
+	return call.val, call.ok
+}
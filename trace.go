@@ -0,0 +1,48 @@
+//go:build dorytrace
+
+package dory
+
+import (
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lockWaitTime = prom.NewHistogramVec(prom.HistogramOpts{
+		Name:    "dory_lock_wait_seconds",
+		Help:    "Time spent waiting to acquire the cache lock.",
+		Buckets: prom.ExponentialBuckets(1e-7, 4, 12),
+	}, []string{"op"})
+	lockHeldTime = prom.NewHistogramVec(prom.HistogramOpts{
+		Name:    "dory_lock_held_seconds",
+		Help:    "Time spent holding the cache lock.",
+		Buckets: prom.ExponentialBuckets(1e-7, 4, 12),
+	}, []string{"op"})
+)
+
+func init() {
+	prom.MustRegister(lockWaitTime)
+	prom.MustRegister(lockHeldTime)
+}
+
+// trace measures the time an operation spends waiting for, and holding, the
+// cache lock. Only enabled when built with the dorytrace build tag.
+type trace struct {
+	start  time.Time
+	locked time.Time
+}
+
+func startTrace() trace {
+	return trace{start: time.Now()}
+}
+
+func (t *trace) lockAcquired() {
+	t.locked = time.Now()
+}
+
+func (t *trace) finish(op string) {
+	now := time.Now()
+	lockWaitTime.WithLabelValues(op).Observe(t.locked.Sub(t.start).Seconds())
+	lockHeldTime.WithLabelValues(op).Observe(now.Sub(t.locked).Seconds())
+}
@@ -0,0 +1,14 @@
+//go:build !dorytrace
+
+package dory
+
+// trace is a no-op when built without the dorytrace build tag.
+type trace struct{}
+
+func startTrace() trace {
+	return trace{}
+}
+
+func (t *trace) lockAcquired() {}
+
+func (t *trace) finish(op string) {}
@@ -0,0 +1,76 @@
+package dory
+
+import (
+	"time"
+)
+
+// Txn performs operations on a Memcache while holding the cache's lock, so
+// that a sequence of operations is applied atomically. A Txn is only valid
+// inside the function passed to Memcache.Atomically.
+type Txn struct {
+	c *Memcache
+}
+
+// Atomically calls fn with a Txn that can be used to perform several
+// operations on the cache atomically. No other operations on the cache can
+// proceed until fn returns, so fn should be quick, and MUST NOT call any
+// Memcache methods directly.
+func (c *Memcache) Atomically(fn func(tx *Txn)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fn(&Txn{c: c})
+}
+
+func (tx *Txn) Has(key []byte) bool {
+	return tx.c.has(key)
+}
+
+func (tx *Txn) Get(key, buf []byte) []byte {
+	return tx.c.get(key, buf)
+}
+
+// TTL returns the remaining TTL of the key, or 0 if the key has no TTL or
+// doesn't exist.
+func (tx *Txn) TTL(key []byte) time.Duration {
+	return tx.c.ttl(key)
+}
+
+func (tx *Txn) Put(key, val []byte) error {
+	return tx.c.put(key, val, 0)
+}
+
+func (tx *Txn) Stat(key []byte) (int, bool) {
+	return tx.c.stat(key)
+}
+
+func (tx *Txn) GetRange(key []byte, start, end int, buf []byte) ([]byte, bool) {
+	return tx.c.getRange(key, start, end, buf)
+}
+
+func (tx *Txn) SetRange(key []byte, offset int, val []byte) (int, error) {
+	return tx.c.setRange(key, offset, val)
+}
+
+func (tx *Txn) PutBatch(keys, vals [][]byte) error {
+	return tx.c.putBatch(keys, vals)
+}
+
+func (tx *Txn) PutWithTTL(key, val []byte, ttl time.Duration) error {
+	return tx.c.put(key, val, ttl)
+}
+
+func (tx *Txn) PutEvicting(key, val []byte, ttl time.Duration) (bool, error) {
+	return tx.c.putEvicting(key, val, ttl)
+}
+
+func (tx *Txn) Add(key, val []byte, ttl time.Duration) (bool, error) {
+	return tx.c.add(key, val, ttl)
+}
+
+func (tx *Txn) Replace(key, val []byte, ttl time.Duration) (bool, error) {
+	return tx.c.replace(key, val, ttl)
+}
+
+func (tx *Txn) Delete(key []byte) {
+	tx.c.delete(key)
+}
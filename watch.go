@@ -0,0 +1,85 @@
+package dory
+
+// watchedKey tracks changes to a key with at least one watcher.
+type watchedKey struct {
+	version  uint64
+	watchers int
+}
+
+// Watch starts tracking changes to the key, and returns its current version.
+// The version changes whenever the key is stored, deleted, expires or is
+// evicted, but not when it is read, or moved by promotion or GC. It can be
+// compared with the version returned by Txn.KeyVersion to detect a change
+// before applying a transaction. Every Watch must be paired with an Unwatch.
+func (c *Memcache) Watch(key []byte) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.watched == nil {
+		c.watched = make(map[string]*watchedKey)
+	}
+	w, ok := c.watched[string(key)]
+	if !ok {
+		c.watchVersion++
+		w = &watchedKey{version: c.watchVersion}
+		c.watched[string(key)] = w
+	}
+	w.watchers++
+	return w.version
+}
+
+// Unwatch stops tracking changes to the key, for one earlier Watch.
+func (c *Memcache) Unwatch(key []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	w, ok := c.watched[string(key)]
+	if !ok {
+		panic("Unwatch without Watch")
+	}
+	w.watchers--
+	if w.watchers == 0 {
+		delete(c.watched, string(key))
+	}
+}
+
+// KeyVersion returns the current version of a key being watched, or 0 if the
+// key isn't being watched.
+func (tx *Txn) KeyVersion(key []byte) uint64 {
+	if w, ok := tx.c.watched[string(key)]; ok {
+		return w.version
+	}
+	return 0
+}
+
+// Records a change to the key, if it is being watched. Must be called with the
+// lock held.
+func (c *Memcache) keyChanged(key []byte) {
+	if len(c.watched) == 0 {
+		return
+	}
+	if w, ok := c.watched[string(key)]; ok {
+		c.watchVersion++
+		w.version = c.watchVersion
+	}
+}
+
+// Records a change to every watched key with a value, or chunk, in |t|, which
+// is about to be discarded. Must be called with the lock held.
+func (c *Memcache) tableChanged(t *DiscardableTable) {
+	for key, w := range c.watched {
+		for _, kt := range c.keyTables([]byte(key)) {
+			if kt == t {
+				c.watchVersion++
+				w.version = c.watchVersion
+				break
+			}
+		}
+	}
+}
+
+// Records a change to every watched key. Must be called with the lock held.
+func (c *Memcache) allKeysChanged() {
+	for _, w := range c.watched {
+		c.watchVersion++
+		w.version = c.watchVersion
+	}
+}